@@ -0,0 +1,19 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/LQR471814/scavenge/downloader/middleware"
+)
+
+func compact(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected exactly one replay log path")
+	}
+	before, after, err := middleware.CompactReplayLog(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("compacted '%s' from %d bytes to %d bytes\n", args[0], before, after)
+	return nil
+}
@@ -0,0 +1,65 @@
+// Command scavenge contains utilities for working with the data scavenge stores.
+//
+// Usage:
+//
+//	scavenge compact <replay log>
+//	scavenge migrate [-compression none|gzip|zstd] <replay dir> [sessions...]
+//	scavenge record [-addr host:port] [-session name] [-ca dir] [-all] [-compression none|gzip|zstd] <replay dir>
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"compact": {
+		usage: "compact <replay log>\n\tcompacts a middleware.LogReplayStore file, it must not be in use",
+		run:   compact,
+	},
+	"migrate": {
+		usage: "migrate [-compression none|gzip|zstd] <replay dir> [sessions...]\n\trewrites the responses of a middleware.FSReplayStore in the current format, by default all sessions are migrated",
+		run:   migrate,
+	},
+	"record": {
+		usage: "record [-addr host:port] [-session name] [-ca dir] [-all] [-compression none|gzip|zstd] <replay dir>\n\truns a proxy that records the responses of a browsing session into a middleware.FSReplayStore",
+		run:   recordSession,
+	},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: scavenge <command> [arguments]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "commands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	err := cmd.run(os.Args[2:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/LQR471814/scavenge"
+	"github.com/LQR471814/scavenge/downloader/middleware"
+)
+
+var compressions = map[string]middleware.ReplayCompression{
+	"none": middleware.ReplayCompressionNone,
+	"gzip": middleware.ReplayCompressionGzip,
+	"zstd": middleware.ReplayCompressionZstd,
+}
+
+func migrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	compression := flags.String("compression", "gzip", "compression of the migrated responses (none, gzip or zstd)")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() < 1 {
+		return fmt.Errorf("expected a replay directory")
+	}
+	c, ok := compressions[*compression]
+	if !ok {
+		return fmt.Errorf("unknown compression '%s'", *compression)
+	}
+
+	dir := flags.Arg(0)
+	sessions := flags.Args()[1:]
+	if len(sessions) == 0 {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.IsDir() {
+				sessions = append(sessions, e.Name())
+			}
+		}
+	}
+
+	logger := scavenge.NewSlogLogger(slog.New(slog.NewTextHandler(os.Stderr, nil)), false)
+	ctx := scavenge.ContextWithLogger(context.Background(), logger)
+
+	// migration never decodes request meta, so the meta encoder is unused
+	store := middleware.NewFSReplayStore(dir, middleware.GobMetaEncoder{}, middleware.WithFSReplayCompression(c))
+	for _, session := range sessions {
+		n, err := store.Migrate(ctx, session)
+		if err != nil {
+			return fmt.Errorf("session '%s': %w", session, err)
+		}
+		fmt.Printf("migrated %d responses in session '%s'\n", n, session)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+
+	"github.com/LQR471814/scavenge"
+	"github.com/LQR471814/scavenge/downloader/middleware"
+	"github.com/LQR471814/scavenge/record"
+)
+
+func recordSession(args []string) error {
+	flags := flag.NewFlagSet("record", flag.ContinueOnError)
+	addr := flags.String("addr", "127.0.0.1:8080", "address the proxy listens on")
+	session := flags.String("session", "default", "replay session the responses are stored in")
+	caDir := flags.String("ca", "", "directory of the certificate authority (ca.pem, ca-key.pem) used to record https, it is generated if it does not exist")
+	all := flags.Bool("all", false, "record all requests keyed by their fingerprint instead of only GET requests keyed by their url")
+	compression := flags.String("compression", "gzip", "compression of the stored responses (none, gzip or zstd)")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected a replay directory")
+	}
+	c, ok := compressions[*compression]
+	if !ok {
+		return fmt.Errorf("unknown compression '%s'", *compression)
+	}
+
+	handler := middleware.ReplayGetRequests
+	if *all {
+		handler = middleware.ReplayAllRequests
+	}
+	logger := scavenge.NewSlogLogger(slog.New(slog.NewTextHandler(os.Stderr, nil)), false)
+	store := middleware.NewFSReplayStore(flags.Arg(0), middleware.GobMetaEncoder{}, middleware.WithFSReplayCompression(c))
+
+	var proxy *record.Proxy
+	if *caDir == "" {
+		proxy, err = record.NewProxy(*session, store, handler, record.WithLogger(logger))
+	} else {
+		err = os.MkdirAll(*caDir, 0700)
+		if err != nil {
+			return err
+		}
+		certFile := filepath.Join(*caDir, "ca.pem")
+		var ca tls.Certificate
+		ca, err = record.LoadOrGenerateCA(certFile, filepath.Join(*caDir, "ca-key.pem"))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "https is recorded, the browser must trust '%s'\n", certFile)
+		proxy, err = record.NewProxy(*session, store, handler, record.WithLogger(logger), record.WithCA(ca))
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	fmt.Fprintf(os.Stderr, "recording through http://%s, press ctrl+c to stop\n", *addr)
+	return proxy.ListenAndServe(ctx, *addr)
+}
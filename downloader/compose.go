@@ -0,0 +1,193 @@
+package downloader
+
+import (
+	"context"
+
+	"github.com/gobwas/glob"
+)
+
+// chain runs middlewares in order as if they were a single middleware.
+type chain struct {
+	middleware []Middleware
+}
+
+// Chain combines the given middlewares into a single middleware that runs them in order (like
+// the Downloader does), middlewares in the chain can still be skipped with SkipMiddleware.
+//
+// A response returned by the HandleRequest of a middleware in the chain passes through the
+// middlewares before it in the chain and is then returned by the chain as a whole, so it only
+// passes through the response middlewares before it like it would without the chain.
+//
+// The name of a chain (see MiddlewareName) is "Chain", the middlewares in it are skipped by their
+// own names.
+func Chain(middleware ...Middleware) Middleware {
+	return chain{middleware: middleware}
+}
+
+func (c chain) Name() string {
+	return "Chain"
+}
+
+func (c chain) HandleRequest(ctx context.Context, req *Request, meta RequestMetadata) (*Response, error) {
+	middleware := activeMiddleware(req, c.middleware)
+	for i, mid := range middleware {
+		res, err := mid.HandleRequest(ctx, req, meta)
+		if err != nil {
+			return nil, err
+		}
+		if res != nil {
+			return handleResponse(ctx, middleware[:i], res, ResponseMetadata{
+				RequestMetadata: meta,
+				Replayed:        true,
+			})
+		}
+	}
+	return nil, nil
+}
+
+func (c chain) HandleResponse(ctx context.Context, res *Response, meta ResponseMetadata) (*Response, error) {
+	return handleResponse(ctx, activeMiddleware(res.Request(), c.middleware), res, meta)
+}
+
+func (c chain) HandleError(ctx context.Context, req *Request, meta RequestMetadata, err error) {
+	for _, mid := range activeMiddleware(req, c.middleware) {
+		emid, ok := mid.(ErrorMiddleware)
+		if ok {
+			emid.HandleError(ctx, req, meta, err)
+		}
+	}
+}
+
+// when runs a middleware only for the requests matching a predicate.
+type when struct {
+	predicate func(req *Request) bool
+	mid       Middleware
+}
+
+// When runs the given middleware only for requests (and the responses to requests) for which the
+// predicate returns true.
+//
+// The name of the returned middleware (see MiddlewareName) is the name of the given middleware,
+// so it is skipped by the same name.
+func When(predicate func(req *Request) bool, mid Middleware) Middleware {
+	return when{predicate: predicate, mid: mid}
+}
+
+func (w when) Name() string {
+	return MiddlewareName(w.mid)
+}
+
+func (w when) HandleRequest(ctx context.Context, req *Request, meta RequestMetadata) (*Response, error) {
+	if !w.predicate(req) {
+		return nil, nil
+	}
+	return w.mid.HandleRequest(ctx, req, meta)
+}
+
+func (w when) HandleResponse(ctx context.Context, res *Response, meta ResponseMetadata) (*Response, error) {
+	if !w.predicate(res.Request()) {
+		return nil, nil
+	}
+	return w.mid.HandleResponse(ctx, res, meta)
+}
+
+func (w when) HandleError(ctx context.Context, req *Request, meta RequestMetadata, err error) {
+	if !w.predicate(req) {
+		return
+	}
+	emid, ok := w.mid.(ErrorMiddleware)
+	if ok {
+		emid.HandleError(ctx, req, meta, err)
+	}
+}
+
+func compileHosts(hosts []string) []glob.Glob {
+	globs := make([]glob.Glob, len(hosts))
+	for i, h := range hosts {
+		globs[i] = glob.MustCompile(h, '.')
+	}
+	return globs
+}
+
+func matchHost(globs []glob.Glob, req *Request) bool {
+	hostname := req.Url.Hostname()
+	for _, g := range globs {
+		if g.Match(hostname) {
+			return true
+		}
+	}
+	return false
+}
+
+// ForHosts runs the given middlewares (in order) only for requests to hosts matching one of the
+// given globs (ex. "api.example.com", "*.example.com").
+//
+// Responses are matched by the host of their request, not the host they were redirected to.
+//
+// The name of the returned middleware (see MiddlewareName) is "ForHosts".
+func ForHosts(hosts []string, middleware ...Middleware) Middleware {
+	globs := compileHosts(hosts)
+	return Named("ForHosts", When(func(req *Request) bool {
+		return matchHost(globs, req)
+	}, Chain(middleware...)))
+}
+
+// HostStack is a stack of middleware used for requests to the hosts matching one of its globs.
+type HostStack struct {
+	Hosts      []string
+	Middleware []Middleware
+}
+
+type hostStack struct {
+	hosts []glob.Glob
+	chain Middleware
+}
+
+// hostStacks picks a middleware stack by the host of a request.
+type hostStacks struct {
+	stacks   []hostStack
+	fallback Middleware
+}
+
+// HostStacks runs a different stack of middleware depending on the host of the request, the
+// first stack with a glob matching the host is used, requests to other hosts use the fallback
+// stack.
+//
+// Responses are matched by the host of their request, not the host they were redirected to.
+//
+// The name of the returned middleware (see MiddlewareName) is "HostStacks".
+func HostStacks(fallback []Middleware, stacks ...HostStack) Middleware {
+	h := hostStacks{fallback: Chain(fallback...)}
+	for _, s := range stacks {
+		h.stacks = append(h.stacks, hostStack{
+			hosts: compileHosts(s.Hosts),
+			chain: Chain(s.Middleware...),
+		})
+	}
+	return h
+}
+
+func (h hostStacks) Name() string {
+	return "HostStacks"
+}
+
+func (h hostStacks) stack(req *Request) Middleware {
+	for _, s := range h.stacks {
+		if matchHost(s.hosts, req) {
+			return s.chain
+		}
+	}
+	return h.fallback
+}
+
+func (h hostStacks) HandleRequest(ctx context.Context, req *Request, meta RequestMetadata) (*Response, error) {
+	return h.stack(req).HandleRequest(ctx, req, meta)
+}
+
+func (h hostStacks) HandleResponse(ctx context.Context, res *Response, meta ResponseMetadata) (*Response, error) {
+	return h.stack(res.Request()).HandleResponse(ctx, res, meta)
+}
+
+func (h hostStacks) HandleError(ctx context.Context, req *Request, meta RequestMetadata, err error) {
+	h.stack(req).(ErrorMiddleware).HandleError(ctx, req, meta, err)
+}
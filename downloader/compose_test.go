@@ -0,0 +1,99 @@
+package downloader
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestChainReplayedResponses(t *testing.T) {
+	var log []string
+	dl := NewDownloader(
+		okClient(),
+		logMiddleware{log: &log, name: "before"},
+		Chain(
+			Named("a", logMiddleware{log: &log, name: "a"}),
+			Named("b", logMiddleware{log: &log, name: "b", replay: true}),
+			Named("c", logMiddleware{log: &log, name: "c"}),
+		),
+		logMiddleware{log: &log, name: "after"},
+	)
+	res, err := dl.Download(context.Background(), GETRequest(MustParseUrl("https://example.com")), RequestMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res.RawBody()) != "replayed" {
+		t.Fatalf("expected the replayed response, got '%s'", res.RawBody())
+	}
+	// the response passes through the same middlewares as it would without the chain
+	expected := []string{
+		"before request", "a request", "b request",
+		"a response replayed", "before response replayed",
+	}
+	if !slices.Equal(log, expected) {
+		t.Fatalf("expected %v, got %v", expected, log)
+	}
+}
+
+func TestComposedMiddlewareNames(t *testing.T) {
+	inner := Named("inner", logMiddleware{})
+	cases := []struct {
+		mid  Middleware
+		name string
+	}{
+		{When(func(req *Request) bool { return true }, inner), "inner"},
+		{Chain(inner), "Chain"},
+		{ForHosts([]string{"example.com"}, inner), "ForHosts"},
+		{HostStacks(nil), "HostStacks"},
+	}
+	for _, c := range cases {
+		if MiddlewareName(c.mid) != c.name {
+			t.Fatalf("expected the name '%s', got '%s'", c.name, MiddlewareName(c.mid))
+		}
+	}
+
+	// skipping the inner middleware of a When skips the When
+	var log []string
+	dl := NewDownloader(
+		okClient(),
+		When(func(req *Request) bool { return true }, Named("inner", logMiddleware{log: &log, name: "inner"})),
+		Chain(Named("chained", logMiddleware{log: &log, name: "chained"}), logMiddleware{log: &log, name: "kept"}),
+	)
+	req := GETRequest(MustParseUrl("https://example.com"))
+	req.AddMeta(SkipMiddleware{Names: []string{"inner", "chained"}})
+	_, err := dl.Download(context.Background(), req, RequestMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"kept request", "kept response"}
+	if !slices.Equal(log, expected) {
+		t.Fatalf("expected %v, got %v", expected, log)
+	}
+}
+
+func TestHostStacks(t *testing.T) {
+	var log []string
+	dl := NewDownloader(
+		okClient(),
+		HostStacks(
+			[]Middleware{logMiddleware{log: &log, name: "fallback"}},
+			HostStack{Hosts: []string{"*.example.com"}, Middleware: []Middleware{logMiddleware{log: &log, name: "example"}}},
+			HostStack{Hosts: []string{"localhost"}, Middleware: []Middleware{logMiddleware{log: &log, name: "local"}}},
+		),
+		ForHosts([]string{"api.example.com"}, logMiddleware{log: &log, name: "api"}),
+	)
+	for _, rawUrl := range []string{"https://api.example.com", "https://other.com", "https://localhost"} {
+		_, err := dl.Download(context.Background(), GETRequest(MustParseUrl(rawUrl)), RequestMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []string{
+		"example request", "api request", "example response", "api response",
+		"fallback request", "fallback response",
+		"local request", "local response",
+	}
+	if !slices.Equal(log, expected) {
+		t.Fatalf("expected %v, got %v", expected, log)
+	}
+}
@@ -3,6 +3,7 @@ package downloader
 import (
 	"context"
 	"fmt"
+	"slices"
 	"time"
 )
 
@@ -10,6 +11,11 @@ import (
 //
 // Note:
 //   - Middlewares are evaluated from start to finish for requests and responses.
+//   - A response returned by a response middleware replaces the response for the middlewares after it.
+//   - A response returned by a request middleware only passes through the response middlewares
+//     before it.
+//   - Middlewares named in the SkipMiddleware meta of a request are skipped for the request.
+//   - The Timeout meta of a request limits the time spent on the request.
 type Downloader struct {
 	client     Client
 	middleware []Middleware
@@ -28,36 +34,91 @@ func (d Downloader) Client() Client {
 	return d.client
 }
 
+// activeMiddleware returns the middlewares that are not skipped by the SkipMiddleware meta of
+// the request.
+func activeMiddleware(req *Request, middleware []Middleware) []Middleware {
+	skips := ListRequestMeta[SkipMiddleware](req)
+	if len(skips) == 0 {
+		return middleware
+	}
+	var out []Middleware
+	for _, mid := range middleware {
+		name := MiddlewareName(mid)
+		skipped := false
+		for _, skip := range skips {
+			if slices.Contains(skip.Names, name) {
+				skipped = true
+				break
+			}
+		}
+		if !skipped {
+			out = append(out, mid)
+		}
+	}
+	return out
+}
+
 // Queue queues a request for downloading.
 func (d Downloader) Download(ctx context.Context, req *Request, meta RequestMetadata) (*Response, error) {
-	for _, mid := range d.middleware {
+	middleware := activeMiddleware(req, d.middleware)
+	for i, mid := range middleware {
 		res, err := mid.HandleRequest(ctx, req, meta)
 		if err != nil {
 			return nil, err
 		}
 		if res != nil {
-			return res, nil
+			return handleResponse(ctx, middleware[:i], res, ResponseMetadata{
+				RequestMetadata: meta,
+				Replayed:        true,
+			})
+		}
+	}
+
+	// only the client uses the timeout, so that middleware can tell a request that timed out
+	// from the scraping being canceled
+	clientCtx := ctx
+	timeout, ok := GetRequestMeta[Timeout](req)
+	if ok && timeout.Duration > 0 {
+		var cancel context.CancelFunc
+		clientCtx, cancel = context.WithTimeout(ctx, timeout.Duration)
+		if req.DirectResponse {
+			// the body of a direct response is read after returning, so the context is only
+			// released once the timeout expires
+			time.AfterFunc(timeout.Duration, cancel)
+		} else {
+			defer cancel()
 		}
 	}
 
 	t1 := time.Now()
-	res, err := d.client.Do(ctx, req)
+	res, err := d.client.Do(clientCtx, req)
 	if err != nil {
+		for _, mid := range middleware {
+			emid, ok := mid.(ErrorMiddleware)
+			if ok {
+				emid.HandleError(ctx, req, meta, err)
+			}
+		}
 		return nil, fmt.Errorf("http: %w", err)
 	}
 	t2 := time.Now()
 
-	resMeta := ResponseMetadata{
+	return handleResponse(ctx, middleware, res, ResponseMetadata{
 		RequestMetadata: meta,
 		Elapsed:         t2.Sub(t1),
-	}
+	})
+}
 
-	for _, mid := range d.middleware {
-		err = mid.HandleResponse(ctx, res, resMeta)
+// handleResponse runs the response through the given middlewares in order.
+func handleResponse(ctx context.Context, middleware []Middleware, res *Response, meta ResponseMetadata) (*Response, error) {
+	for _, mid := range middleware {
+		replaced, err := mid.HandleResponse(ctx, res, meta)
 		if err != nil {
 			return nil, err
 		}
+		if replaced != nil {
+			res = replaced
+		}
 	}
-
 	return res, nil
 }
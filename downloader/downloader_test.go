@@ -0,0 +1,122 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+// clientFunc is a Client that responds with the given function.
+type clientFunc func(ctx context.Context, req *Request) (*Response, error)
+
+func (f clientFunc) Do(ctx context.Context, req *Request) (*Response, error) {
+	return f(ctx, req)
+}
+
+func okClient() Client {
+	return clientFunc(func(ctx context.Context, req *Request) (*Response, error) {
+		return NewResponse(req, 200, req.Url, http.Header{}, []byte("downloaded")), nil
+	})
+}
+
+// logMiddleware appends the middlewares it is called on to a log.
+type logMiddleware struct {
+	log    *[]string
+	name   string
+	replay bool
+}
+
+func (m logMiddleware) HandleRequest(ctx context.Context, req *Request, meta RequestMetadata) (*Response, error) {
+	*m.log = append(*m.log, m.name+" request")
+	if m.replay {
+		return NewResponse(req, 200, req.Url, http.Header{}, []byte("replayed")), nil
+	}
+	return nil, nil
+}
+
+func (m logMiddleware) HandleResponse(ctx context.Context, res *Response, meta ResponseMetadata) (*Response, error) {
+	entry := m.name + " response"
+	if meta.Replayed {
+		entry += " replayed"
+	}
+	*m.log = append(*m.log, entry)
+	return nil, nil
+}
+
+func (m logMiddleware) HandleError(ctx context.Context, req *Request, meta RequestMetadata, err error) {
+	*m.log = append(*m.log, m.name+" error")
+}
+
+func TestDownloaderReplayedResponses(t *testing.T) {
+	var log []string
+	dl := NewDownloader(
+		okClient(),
+		Named("a", logMiddleware{log: &log, name: "a"}),
+		Named("b", logMiddleware{log: &log, name: "b", replay: true}),
+		Named("c", logMiddleware{log: &log, name: "c"}),
+	)
+	res, err := dl.Download(context.Background(), GETRequest(MustParseUrl("https://example.com")), RequestMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res.RawBody()) != "replayed" {
+		t.Fatalf("expected the replayed response, got '%s'", res.RawBody())
+	}
+	expected := []string{"a request", "b request", "a response replayed"}
+	if !slices.Equal(log, expected) {
+		t.Fatalf("expected %v, got %v", expected, log)
+	}
+}
+
+func TestSkipMiddleware(t *testing.T) {
+	var log []string
+	dl := NewDownloader(
+		clientFunc(func(ctx context.Context, req *Request) (*Response, error) {
+			return nil, errors.New("failed")
+		}),
+		logMiddleware{log: &log, name: "unnamed"},
+		Named("a", logMiddleware{log: &log, name: "a"}),
+		Named("b", logMiddleware{log: &log, name: "b"}),
+	)
+	if MiddlewareName(logMiddleware{}) != "logMiddleware" {
+		t.Fatalf("expected the type name, got '%s'", MiddlewareName(logMiddleware{}))
+	}
+
+	req := GETRequest(MustParseUrl("https://example.com"))
+	req.AddMeta(SkipMiddleware{Names: []string{"logMiddleware"}})
+	req.AddMeta(SkipMiddleware{Names: []string{"b"}})
+	_, err := dl.Download(context.Background(), req, RequestMetadata{})
+	if err == nil {
+		t.Fatal("expected the client error")
+	}
+	// the error of the client is also only seen by the middlewares that are not skipped
+	expected := []string{"a request", "a error"}
+	if !slices.Equal(log, expected) {
+		t.Fatalf("expected %v, got %v", expected, log)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	dl := NewDownloader(clientFunc(func(ctx context.Context, req *Request) (*Response, error) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+			return NewResponse(req, 200, req.Url, http.Header{}, nil), nil
+		}
+	}))
+
+	req := GETRequest(MustParseUrl("https://example.com"))
+	req.AddMeta(Timeout{Duration: 10 * time.Millisecond})
+	start := time.Now()
+	_, err := dl.Download(context.Background(), req, RequestMetadata{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the request to time out, got %v", err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("expected the timeout to stop the request, took %v", time.Since(start))
+	}
+}
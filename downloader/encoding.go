@@ -0,0 +1,153 @@
+package downloader
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// acceptEncoding is the Accept-Encoding HttpClient sends when a request does not have one.
+const acceptEncoding = "gzip, deflate, br, zstd"
+
+// zstdReader closes the decoder once the stream has been read, so its goroutines are not leaked
+// when the reader is not closed.
+type zstdReader struct {
+	dec *zstd.Decoder
+}
+
+func (r zstdReader) Read(p []byte) (int, error) {
+	n, err := r.dec.Read(p)
+	if err != nil {
+		r.dec.Close()
+	}
+	return n, err
+}
+
+func (r zstdReader) Close() error {
+	r.dec.Close()
+	return nil
+}
+
+// decodedBody is a decoded body, closing it closes its decoders and the encoded body.
+type decodedBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (b decodedBody) Close() error {
+	var errs []error
+	for _, c := range b.closers {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// deflateReader reads a "deflate" body, which should be zlib wrapped but is sometimes raw deflate.
+func deflateReader(r io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+	header, err := buffered.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	// https://www.rfc-editor.org/rfc/rfc1950#section-2.2
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(buffered)
+	}
+	return flate.NewReader(buffered), nil
+}
+
+func decoder(encoding string, r io.Reader) (io.Reader, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		return deflateReader(r)
+	case "br":
+		return brotli.NewReader(r), nil
+	case "zstd":
+		dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zstdReader{dec: dec}, nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding '%s'", encoding)
+}
+
+// decodeBody wraps the body with decoders for the encodings in the Content-Encoding header (which
+// are applied in the order they are listed), it returns false if the body has no encoding or has
+// an encoding that is not supported and was left as is.
+//
+// Closing the returned body closes the decoders and the given body.
+func decodeBody(headers http.Header, body io.ReadCloser) (io.ReadCloser, bool, error) {
+	var encodings []string
+	for _, line := range headers.Values("Content-Encoding") {
+		for _, e := range strings.Split(line, ",") {
+			e = strings.ToLower(strings.TrimSpace(e))
+			if e != "" && e != "identity" {
+				encodings = append(encodings, e)
+			}
+		}
+	}
+	if len(encodings) == 0 {
+		return body, false, nil
+	}
+
+	for _, e := range encodings {
+		switch e {
+		case "gzip", "x-gzip", "deflate", "br", "zstd":
+		default:
+			return body, false, nil
+		}
+	}
+	decoded := decodedBody{Reader: body, closers: []io.Closer{body}}
+	for i := len(encodings) - 1; i >= 0; i-- {
+		r, err := decoder(encodings[i], decoded.Reader)
+		if err != nil {
+			decoded.Close()
+			return nil, false, fmt.Errorf("decode %s: %w", encodings[i], err)
+		}
+		decoded.Reader = r
+		c, ok := r.(io.Closer)
+		if ok {
+			// the outer decoders are closed first
+			decoded.closers = append([]io.Closer{c}, decoded.closers...)
+		}
+	}
+	return decoded, true, nil
+}
+
+// DecodeResponseBody decodes a response body with the encodings in the Content-Encoding header
+// like HttpClient does, it is meant for responses that were not downloaded by HttpClient (ex.
+// responses read from an archive).
+//
+// If the body was decoded, the returned headers are a copy of the given headers without
+// Content-Encoding and Content-Length, otherwise the headers and body are returned as is.
+func DecodeResponseBody(headers http.Header, body []byte) (http.Header, []byte, error) {
+	r, decoded, err := decodeBody(headers, io.NopCloser(bytes.NewReader(body)))
+	if err != nil {
+		return nil, nil, err
+	}
+	if !decoded {
+		return headers, body, nil
+	}
+	body, err = io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	headers = headers.Clone()
+	headers.Del("Content-Encoding")
+	headers.Del("Content-Length")
+	return headers, body, nil
+}
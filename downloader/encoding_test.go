@@ -0,0 +1,251 @@
+package downloader
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/net/html"
+)
+
+func encodeBody(t *testing.T, encoding string, body []byte) []byte {
+	t.Helper()
+	var buff bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buff)
+	case "deflate":
+		w = zlib.NewWriter(&buff)
+	case "raw-deflate":
+		w, err = flate.NewWriter(&buff, flate.DefaultCompression)
+	case "br":
+		w = brotli.NewWriter(&buff)
+	case "zstd":
+		w, err = zstd.NewWriter(&buff)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write(body)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buff.Bytes()
+}
+
+func TestHttpClientDecodesBodies(t *testing.T) {
+	const body = "decoded body"
+	cases := []struct {
+		name     string
+		header   string
+		encoded  []byte
+		expected string
+	}{
+		{"gzip", "gzip", encodeBody(t, "gzip", []byte(body)), body},
+		{"deflate", "deflate", encodeBody(t, "deflate", []byte(body)), body},
+		{"raw deflate", "deflate", encodeBody(t, "raw-deflate", []byte(body)), body},
+		{"br", "br", encodeBody(t, "br", []byte(body)), body},
+		{"zstd", "zstd", encodeBody(t, "zstd", []byte(body)), body},
+		{"stacked", "gzip, br", encodeBody(t, "br", encodeBody(t, "gzip", []byte(body))), body},
+		{"identity", "identity", []byte(body), body},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Encoding", c.header)
+				w.Write(c.encoded)
+			}))
+			defer srv.Close()
+
+			res, err := NewHttpClient(http.DefaultClient).Do(context.Background(), GETRequest(MustParseUrl(srv.URL)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(res.RawBody()) != c.expected {
+				t.Fatalf("expected '%s', got '%s'", c.expected, res.RawBody())
+			}
+			if c.header != "identity" && (res.Headers().Get("Content-Encoding") != "" || res.Headers().Get("Content-Length") != "") {
+				t.Fatalf("expected the encoding headers of a decoded body to be removed, got %v", res.Headers())
+			}
+		})
+	}
+}
+
+func TestHttpClientKeepsUndecodedBodies(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/plain":
+			w.Write([]byte("plain"))
+		case "/unsupported":
+			w.Header().Set("Content-Encoding", "compress")
+			w.Write([]byte("compressed"))
+		case "/corrupt":
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write([]byte("not gzip"))
+		}
+	}))
+	defer srv.Close()
+	client := NewHttpClient(http.DefaultClient)
+
+	res, err := client.Do(context.Background(), GETRequest(MustParseUrl(srv.URL+"/plain")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Headers().Get("Content-Length") != "5" {
+		t.Fatalf("expected the Content-Length of a body without an encoding to be kept, got %v", res.Headers())
+	}
+
+	res, err = client.Do(context.Background(), GETRequest(MustParseUrl(srv.URL+"/unsupported")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res.RawBody()) != "compressed" || res.Headers().Get("Content-Encoding") != "compress" {
+		t.Fatal("expected a body with an unsupported encoding to be left as is")
+	}
+
+	_, err = client.Do(context.Background(), GETRequest(MustParseUrl(srv.URL+"/corrupt")))
+	if err == nil {
+		t.Fatal("expected an error for a body that cannot be decoded")
+	}
+}
+
+func TestDecodeResponseBody(t *testing.T) {
+	headers := http.Header{"Content-Encoding": {"gzip"}, "Content-Length": {"10"}, "Content-Type": {"text/plain"}}
+	decodedHeaders, body, err := DecodeResponseBody(headers, encodeBody(t, "gzip", []byte("archived")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "archived" || decodedHeaders.Get("Content-Encoding") != "" || decodedHeaders.Get("Content-Type") != "text/plain" {
+		t.Fatalf("expected the body to be decoded, got '%s' %v", body, decodedHeaders)
+	}
+	if headers.Get("Content-Encoding") != "gzip" {
+		t.Fatal("expected the given headers to not be modified")
+	}
+
+	plain := http.Header{"Content-Length": {"5"}}
+	decodedHeaders, body, err = DecodeResponseBody(plain, []byte("plain"))
+	if err != nil || string(body) != "plain" || decodedHeaders.Get("Content-Length") != "5" {
+		t.Fatalf("expected a body without an encoding to be returned as is, got '%s' %v %v", body, decodedHeaders, err)
+	}
+}
+
+func TestResponseCharsets(t *testing.T) {
+	latin1 := []byte("caf\xe9")
+	cases := []struct {
+		name        string
+		contentType string
+		body        []byte
+		expected    string
+	}{
+		{"utf-8", "text/plain", []byte("café"), "café"},
+		{"content-type charset", "text/plain; charset=iso-8859-1", latin1, "café"},
+		{"meta charset", "text/html", append([]byte(`<meta charset="iso-8859-1">`), latin1...), `<meta charset="iso-8859-1">café`},
+		{"bom", "text/plain; charset=iso-8859-1", []byte("\xef\xbb\xbfcafé"), "café"},
+		{"invalid utf-8", "text/plain", latin1, "café"},
+	}
+	for _, c := range cases {
+		req := GETRequest(MustParseUrl("https://example.com"))
+		res := NewResponse(req, 200, req.Url, http.Header{"Content-Type": {c.contentType}}, c.body)
+		text, err := res.Text()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if text != c.expected {
+			t.Fatalf("%s: expected '%s', got '%s'", c.name, c.expected, text)
+		}
+	}
+
+	req := GETRequest(MustParseUrl("https://example.com"))
+	res := NewResponse(req, 200, req.Url, http.Header{"Content-Type": {"text/html; charset=iso-8859-1"}}, []byte("<p>caf\xe9</p>"))
+	node, err := res.HtmlBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var text strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			text.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(node)
+	if text.String() != "café" {
+		t.Fatalf("expected the html to be converted to UTF-8, got '%s'", text.String())
+	}
+}
+
+// roundTripperFunc is a http.RoundTripper that responds with the given function.
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// closeTrackingBody records if it was closed.
+type closeTrackingBody struct {
+	io.Reader
+	closed bool
+}
+
+func (b *closeTrackingBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestHttpClientClosesDirectBodies(t *testing.T) {
+	body := &closeTrackingBody{Reader: bytes.NewReader(encodeBody(t, "gzip", []byte("direct")))}
+	client := NewHttpClient(&http.Client{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode:    200,
+				Header:        http.Header{"Content-Encoding": {"gzip"}},
+				Body:          body,
+				ContentLength: -1,
+				Request:       req,
+			}, nil
+		}),
+	})
+
+	req := GETRequest(MustParseUrl("https://example.com"))
+	req.DirectResponse = true
+	res, err := client.Do(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	direct, ok := res.DirectBody().(io.ReadCloser)
+	if !ok {
+		t.Fatalf("expected the direct body to be closable, got %T", res.DirectBody())
+	}
+	decoded, err := io.ReadAll(direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded) != "direct" {
+		t.Fatalf("expected the decoded body, got '%s'", decoded)
+	}
+	err = direct.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !body.closed {
+		t.Fatal("expected closing the direct body to close the response body")
+	}
+}
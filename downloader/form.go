@@ -0,0 +1,392 @@
+package downloader
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/andybalholm/cascadia"
+	"golang.org/x/net/html"
+)
+
+type formCfg struct {
+	clickSelector string
+	noClick       bool
+}
+
+type formOption = func(cfg *formCfg)
+
+// WithFormClick sets the submit button that is clicked to the first submit button in the form
+// matching the given css selector.
+func WithFormClick(selector string) formOption {
+	return func(cfg *formCfg) {
+		cfg.clickSelector = selector
+	}
+}
+
+// WithFormNoClick submits the form without clicking any submit button.
+func WithFormNoClick() formOption {
+	return func(cfg *formCfg) {
+		cfg.noClick = true
+	}
+}
+
+type formField struct {
+	name  string
+	value string
+}
+
+func getAttr(n *html.Node, key string) (string, bool) {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return attr.Val, true
+		}
+	}
+	return "", false
+}
+
+func hasAttr(n *html.Node, key string) bool {
+	_, ok := getAttr(n, key)
+	return ok
+}
+
+func textContent(n *html.Node) string {
+	var sb strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			sb.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return sb.String()
+}
+
+func inputType(n *html.Node) string {
+	t, _ := getAttr(n, "type")
+	t = strings.ToLower(t)
+	if t == "" {
+		return "text"
+	}
+	return t
+}
+
+func isSubmitButton(n *html.Node) bool {
+	switch n.Data {
+	case "input":
+		t := inputType(n)
+		return t == "submit" || t == "image"
+	case "button":
+		t, ok := getAttr(n, "type")
+		return !ok || strings.EqualFold(t, "submit")
+	}
+	return false
+}
+
+// formElements returns the elements associated with the given form in document order, this
+// includes elements outside of the form that reference it with the form attribute.
+func formElements(root, form *html.Node) []*html.Node {
+	formId, _ := getAttr(form, "id")
+
+	var out []*html.Node
+	var walk func(n *html.Node, inForm bool)
+	walk = func(n *html.Node, inForm bool) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "input", "select", "textarea", "button":
+				owner, ok := getAttr(n, "form")
+				if (ok && formId != "" && owner == formId) || (!ok && inForm) {
+					out = append(out, n)
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c, inForm || c == form)
+		}
+	}
+	walk(root, root == form)
+	return out
+}
+
+func selectFields(n *html.Node, name string) []formField {
+	var options []*html.Node
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.ElementNode && c.Data == "option" {
+				options = append(options, c)
+				continue
+			}
+			walk(c)
+		}
+	}
+	walk(n)
+
+	optionValue := func(option *html.Node) string {
+		value, ok := getAttr(option, "value")
+		if ok {
+			return value
+		}
+		return strings.Join(strings.Fields(textContent(option)), " ")
+	}
+
+	var fields []formField
+	for _, option := range options {
+		if hasAttr(option, "selected") && !hasAttr(option, "disabled") {
+			fields = append(fields, formField{name: name, value: optionValue(option)})
+		}
+	}
+	if len(fields) > 0 || hasAttr(n, "multiple") {
+		return fields
+	}
+	for _, option := range options {
+		if !hasAttr(option, "disabled") {
+			return []formField{{name: name, value: optionValue(option)}}
+		}
+	}
+	return nil
+}
+
+// defaultFields returns the fields the browser would submit for the given form elements without
+// any submit button.
+func defaultFields(elements []*html.Node) []formField {
+	var fields []formField
+	for _, n := range elements {
+		name, _ := getAttr(n, "name")
+		if name == "" || hasAttr(n, "disabled") {
+			continue
+		}
+
+		switch n.Data {
+		case "input":
+			switch inputType(n) {
+			case "submit", "image", "button", "reset":
+				continue
+			case "checkbox", "radio":
+				if !hasAttr(n, "checked") {
+					continue
+				}
+				value, ok := getAttr(n, "value")
+				if !ok {
+					value = "on"
+				}
+				fields = append(fields, formField{name: name, value: value})
+			case "file":
+				fields = append(fields, formField{name: name})
+			default:
+				value, _ := getAttr(n, "value")
+				fields = append(fields, formField{name: name, value: value})
+			}
+		case "select":
+			fields = append(fields, selectFields(n, name)...)
+		case "textarea":
+			// https://html.spec.whatwg.org/multipage/form-elements.html#the-textarea-element
+			// the parser already strips a single leading newline
+			fields = append(fields, formField{name: name, value: textContent(n)})
+		}
+	}
+	return fields
+}
+
+func clickedFields(n *html.Node) []formField {
+	name, _ := getAttr(n, "name")
+	if name == "" {
+		return nil
+	}
+	if n.Data == "input" && inputType(n) == "image" {
+		return []formField{{name: name + ".x", value: "0"}, {name: name + ".y", value: "0"}}
+	}
+	value, _ := getAttr(n, "value")
+	return []formField{{name: name, value: value}}
+}
+
+// applyOverrides replaces the values of fields with the same names as the overrides, the
+// overriding values take the position of the first field with the same name.
+func applyOverrides(fields []formField, overrides url.Values) []formField {
+	out := make([]formField, 0, len(fields))
+	applied := map[string]bool{}
+	for _, f := range fields {
+		values, ok := overrides[f.name]
+		if !ok {
+			out = append(out, f)
+			continue
+		}
+		if applied[f.name] {
+			continue
+		}
+		applied[f.name] = true
+		for _, v := range values {
+			out = append(out, formField{name: f.name, value: v})
+		}
+	}
+	// the overrides without a field are appended in sorted order so the body is the same for
+	// each request
+	var unmatched []string
+	for name := range overrides {
+		if !applied[name] {
+			unmatched = append(unmatched, name)
+		}
+	}
+	slices.Sort(unmatched)
+	for _, name := range unmatched {
+		for _, v := range overrides[name] {
+			out = append(out, formField{name: name, value: v})
+		}
+	}
+	return out
+}
+
+func encodeURLEncodedForm(fields []formField) string {
+	pairs := make([]string, len(fields))
+	for i, f := range fields {
+		pairs[i] = url.QueryEscape(f.name) + "=" + url.QueryEscape(f.value)
+	}
+	return strings.Join(pairs, "&")
+}
+
+func documentBase(root *html.Node, pageUrl *url.URL) *url.URL {
+	base := cascadia.MustCompile("base[href]").MatchFirst(root)
+	if base == nil {
+		return pageUrl
+	}
+	href, _ := getAttr(base, "href")
+	ref, err := url.Parse(href)
+	if err != nil {
+		return pageUrl
+	}
+	return pageUrl.ResolveReference(ref)
+}
+
+// FormRequest returns the request a browser would make when submitting the form matching the
+// given css selector in the given response.
+//
+//   - The values of the form's fields (inputs, selects, textareas, checked checkboxes and radio
+//     buttons, hidden inputs) are collected and the values in overrides replace them.
+//   - Unless WithFormNoClick is given, the first submit button (or the one matching
+//     WithFormClick) is clicked, its formaction, formmethod and formenctype are respected.
+//   - The action is resolved against the url of the page, the request will be a GET with the
+//     fields in its query, or a POST with a urlencoded or multipart body.
+func FormRequest(res *Response, selector string, overrides url.Values, options ...formOption) (*Request, error) {
+	cfg := formCfg{}
+	for _, o := range options {
+		o(&cfg)
+	}
+
+	sel, err := cascadia.Compile(selector)
+	if err != nil {
+		return nil, fmt.Errorf("form request: %w", err)
+	}
+	root, err := res.HtmlBody()
+	if err != nil {
+		return nil, fmt.Errorf("form request: %w", err)
+	}
+	form := sel.MatchFirst(root)
+	if form == nil {
+		return nil, fmt.Errorf("form request: no element matches '%s'", selector)
+	}
+	if form.Data != "form" {
+		return nil, fmt.Errorf("form request: element matching '%s' is a <%s> not a <form>", selector, form.Data)
+	}
+
+	elements := formElements(root, form)
+	fields := defaultFields(elements)
+
+	var clicked *html.Node
+	if !cfg.noClick {
+		var clickSel cascadia.Selector
+		if cfg.clickSelector != "" {
+			clickSel, err = cascadia.Compile(cfg.clickSelector)
+			if err != nil {
+				return nil, fmt.Errorf("form request: %w", err)
+			}
+		}
+		for _, n := range elements {
+			if !isSubmitButton(n) || hasAttr(n, "disabled") {
+				continue
+			}
+			if clickSel != nil && !clickSel.Match(n) {
+				continue
+			}
+			clicked = n
+			break
+		}
+		if clicked == nil && clickSel != nil {
+			return nil, fmt.Errorf("form request: no submit button matches '%s'", cfg.clickSelector)
+		}
+	}
+	if clicked != nil {
+		fields = append(fields, clickedFields(clicked)...)
+	}
+	fields = applyOverrides(fields, overrides)
+
+	attr := func(formAttr, buttonAttr string) string {
+		if clicked != nil {
+			value, ok := getAttr(clicked, buttonAttr)
+			if ok {
+				return value
+			}
+		}
+		value, _ := getAttr(form, formAttr)
+		return value
+	}
+
+	method := strings.ToUpper(attr("method", "formmethod"))
+	if method == "" {
+		method = http.MethodGet
+	}
+	enctype := strings.ToLower(attr("enctype", "formenctype"))
+
+	base := documentBase(root, res.Url())
+	action := base
+	rawAction := strings.TrimSpace(attr("action", "formaction"))
+	if rawAction != "" {
+		ref, err := url.Parse(rawAction)
+		if err != nil {
+			return nil, fmt.Errorf("form request: action: %w", err)
+		}
+		action = base.ResolveReference(ref)
+	}
+
+	switch method {
+	case http.MethodGet:
+		u := *action
+		u.RawQuery = encodeURLEncodedForm(fields)
+		u.Fragment = ""
+		return GETRequest(&u), nil
+	case http.MethodPost:
+		req := POSTRequest(action)
+		switch enctype {
+		case "multipart/form-data":
+			var buffer bytes.Buffer
+			writer := multipart.NewWriter(&buffer)
+			for _, f := range fields {
+				err = writer.WriteField(f.name, f.value)
+				if err != nil {
+					return nil, fmt.Errorf("form request: %w", err)
+				}
+			}
+			err = writer.Close()
+			if err != nil {
+				return nil, fmt.Errorf("form request: %w", err)
+			}
+			req.SetBody(writer.FormDataContentType(), buffer.Bytes())
+		case "text/plain":
+			var sb strings.Builder
+			for _, f := range fields {
+				sb.WriteString(f.name + "=" + f.value + "\r\n")
+			}
+			req.SetBody("text/plain", []byte(sb.String()))
+		default:
+			req.SetBody("application/x-www-form-urlencoded", []byte(encodeURLEncodedForm(fields)))
+		}
+		return req, nil
+	}
+	return nil, fmt.Errorf("form request: unsupported method '%s'", method)
+}
@@ -0,0 +1,165 @@
+package downloader
+
+import (
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func formResponse(page string) *Response {
+	u := MustParseUrl("https://example.com/dir/page?x=1")
+	headers := http.Header{"Content-Type": {"text/html; charset=utf-8"}}
+	return NewResponse(GETRequest(u), http.StatusOK, u, headers, []byte(page))
+}
+
+func TestFormRequestGET(t *testing.T) {
+	res := formResponse(`
+		<form id="search" action="results#top">
+			<input name="q" value="go">
+			<input type="hidden" name="token" value="abc">
+			<input type="checkbox" name="exact" checked>
+			<input type="checkbox" name="unchecked" value="1">
+			<input type="radio" name="sort" value="new">
+			<input type="radio" name="sort" value="top" checked>
+			<input name="disabled" value="1" disabled>
+			<select name="lang"><option value="en">English</option><option value="fr">French</option></select>
+			<select name="size"><option>S</option><option selected>M</option></select>
+			<textarea name="notes">
+hello</textarea>
+			<input type="submit" name="go" value="Search">
+			<input type="submit" name="other" value="Other">
+		</form>
+		<input form="search" name="outside" value="yes">
+	`)
+
+	req, err := FormRequest(res, "#search", url.Values{"q": {"scavenge"}, "extra": {"1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Method != http.MethodGet {
+		t.Fatalf("expected GET, got %s", req.Method)
+	}
+	expected := "https://example.com/dir/results?" +
+		"q=scavenge&token=abc&exact=on&sort=top&lang=en&size=M&notes=hello&outside=yes&go=Search&extra=1"
+	if req.Url.String() != expected {
+		t.Fatalf("expected url\n%s\ngot\n%s", expected, req.Url.String())
+	}
+}
+
+func TestFormRequestPOST(t *testing.T) {
+	res := formResponse(`
+		<base href="https://example.com/base/">
+		<form method="post" action="login">
+			<input name="user" value="a b">
+			<button name="action" value="save">Save</button>
+			<button name="action" value="delete" formaction="/delete" formmethod="get">Delete</button>
+		</form>
+	`)
+
+	req, err := FormRequest(res, "form", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Method != http.MethodPost || req.Url.String() != "https://example.com/base/login" {
+		t.Fatalf("expected a POST to the action resolved against the base, got %s %s", req.Method, req.Url)
+	}
+	if req.Headers.Get("Content-Type") != "application/x-www-form-urlencoded" {
+		t.Fatalf("expected a urlencoded body, got '%s'", req.Headers.Get("Content-Type"))
+	}
+	if string(req.Body) != "user=a+b&action=save" {
+		t.Fatalf("unexpected body '%s'", string(req.Body))
+	}
+
+	req, err = FormRequest(res, "form", nil, WithFormClick(`[value="delete"]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Method != http.MethodGet || req.Url.String() != "https://example.com/delete?user=a+b&action=delete" {
+		t.Fatalf("expected the formaction and formmethod of the clicked button, got %s %s", req.Method, req.Url)
+	}
+
+	req, err = FormRequest(res, "form", nil, WithFormNoClick())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(req.Body) != "user=a+b" {
+		t.Fatalf("expected no button to be clicked, got body '%s'", string(req.Body))
+	}
+}
+
+func TestFormRequestDeterministicOverrides(t *testing.T) {
+	res := formResponse(`<form method="post" action="/submit"><input name="user" value="a"></form>`)
+	overrides := url.Values{"user": {"b"}}
+	for _, name := range []string{"z", "y", "x", "w", "v", "u", "t", "s"} {
+		overrides.Set(name, "1")
+	}
+
+	first, err := FormRequest(res, "form", overrides)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(first.Body) != "user=b&s=1&t=1&u=1&v=1&w=1&x=1&y=1&z=1" {
+		t.Fatalf("expected the overrides without a field in sorted order, got '%s'", first.Body)
+	}
+	for range 10 {
+		req, err := FormRequest(res, "form", overrides)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(req.Body) != string(first.Body) {
+			t.Fatalf("expected the same body for the same form, got '%s' and '%s'", first.Body, req.Body)
+		}
+	}
+}
+
+func TestFormRequestMultipart(t *testing.T) {
+	res := formResponse(`
+		<form method="post" enctype="multipart/form-data">
+			<input name="title" value="hello">
+			<input name="title" value="world">
+		</form>
+	`)
+
+	req, err := FormRequest(res, "form", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Url.String() != "https://example.com/dir/page?x=1" {
+		t.Fatalf("expected a form without an action to submit to the page, got %s", req.Url)
+	}
+	mediatype, params, err := mime.ParseMediaType(req.Headers.Get("Content-Type"))
+	if err != nil || mediatype != "multipart/form-data" {
+		t.Fatalf("expected a multipart body, got '%s'", req.Headers.Get("Content-Type"))
+	}
+	form, err := multipart.NewReader(strings.NewReader(string(req.Body)), params["boundary"]).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(form.Value["title"], ",") != "hello,world" {
+		t.Fatalf("unexpected multipart fields %v", form.Value)
+	}
+}
+
+func TestFormRequestErrors(t *testing.T) {
+	res := formResponse(`<div id="div"></div><form><input type="submit"></form>`)
+
+	cases := []struct {
+		name     string
+		selector string
+		options  []formOption
+	}{
+		{"no match", "#missing", nil},
+		{"not a form", "#div", nil},
+		{"invalid selector", "[", nil},
+		{"no button matches", "form", []formOption{WithFormClick("#missing")}},
+	}
+	for _, c := range cases {
+		_, err := FormRequest(res, c.selector, nil, c.options...)
+		if err == nil {
+			t.Fatalf("%s: expected an error", c.name)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"slices"
+	"strings"
+	"time"
+)
+
+// headerOrderKey is the header used to pass the HeaderOrder of a request to the connection it is
+// written to, it is removed before the request is sent.
+const headerOrderKey = "Scavenge-Header-Order"
+
+// orderedTransport returns a copy of the given transport that sends the headers of each request
+// in the order given by its headerOrderKey header.
+//
+// The standard library writes headers in sorted order, so the request head is reordered by the
+// connection before it is sent. Connections are not reused so that the head of each request is
+// the first thing written to its connection.
+func orderedTransport(transport *http.Transport) *http.Transport {
+	ordered := transport.Clone()
+	ordered.DisableKeepAlives = true
+	ordered.ForceAttemptHTTP2 = false
+	ordered.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+
+	dial := ordered.DialContext
+	if dial == nil {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		dial = dialer.DialContext
+	}
+	ordered.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &orderedConn{Conn: conn}, nil
+	}
+
+	dialTLS := ordered.DialTLSContext
+	if dialTLS == nil {
+		dialTLS = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialHTTP1TLS(ctx, dial, ordered.TLSClientConfig, network, addr)
+		}
+	}
+	ordered.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialTLS(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &orderedConn{Conn: conn}, nil
+	}
+	return ordered
+}
+
+// dialHTTP1TLS dials a tls connection that only offers HTTP/1.1, it reports the handshake to the
+// httptrace.ClientTrace of the context like the transport does for the connections it dials.
+func dialHTTP1TLS(ctx context.Context, dial func(context.Context, string, string) (net.Conn, error), config *tls.Config, network, addr string) (net.Conn, error) {
+	conn, err := dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		config.ServerName = host
+	}
+	config.NextProtos = []string{"http/1.1"}
+
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.TLSHandshakeStart != nil {
+		trace.TLSHandshakeStart()
+	}
+	tlsConn := tls.Client(conn, config)
+	err = tlsConn.HandshakeContext(ctx)
+	if trace != nil && trace.TLSHandshakeDone != nil {
+		trace.TLSHandshakeDone(tlsConn.ConnectionState(), err)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// orderedConn reorders the headers of the first request head written to it.
+type orderedConn struct {
+	net.Conn
+	head []byte
+	done bool
+}
+
+func (c *orderedConn) Write(p []byte) (int, error) {
+	if c.done {
+		return c.Conn.Write(p)
+	}
+
+	c.head = append(c.head, p...)
+	end := bytes.Index(c.head, []byte("\r\n\r\n"))
+	if end < 0 {
+		return len(p), nil
+	}
+	c.done = true
+
+	out := orderHead(c.head[:end])
+	out = append(out, c.head[end:]...)
+	c.head = nil
+	_, err := c.Conn.Write(out)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// orderHead reorders the header lines of a request head (without its final empty line) by its
+// headerOrderKey header and removes that header.
+func orderHead(head []byte) []byte {
+	lines := strings.Split(string(head), "\r\n")
+
+	var order []string
+	headers := make([]string, 0, len(lines)-1)
+	for _, line := range lines[1:] {
+		key, value, _ := strings.Cut(line, ":")
+		if http.CanonicalHeaderKey(key) == headerOrderKey {
+			order = strings.Split(strings.TrimSpace(value), ",")
+			continue
+		}
+		headers = append(headers, line)
+	}
+
+	rank := func(line string) int {
+		key, _, _ := strings.Cut(line, ":")
+		key = http.CanonicalHeaderKey(key)
+		i := slices.Index(order, key)
+		switch {
+		case i >= 0:
+			return i
+		case key == "Host":
+			return -1
+		default:
+			return len(order)
+		}
+	}
+	slices.SortStableFunc(headers, func(a, b string) int {
+		return rank(a) - rank(b)
+	})
+
+	out := []byte(lines[0])
+	for _, line := range headers {
+		out = append(out, "\r\n"...)
+		out = append(out, line...)
+	}
+	return out
+}
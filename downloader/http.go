@@ -6,6 +6,9 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Client defines a generic interface for http clients.
@@ -15,12 +18,90 @@ type Client interface {
 
 // HttpClient implements Client using the standard library's http client.
 type HttpClient struct {
-	client *http.Client
+	client  *http.Client
+	proxied *sync.Map
+	// ordered is the client used for requests with a HeaderOrder, it is nil if the client's
+	// transport cannot be copied.
+	ordered *http.Client
 }
 
 // NewHttpClient creates a HttpClient
+//
+// The client's CheckRedirect is wrapped to record the redirects that were followed, see
+// Response.Redirects.
+//
+// Response bodies with a gzip, deflate, br or zstd Content-Encoding are decoded (and the
+// Content-Encoding and Content-Length headers removed), requests without an Accept-Encoding
+// header accept all of them.
+//
+// Requests with a HeaderOrder are made with a copy of the given client that sends their headers
+// in that order.
+//
+// Note: requests with a Proxy (or a HeaderOrder) are made with a copy of the given client whose
+// transport uses the proxy, so the client's Transport must either be nil or an [*http.Transport].
 func NewHttpClient(client *http.Client) HttpClient {
-	return HttpClient{client: client}
+	traced := *client
+	traceRedirects(&traced)
+	c := HttpClient{client: &traced, proxied: &sync.Map{}}
+
+	var transport *http.Transport
+	switch t := client.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport)
+	case *http.Transport:
+		transport = t
+	}
+	if transport != nil {
+		ordered := traced
+		ordered.Transport = orderedTransport(transport)
+		c.ordered = &ordered
+	}
+	return c
+}
+
+// orderedClient returns the client used for a request with a HeaderOrder, or nil if the order
+// cannot be kept for the request.
+func (c HttpClient) orderedClient(req *http.Request) *http.Client {
+	if c.ordered == nil {
+		return nil
+	}
+	transport := c.ordered.Transport.(*http.Transport)
+	if transport.Proxy != nil {
+		proxy, err := transport.Proxy(req)
+		if err != nil || proxy != nil {
+			return nil
+		}
+	}
+	return c.ordered
+}
+
+// proxiedClient returns the client used for requests going through the given proxy.
+func (c HttpClient) proxiedClient(request *Request) (*http.Client, error) {
+	if request.Proxy == nil {
+		return c.client, nil
+	}
+
+	proxyUrl := request.Proxy.String()
+	v, ok := c.proxied.Load(proxyUrl)
+	if ok {
+		return v.(*http.Client), nil
+	}
+
+	var transport *http.Transport
+	switch t := c.client.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = t.Clone()
+	default:
+		return nil, fmt.Errorf("client transport %T does not support proxies", t)
+	}
+	transport.Proxy = http.ProxyURL(request.Proxy)
+
+	client := *c.client
+	client.Transport = transport
+	v, _ = c.proxied.LoadOrStore(proxyUrl, &client)
+	return v.(*http.Client), nil
 }
 
 // Do implements Client.Do
@@ -30,37 +111,78 @@ func (c HttpClient) Do(ctx context.Context, request *Request) (*Response, error)
 		body = bytes.NewBuffer(request.Body)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, request.Method, request.Url.String(), body)
+	t := &tracer{}
+	t.cookies, _ = GetRequestMeta[RedirectCookies](request)
+	req, err := http.NewRequestWithContext(withTracer(ctx, t), request.Method, request.Url.String(), body)
 	if err != nil {
 		return nil, fmt.Errorf("new http request: %w", err)
 	}
-	res, err := c.client.Do(req)
+	if request.Headers != nil {
+		req.Header = request.Headers.Clone()
+	}
+	// the encoding is set explicitly (so the transport does not decode gzip by itself) to decode
+	// all supported encodings the same way
+	if req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	client, err := c.proxiedClient(request)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: %w", err)
+	}
+	order, ok := GetRequestMeta[HeaderOrder](request)
+	if ok && request.Proxy == nil {
+		ordered := c.orderedClient(req)
+		if ordered != nil {
+			client = ordered
+			keys := make([]string, len(order.Keys))
+			for i, k := range order.Keys {
+				keys[i] = http.CanonicalHeaderKey(k)
+			}
+			req.Header.Set(headerOrderKey, strings.Join(keys, ","))
+		}
+	}
+	res, err := client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("do http request: %w", err)
 	}
 
+	var resBody io.ReadCloser = res.Body
+	hasBody := request.Method != http.MethodHead &&
+		res.StatusCode != http.StatusNoContent &&
+		res.StatusCode != http.StatusNotModified
+	if hasBody && res.ContentLength != 0 {
+		var decoded bool
+		resBody, decoded, err = decodeBody(res.Header, res.Body)
+		if err != nil {
+			return nil, fmt.Errorf("read http body: %w", err)
+		}
+		if decoded {
+			res.Header.Del("Content-Encoding")
+			res.Header.Del("Content-Length")
+		}
+	}
+
 	var resbody []byte
 	var directBody io.Reader
 	if !request.DirectResponse {
-		resbody, err = io.ReadAll(res.Body)
+		resbody, err = io.ReadAll(resBody)
+		resBody.Close()
 		if err != nil {
 			return nil, fmt.Errorf("read http body: %w", err)
 		}
 	} else {
-		directBody = res.Body
-	}
-
-	endUrl := req.URL
-	loc, err := res.Location()
-	if err == nil {
-		endUrl = loc
+		directBody = resBody
 	}
 
 	return &Response{
-		request:    request,
-		url:        endUrl,
+		request: request,
+		status:  res.StatusCode,
+		// the request of the response is the last one made after following redirects
+		url:        res.Request.URL,
 		headers:    res.Header,
 		body:       resbody,
 		directBody: directBody,
+		timings:    t.timings(time.Now()),
+		redirects:  t.redirects,
 	}, nil
 }
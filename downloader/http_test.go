@@ -0,0 +1,141 @@
+package downloader
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestHttpClientSendsHeaders(t *testing.T) {
+	var received http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+	defer srv.Close()
+
+	req := GETRequest(MustParseUrl(srv.URL))
+	req.SetHeader("User-Agent", "scavenge-test")
+	req.Headers.Add("X-Multi", "a")
+	req.Headers.Add("X-Multi", "b")
+
+	_, err := NewHttpClient(http.DefaultClient).Do(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.Get("User-Agent") != "scavenge-test" {
+		t.Fatalf("expected the User-Agent header to be sent, got '%s'", received.Get("User-Agent"))
+	}
+	if len(received.Values("X-Multi")) != 2 {
+		t.Fatalf("expected both values of X-Multi to be sent, got %v", received.Values("X-Multi"))
+	}
+}
+
+// serveHeaderKeys responds to the requests accepted by the listener and sends the header keys of
+// each request in the order they were received.
+func serveHeaderKeys(ln net.Listener) <-chan []string {
+	received := make(chan []string, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			var keys []string
+			_, err = r.ReadString('\n')
+			for err == nil {
+				var line string
+				line, err = r.ReadString('\n')
+				line = strings.TrimSpace(line)
+				if line == "" {
+					break
+				}
+				key, _, _ := strings.Cut(line, ":")
+				keys = append(keys, key)
+			}
+			conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+			conn.Close()
+			received <- keys
+		}
+	}()
+	return received
+}
+
+func TestHttpClientHeaderOrder(t *testing.T) {
+	order := HeaderOrder{Keys: []string{"user-agent", "Accept", "Host", "Sec-Ch-Ua"}}
+	expected := []string{"User-Agent", "Accept", "Host", "Sec-Ch-Ua", "Accept-Encoding", "X-Other", "Connection"}
+	newRequest := func(rawUrl string) *Request {
+		req := GETRequest(MustParseUrl(rawUrl))
+		req.SetHeader("X-Other", "1")
+		req.SetHeader("Sec-Ch-Ua", "chromium")
+		req.SetHeader("Accept", "text/html")
+		req.SetHeader("User-Agent", "chrome")
+		req.SetMeta(order)
+		return req
+	}
+
+	t.Run("http", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		received := serveHeaderKeys(ln)
+
+		_, err = NewHttpClient(&http.Client{}).Do(context.Background(), newRequest("http://"+ln.Addr().String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := <-received
+		if !slices.Equal(keys, expected) {
+			t.Fatalf("expected the headers in the order %v, got %v", expected, keys)
+		}
+	})
+
+	t.Run("https", func(t *testing.T) {
+		srv := httptest.NewUnstartedServer(nil)
+		srv.StartTLS()
+		defer srv.Close()
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln = tls.NewListener(ln, srv.TLS)
+		defer ln.Close()
+		received := serveHeaderKeys(ln)
+
+		_, err = NewHttpClient(srv.Client()).Do(context.Background(), newRequest("https://"+ln.Addr().String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := <-received
+		if !slices.Equal(keys, expected) {
+			t.Fatalf("expected the headers in the order %v, got %v", expected, keys)
+		}
+	})
+
+	t.Run("without order", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		received := serveHeaderKeys(ln)
+
+		req := GETRequest(MustParseUrl("http://" + ln.Addr().String()))
+		_, err = NewHttpClient(&http.Client{}).Do(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := <-received
+		if slices.Contains(keys, headerOrderKey) {
+			t.Fatalf("expected the header order to not be sent, got %v", keys)
+		}
+	})
+}
@@ -0,0 +1,114 @@
+package downloader
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// The well-known request metadata types below are understood by the Downloader and the built-in
+// middleware, they are added to a request with Request.AddMeta (or Request.SetMeta).
+
+// SkipMiddleware is request metadata that makes the Downloader skip the middlewares with the
+// given names (see MiddlewareName) for the request.
+type SkipMiddleware struct {
+	Names []string
+}
+
+// Timeout is request metadata that limits the time the Client spends on the request, a request
+// that times out is a failed request for middleware (ex. middleware.CircuitBreaker).
+//
+// Note: the body of a request with DirectResponse must also be read before the timeout.
+type Timeout struct {
+	Duration time.Duration
+}
+
+// DontFilter is request metadata that makes middleware that drop duplicate requests (like
+// middleware.Dedupe) let the request through.
+type DontFilter struct{}
+
+// AllowStatus is request metadata that makes middleware that drop responses by their status (like
+// middleware.HttpError) let responses with the given statuses through, All lets every status
+// through.
+type AllowStatus struct {
+	Statuses []int
+	All      bool
+}
+
+// RedirectCookies is request metadata with the cookies HttpClient uses for the redirects it
+// follows (set by middleware.Cookies), the cookies set by each redirect are stored in Jar and the
+// Cookie header of each redirected request is Header followed by the cookies in Jar for its url.
+type RedirectCookies struct {
+	Jar    http.CookieJar
+	Header string
+}
+
+// HeaderOrder is request metadata with the header keys in the order HttpClient sends them in (set
+// by middleware.HeaderProfiles), Host is sent first unless it is listed and the headers that are
+// not listed are sent after the listed ones.
+//
+// Note: the order can only be kept for HTTP/1.1, so requests with a HeaderOrder are not made over
+// HTTP/2, nor do they reuse connections (so they are sent with "Connection: close"). It is
+// ignored for requests made through a proxy.
+type HeaderOrder struct {
+	Keys []string
+}
+
+// CacheControl is request metadata that controls how caching middleware (like middleware.Replay
+// and middleware.HTTPCache) treat the request.
+type CacheControl struct {
+	// NoStore prevents the response from being stored.
+	NoStore bool
+	// NoCache prevents a stored response from being used without being downloaded (or
+	// revalidated) again.
+	NoCache bool
+}
+
+// GetCacheControl returns the CacheControl of the request, or the zero value if it has none.
+func GetCacheControl(req *Request) CacheControl {
+	cc, _ := GetRequestMeta[CacheControl](req)
+	return cc
+}
+
+// NamedMiddleware can be implemented by a Middleware to choose its name.
+type NamedMiddleware interface {
+	Middleware
+	Name() string
+}
+
+// MiddlewareName returns the name of the given middleware, it is the name given by
+// NamedMiddleware or the name of its type (ex. "Dedupe" for a *middleware.Dedupe).
+func MiddlewareName(m Middleware) string {
+	named, ok := m.(NamedMiddleware)
+	if ok {
+		return named.Name()
+	}
+	t := reflect.TypeOf(m)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+type namedMiddleware struct {
+	Middleware
+	name string
+}
+
+func (n namedMiddleware) Name() string {
+	return n.name
+}
+
+func (n namedMiddleware) HandleError(ctx context.Context, req *Request, meta RequestMetadata, err error) {
+	emid, ok := n.Middleware.(ErrorMiddleware)
+	if ok {
+		emid.HandleError(ctx, req, meta, err)
+	}
+}
+
+// Named gives the middleware a name, this is useful to skip one of several middlewares of the
+// same type with SkipMiddleware.
+func Named(name string, m Middleware) Middleware {
+	return namedMiddleware{Middleware: m, name: name}
+}
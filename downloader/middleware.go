@@ -17,20 +17,52 @@ type RequestMetadata struct {
 type ResponseMetadata struct {
 	RequestMetadata
 	Elapsed time.Duration
+	// Replayed is true if the response was returned by the HandleRequest of a middleware (ex. a
+	// response from a cache) instead of being downloaded, Elapsed is zero for replayed responses.
+	Replayed bool
 }
 
 // Middleware runs before a request or a response, if either HandleRequest or HandleResponse
 // return an error, the request will be aborted.
 //
 // if HandleRequest returns a non-nil Response, it will be used as the response for the request
-// and the rest of the request middlewares will be skipped, this response will also bypass response
-// middlewares.
+// and the rest of the request middlewares will be skipped, this response will only pass through
+// the response middlewares before the middleware that returned it (with ResponseMetadata.Replayed
+// set), middlewares that should only see downloaded responses can check for it.
+//
+// if HandleResponse returns a non-nil Response, it replaces the response for the rest of the
+// response middlewares (and the spider), to download a different request instead of the response,
+// return the error from ReissueRequest.
 type Middleware interface {
 	HandleRequest(ctx context.Context, req *Request, meta RequestMetadata) (*Response, error)
-	HandleResponse(ctx context.Context, res *Response, meta ResponseMetadata) error
+	HandleResponse(ctx context.Context, res *Response, meta ResponseMetadata) (*Response, error)
+}
+
+// ErrorMiddleware can optionally be implemented by a Middleware to be notified when the
+// client fails to return a response for a request (ex. a connection or timeout error).
+//
+// HandleError is only called on middlewares whose HandleRequest was called for the request.
+type ErrorMiddleware interface {
+	HandleError(ctx context.Context, req *Request, meta RequestMetadata, err error)
 }
 
 // DroppedRequest indicates that the given request has been dropped and should not be retried.
 func DroppedRequest(reason error) error {
 	return fmt.Errorf("dropped request: %w", reason)
 }
+
+// ReissueError is returned by middleware to abort a request and queue the given request in its
+// place (ex. to follow a redirect or retry with new credentials).
+type ReissueError struct {
+	Request *Request
+}
+
+func (e ReissueError) Error() string {
+	return fmt.Sprintf("reissue request: %s %s", e.Request.Method, e.Request.Url)
+}
+
+// ReissueRequest indicates that the response should be discarded and the given request should be
+// queued instead, the given request may be the original request (to retry it immediately).
+func ReissueRequest(req *Request) error {
+	return ReissueError{Request: req}
+}
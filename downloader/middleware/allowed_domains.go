@@ -65,9 +65,9 @@ func (p AllowedDomains) HandleResponse(
 	ctx context.Context,
 	res *downloader.Response,
 	meta downloader.ResponseMetadata,
-) error {
+) (*downloader.Response, error) {
 	if len(p.responseDomains) == 0 {
-		return nil
+		return nil, nil
 	}
 
 	resUrl := res.Url()
@@ -81,12 +81,12 @@ func (p AllowedDomains) HandleResponse(
 		}
 	}
 	if !matched {
-		return downloader.DroppedRequest(fmt.Errorf(
+		return nil, downloader.DroppedRequest(fmt.Errorf(
 			"allowed domains: response from domain (for a request to '%s') '%s' is not allowed",
 			res.Request().Url,
 			hostname,
 		))
 	}
 
-	return nil
+	return nil, nil
 }
@@ -0,0 +1,314 @@
+package middleware
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LQR471814/scavenge"
+	"github.com/LQR471814/scavenge/downloader"
+
+	"github.com/gobwas/glob"
+)
+
+// Authenticator adds credentials to requests.
+type Authenticator interface {
+	// Authenticate adds credentials to the given request.
+	Authenticate(ctx context.Context, req *downloader.Request) error
+	// Invalidate is called when the credentials added to the given request were rejected.
+	Invalidate(ctx context.Context, req *downloader.Request)
+}
+
+// BasicAuth is an Authenticator that uses [HTTP Basic authentication](https://developer.mozilla.org/en-US/docs/Web/HTTP/Authentication#basic_authentication_scheme).
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+func (a BasicAuth) Authenticate(ctx context.Context, req *downloader.Request) error {
+	credentials := base64.StdEncoding.EncodeToString([]byte(a.Username + ":" + a.Password))
+	req.SetHeader("Authorization", "Basic "+credentials)
+	return nil
+}
+
+func (a BasicAuth) Invalidate(ctx context.Context, req *downloader.Request) {}
+
+// BearerToken is an Authenticator that uses a static bearer token.
+type BearerToken string
+
+func (t BearerToken) Authenticate(ctx context.Context, req *downloader.Request) error {
+	req.SetHeader("Authorization", "Bearer "+string(t))
+	return nil
+}
+
+func (t BearerToken) Invalidate(ctx context.Context, req *downloader.Request) {}
+
+// OAuth2Config configures an OAuth2 authenticator.
+type OAuth2Config struct {
+	TokenUrl     *url.URL
+	ClientId     string
+	ClientSecret string
+	Scopes       []string
+
+	// RefreshToken makes tokens be fetched with the refresh_token grant instead of
+	// the client_credentials grant.
+	RefreshToken string
+
+	// CredentialsInBody sends the client id and secret in the request body instead of
+	// with HTTP Basic authentication.
+	CredentialsInBody bool
+
+	// ExpiryDelta is how long before a token expires that it is refreshed, by default it is 30 seconds.
+	ExpiryDelta time.Duration
+}
+
+type oauth2TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// OAuth2 is an Authenticator that fetches and caches bearer tokens with the OAuth2
+// [client credentials](https://datatracker.ietf.org/doc/html/rfc6749#section-4.4) or
+// [refresh token](https://datatracker.ietf.org/doc/html/rfc6749#section-6) grant.
+//
+// Tokens are fetched directly with the given Client, bypassing all middleware, only one token is
+// fetched at a time, the other requests needing a token wait for it.
+type OAuth2 struct {
+	client downloader.Client
+	cfg    OAuth2Config
+
+	mu           sync.Mutex
+	accessToken  string
+	refreshToken string
+	expiry       time.Time
+	// fetching is closed when the token being fetched is received, it is nil if no token is
+	// being fetched.
+	fetching chan struct{}
+}
+
+func NewOAuth2(client downloader.Client, cfg OAuth2Config) *OAuth2 {
+	if cfg.TokenUrl == nil {
+		panic("oauth2: a token url must be given")
+	}
+	if cfg.ExpiryDelta == 0 {
+		cfg.ExpiryDelta = 30 * time.Second
+	}
+	return &OAuth2{
+		client:       client,
+		cfg:          cfg,
+		refreshToken: cfg.RefreshToken,
+	}
+}
+
+// fetch fetches a new token, it must be called without the lock held.
+func (o *OAuth2) fetch(ctx context.Context, refreshToken string) (oauth2TokenResponse, error) {
+	form := url.Values{}
+	if refreshToken != "" {
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", refreshToken)
+	} else {
+		form.Set("grant_type", "client_credentials")
+	}
+	if len(o.cfg.Scopes) > 0 {
+		form.Set("scope", strings.Join(o.cfg.Scopes, " "))
+	}
+
+	req := downloader.POSTRequest(o.cfg.TokenUrl)
+	req.SetHeader("Accept", "application/json")
+	if o.cfg.CredentialsInBody {
+		form.Set("client_id", o.cfg.ClientId)
+		form.Set("client_secret", o.cfg.ClientSecret)
+	} else if o.cfg.ClientId != "" {
+		// https://datatracker.ietf.org/doc/html/rfc6749#section-2.3.1
+		BasicAuth{
+			Username: url.QueryEscape(o.cfg.ClientId),
+			Password: url.QueryEscape(o.cfg.ClientSecret),
+		}.Authenticate(ctx, req)
+	}
+	req.SetBodyURLEncodedForm(form)
+
+	res, err := o.client.Do(ctx, req)
+	if err != nil {
+		return oauth2TokenResponse{}, fmt.Errorf("fetch token: %w", err)
+	}
+	if res.Status() != http.StatusOK {
+		return oauth2TokenResponse{}, fmt.Errorf("fetch token: unexpected status %d: %s", res.Status(), string(res.RawBody()))
+	}
+
+	var token oauth2TokenResponse
+	err = res.JsonBody(&token)
+	if err != nil {
+		return oauth2TokenResponse{}, fmt.Errorf("fetch token: %w", err)
+	}
+	if token.AccessToken == "" {
+		return oauth2TokenResponse{}, fmt.Errorf("fetch token: response did not contain an access token")
+	}
+	return token, nil
+}
+
+// token returns the current access token, fetching a new one if there is none or it expired.
+func (o *OAuth2) token(ctx context.Context) (string, error) {
+	for {
+		o.mu.Lock()
+		expired := !o.expiry.IsZero() && time.Now().Add(o.cfg.ExpiryDelta).After(o.expiry)
+		if o.accessToken != "" && !expired {
+			token := o.accessToken
+			o.mu.Unlock()
+			return token, nil
+		}
+		if o.fetching == nil {
+			break
+		}
+		// another request is already fetching a token
+		fetching := o.fetching
+		o.mu.Unlock()
+		select {
+		case <-fetching:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+
+	fetching := make(chan struct{})
+	o.fetching = fetching
+	refreshToken := o.refreshToken
+	o.mu.Unlock()
+
+	token, err := o.fetch(ctx, refreshToken)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.fetching = nil
+	close(fetching)
+	if err != nil {
+		return "", err
+	}
+
+	o.accessToken = token.AccessToken
+	o.expiry = time.Time{}
+	if token.ExpiresIn > 0 {
+		o.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	if token.RefreshToken != "" {
+		o.refreshToken = token.RefreshToken
+	}
+
+	scavenge.LoggerFromContext(ctx).Debug(
+		"oauth2", "fetched token",
+		"token_url", scavenge.ShortUrl(o.cfg.TokenUrl),
+		"expiry", o.expiry,
+	)
+	return o.accessToken, nil
+}
+
+func (o *OAuth2) Authenticate(ctx context.Context, req *downloader.Request) error {
+	token, err := o.token(ctx)
+	if err != nil {
+		return fmt.Errorf("oauth2: %w", err)
+	}
+	req.SetHeader("Authorization", "Bearer "+token)
+	return nil
+}
+
+func (o *OAuth2) Invalidate(ctx context.Context, req *downloader.Request) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// the token may have already been refreshed by another request
+	if req.Headers.Get("Authorization") != "Bearer "+o.accessToken {
+		return
+	}
+	o.accessToken = ""
+}
+
+// AuthRule applies an Authenticator to the requests with a matching host.
+type AuthRule struct {
+	host          glob.Glob
+	authenticator Authenticator
+}
+
+// NewAuthRule creates an AuthRule, you can use wildcards (*) in the host. [documentation](https://github.com/gobwas/glob)
+func NewAuthRule(host string, authenticator Authenticator) AuthRule {
+	return AuthRule{
+		host:          glob.MustCompile(host, '.'),
+		authenticator: authenticator,
+	}
+}
+
+// authRetry is the request meta of a request that was reissued after its credentials were
+// rejected, pending is true until a response to the reissued request is accepted.
+type authRetry struct {
+	pending bool
+}
+
+// Auth adds credentials to requests, the Authenticator of the first rule that matches the host
+// of a request is used.
+//
+// When a response has the status 401, the credentials are invalidated (so that they will be
+// refreshed if possible) and the request is reissued, if the reissued request is rejected again
+// it is dropped.
+type Auth struct {
+	rules []AuthRule
+}
+
+func NewAuth(rules ...AuthRule) *Auth {
+	return &Auth{rules: rules}
+}
+
+func (a *Auth) authenticator(req *downloader.Request) Authenticator {
+	hostname := req.Url.Hostname()
+	for _, r := range a.rules {
+		if r.host.Match(hostname) {
+			return r.authenticator
+		}
+	}
+	return nil
+}
+
+func (a *Auth) HandleRequest(ctx context.Context, req *downloader.Request, meta downloader.RequestMetadata) (*downloader.Response, error) {
+	authenticator := a.authenticator(req)
+	if authenticator == nil {
+		return nil, nil
+	}
+	err := authenticator.Authenticate(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("auth: %w", err)
+	}
+	return nil, nil
+}
+
+func (a *Auth) HandleResponse(ctx context.Context, res *downloader.Response, meta downloader.ResponseMetadata) (*downloader.Response, error) {
+	// a replayed response was not authenticated with the current credentials
+	if meta.Replayed {
+		return nil, nil
+	}
+	req := res.Request()
+	retry, _ := downloader.GetRequestMeta[authRetry](req)
+	if res.Status() != http.StatusUnauthorized {
+		if retry.pending {
+			req.SetMeta(authRetry{})
+		}
+		return nil, nil
+	}
+	authenticator := a.authenticator(req)
+	if authenticator == nil {
+		return nil, nil
+	}
+	authenticator.Invalidate(ctx, req)
+
+	if retry.pending {
+		return nil, downloader.DroppedRequest(fmt.Errorf(
+			"auth: credentials for '%s' were rejected",
+			req.Url.Host,
+		))
+	}
+	req.SetMeta(authRetry{pending: true})
+	return nil, downloader.ReissueRequest(req)
+}
@@ -0,0 +1,272 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/LQR471814/scavenge/downloader"
+)
+
+// testTokenEndpoint is a fake OAuth2 token endpoint, it issues the tokens "token-1", "token-2",
+// ... and calls check with each token request.
+type testTokenEndpoint struct {
+	issued atomic.Int64
+	check  func(r *http.Request)
+	// wait blocks the token responses until it is closed if it is not nil.
+	wait chan struct{}
+}
+
+func newTestTokenEndpoint(t *testing.T, endpoint *testTokenEndpoint) *url.URL {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if endpoint.check != nil {
+			endpoint.check(r)
+		}
+		if endpoint.wait != nil {
+			<-endpoint.wait
+		}
+		n := endpoint.issued.Add(1)
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token":  fmt.Sprintf("token-%d", n),
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+			"refresh_token": fmt.Sprintf("refresh-%d", n),
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return downloader.MustParseUrl(srv.URL + "/token")
+}
+
+func TestAuthRules(t *testing.T) {
+	ctx, _ := testContext()
+	auth := NewAuth(
+		NewAuthRule("api.example.com", BearerToken("secret")),
+		NewAuthRule("*.example.com", BasicAuth{Username: "user", Password: "pass"}),
+	)
+
+	cases := []struct {
+		url      string
+		expected string
+	}{
+		{"https://api.example.com/a", "Bearer secret"},
+		{"https://www.example.com/a", "Basic dXNlcjpwYXNz"},
+		{"https://other.com/a", ""},
+	}
+	for _, c := range cases {
+		req := testGET(c.url)
+		_, err := auth.HandleRequest(ctx, req, downloader.RequestMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := req.Headers.Get("Authorization"); got != c.expected {
+			t.Fatalf("%s: expected Authorization '%s', got '%s'", c.url, c.expected, got)
+		}
+	}
+}
+
+func TestOAuth2ClientCredentials(t *testing.T) {
+	ctx, _ := testContext()
+	endpoint := &testTokenEndpoint{
+		check: func(r *http.Request) {
+			id, secret, ok := r.BasicAuth()
+			if !ok || id != "client" || secret != "secret" {
+				t.Errorf("expected client credentials with basic auth, got '%s' '%s'", id, secret)
+			}
+			if r.Form.Get("grant_type") != "client_credentials" {
+				t.Errorf("expected client_credentials grant, got '%s'", r.Form.Get("grant_type"))
+			}
+			if r.Form.Get("scope") != "read write" {
+				t.Errorf("expected scope 'read write', got '%s'", r.Form.Get("scope"))
+			}
+		},
+	}
+	tokenUrl := newTestTokenEndpoint(t, endpoint)
+
+	oauth := NewOAuth2(downloader.NewHttpClient(http.DefaultClient), OAuth2Config{
+		TokenUrl:     tokenUrl,
+		ClientId:     "client",
+		ClientSecret: "secret",
+		Scopes:       []string{"read", "write"},
+	})
+
+	for range 3 {
+		req := testGET("https://api.example.com")
+		err := oauth.Authenticate(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := req.Headers.Get("Authorization"); got != "Bearer token-1" {
+			t.Fatalf("expected the cached token, got '%s'", got)
+		}
+	}
+	if endpoint.issued.Load() != 1 {
+		t.Fatalf("expected 1 token to be fetched, got %d", endpoint.issued.Load())
+	}
+}
+
+func TestOAuth2RefreshToken(t *testing.T) {
+	ctx, _ := testContext()
+	var refreshTokens []string
+	endpoint := &testTokenEndpoint{
+		check: func(r *http.Request) {
+			if r.Form.Get("grant_type") != "refresh_token" {
+				t.Errorf("expected refresh_token grant, got '%s'", r.Form.Get("grant_type"))
+			}
+			if r.Form.Get("client_id") != "client" || r.Form.Get("client_secret") != "secret" {
+				t.Errorf("expected client credentials in the body, got '%s'", r.Form.Encode())
+			}
+			refreshTokens = append(refreshTokens, r.Form.Get("refresh_token"))
+		},
+	}
+	tokenUrl := newTestTokenEndpoint(t, endpoint)
+
+	oauth := NewOAuth2(downloader.NewHttpClient(http.DefaultClient), OAuth2Config{
+		TokenUrl:          tokenUrl,
+		ClientId:          "client",
+		ClientSecret:      "secret",
+		RefreshToken:      "initial",
+		CredentialsInBody: true,
+	})
+
+	req := testGET("https://api.example.com")
+	err := oauth.Authenticate(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oauth.Invalidate(ctx, req)
+	err = oauth.Authenticate(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := req.Headers.Get("Authorization"); got != "Bearer token-2" {
+		t.Fatalf("expected the refreshed token, got '%s'", got)
+	}
+	if strings.Join(refreshTokens, ",") != "initial,refresh-1" {
+		t.Fatalf("expected the refresh token to be rotated, got %v", refreshTokens)
+	}
+}
+
+func TestOAuth2FetchesOnce(t *testing.T) {
+	ctx, _ := testContext()
+	started := make(chan struct{})
+	var once sync.Once
+	endpoint := &testTokenEndpoint{
+		check: func(r *http.Request) {
+			once.Do(func() { close(started) })
+		},
+		wait: make(chan struct{}),
+	}
+	tokenUrl := newTestTokenEndpoint(t, endpoint)
+
+	oauth := NewOAuth2(downloader.NewHttpClient(http.DefaultClient), OAuth2Config{
+		TokenUrl: tokenUrl,
+	})
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := testGET("https://api.example.com")
+			err := oauth.Authenticate(ctx, req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if got := req.Headers.Get("Authorization"); got != "Bearer token-1" {
+				t.Errorf("expected the shared token, got '%s'", got)
+			}
+		}()
+	}
+
+	// the lock must not be held while the token is being fetched
+	<-started
+	req := testGET("https://api.example.com")
+	req.SetHeader("Authorization", "Bearer stale")
+	oauth.Invalidate(ctx, req)
+
+	close(endpoint.wait)
+	wg.Wait()
+	if endpoint.issued.Load() != 1 {
+		t.Fatalf("expected 1 token to be fetched, got %d", endpoint.issued.Load())
+	}
+}
+
+func TestAuthReissuesRejectedRequests(t *testing.T) {
+	ctx, _ := testContext()
+	endpoint := &testTokenEndpoint{}
+	tokenUrl := newTestTokenEndpoint(t, endpoint)
+	auth := NewAuth(NewAuthRule("**", NewOAuth2(
+		downloader.NewHttpClient(http.DefaultClient),
+		OAuth2Config{TokenUrl: tokenUrl},
+	)))
+
+	req := testGET("https://api.example.com")
+	download := func(status int) error {
+		_, err := auth.HandleRequest(ctx, req, downloader.RequestMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = auth.HandleResponse(ctx, testResponse(req, status), downloader.ResponseMetadata{})
+		return err
+	}
+	expectReissue := func(err error) {
+		t.Helper()
+		var reissue downloader.ReissueError
+		if !errors.As(err, &reissue) || reissue.Request != req {
+			t.Fatalf("expected the request to be reissued, got %v", err)
+		}
+	}
+
+	expectReissue(download(http.StatusUnauthorized))
+	if got := req.Headers.Get("Authorization"); got != "Bearer token-1" {
+		t.Fatalf("expected the first token, got '%s'", got)
+	}
+
+	// the reissued request is accepted with a new token
+	err := download(http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Headers.Get("Authorization"); got != "Bearer token-2" {
+		t.Fatalf("expected the token to be refreshed, got '%s'", got)
+	}
+
+	// a later rejection of the same request is retried again
+	expectReissue(download(http.StatusUnauthorized))
+	err = download(http.StatusUnauthorized)
+	if err == nil || !strings.Contains(err.Error(), "dropped request") {
+		t.Fatalf("expected the request to be dropped after being rejected twice, got %v", err)
+	}
+
+	// replayed responses do not invalidate the credentials
+	_, err = auth.HandleRequest(ctx, req, downloader.RequestMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued := endpoint.issued.Load()
+	_, err = auth.HandleResponse(ctx, testResponse(req, http.StatusUnauthorized), downloader.ResponseMetadata{Replayed: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = auth.HandleRequest(ctx, req, downloader.RequestMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.issued.Load() != issued {
+		t.Fatal("expected a replayed response to not refresh the token")
+	}
+}
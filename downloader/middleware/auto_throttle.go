@@ -39,9 +39,12 @@ func (t Throttle) HandleResponse(
 	ctx context.Context,
 	res *downloader.Response,
 	meta downloader.ResponseMetadata,
-) error {
+) (*downloader.Response, error) {
+	if meta.Replayed {
+		return nil, nil
+	}
 	t.handler.HandleResponse(ctx, res, meta)
-	return nil
+	return nil, nil
 }
 
 type autoThrottleCfg struct {
@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// TrackingParams are common query parameters used for tracking that do not change the page.
+var TrackingParams = []string{
+	"utm_*",
+	"fbclid",
+	"gclid",
+	"dclid",
+	"gbraid",
+	"wbraid",
+	"msclkid",
+	"yclid",
+	"mc_cid",
+	"mc_eid",
+	"_ga",
+	"_gl",
+	"igshid",
+	"ref_src",
+}
+
+// UrlRewrite replaces the matches of Pattern in a url with Replacement (which can reference
+// capture groups like [regexp.Regexp.ReplaceAllString]).
+type UrlRewrite struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// Canonicalizer rewrites urls into a canonical form so that different urls that lead to the
+// same page are treated as the same url, the zero value leaves urls unchanged.
+type Canonicalizer struct {
+	// StripParams are the query parameters that are removed, a name ending with "*" removes all
+	// parameters starting with the rest of the name (ex. "utm_*").
+	StripParams []string
+	// SortQuery sorts the query parameters by name (and value).
+	SortQuery bool
+	// LowercaseHost lowercases the host.
+	LowercaseHost bool
+	// DropFragment removes the fragment (#...).
+	DropFragment bool
+	// Rewrites are applied in order to the url after the other steps.
+	Rewrites []UrlRewrite
+}
+
+// DefaultCanonicalizer strips TrackingParams, sorts the query, lowercases the host and drops the
+// fragment.
+var DefaultCanonicalizer = Canonicalizer{
+	StripParams:   TrackingParams,
+	SortQuery:     true,
+	LowercaseHost: true,
+	DropFragment:  true,
+}
+
+func (c Canonicalizer) stripped(name string) bool {
+	for _, param := range c.StripParams {
+		prefix, wildcard := strings.CutSuffix(param, "*")
+		if wildcard && strings.HasPrefix(name, prefix) || name == param {
+			return true
+		}
+	}
+	return false
+}
+
+type queryParam struct {
+	name  string
+	value string
+	raw   string
+}
+
+// canonicalQuery strips and sorts the raw query while keeping the escaping of the parameters
+// that are kept.
+func (c Canonicalizer) canonicalQuery(rawQuery string) string {
+	if rawQuery == "" || (len(c.StripParams) == 0 && !c.SortQuery) {
+		return rawQuery
+	}
+
+	var params []queryParam
+	for _, raw := range strings.Split(rawQuery, "&") {
+		if raw == "" {
+			continue
+		}
+		rawName, rawValue, _ := strings.Cut(raw, "=")
+		name, err := url.QueryUnescape(rawName)
+		if err != nil {
+			name = rawName
+		}
+		if c.stripped(name) {
+			continue
+		}
+		value, err := url.QueryUnescape(rawValue)
+		if err != nil {
+			value = rawValue
+		}
+		params = append(params, queryParam{name: name, value: value, raw: raw})
+	}
+	if c.SortQuery {
+		sort.SliceStable(params, func(i, j int) bool {
+			if params[i].name != params[j].name {
+				return params[i].name < params[j].name
+			}
+			return params[i].value < params[j].value
+		})
+	}
+
+	raws := make([]string, len(params))
+	for i, p := range params {
+		raws[i] = p.raw
+	}
+	return strings.Join(raws, "&")
+}
+
+// Canonicalize returns the canonical form of the given url, the given url is not modified.
+func (c Canonicalizer) Canonicalize(u *url.URL) *url.URL {
+	out := *u
+	out.RawQuery = c.canonicalQuery(u.RawQuery)
+	if c.LowercaseHost {
+		out.Host = strings.ToLower(out.Host)
+	}
+	if c.DropFragment {
+		out.Fragment = ""
+		out.RawFragment = ""
+	}
+	if len(c.Rewrites) == 0 {
+		return &out
+	}
+
+	rewritten := out.String()
+	for _, r := range c.Rewrites {
+		rewritten = r.Pattern.ReplaceAllString(rewritten, r.Replacement)
+	}
+	parsed, err := url.Parse(rewritten)
+	if err != nil {
+		return &out
+	}
+	return parsed
+}
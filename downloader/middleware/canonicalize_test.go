@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/LQR471814/scavenge/downloader"
+)
+
+func TestCanonicalizer(t *testing.T) {
+	rewrites := Canonicalizer{Rewrites: []UrlRewrite{
+		{Pattern: regexp.MustCompile(`/amp/(.*)$`), Replacement: "/$1"},
+	}}
+
+	cases := []struct {
+		name      string
+		canonical Canonicalizer
+		in        string
+		out       string
+	}{
+		{"zero value", Canonicalizer{}, "https://Example.com/a?b=1&a=2#top", "https://Example.com/a?b=1&a=2#top"},
+		{"tracking params", DefaultCanonicalizer, "https://example.com/a?utm_source=x&id=1&fbclid=y", "https://example.com/a?id=1"},
+		{"sorted query", DefaultCanonicalizer, "https://example.com/a?b=2&a=1&a=0", "https://example.com/a?a=0&a=1&b=2"},
+		{"escaping is kept", DefaultCanonicalizer, "https://example.com/a?q=a%20b&p=%2F", "https://example.com/a?p=%2F&q=a%20b"},
+		{"host and fragment", DefaultCanonicalizer, "https://EXAMPLE.com/Path#section", "https://example.com/Path"},
+		{"only tracking params", DefaultCanonicalizer, "https://example.com/a?utm_medium=x", "https://example.com/a"},
+		{"rewrites", rewrites, "https://example.com/amp/article", "https://example.com/article"},
+	}
+	for _, c := range cases {
+		u := downloader.MustParseUrl(c.in)
+		out := c.canonical.Canonicalize(u)
+		if out.String() != c.out {
+			t.Fatalf("%s: expected '%s', got '%s'", c.name, c.out, out)
+		}
+		if u.String() != c.in {
+			t.Fatalf("%s: expected the given url to not be modified, got '%s'", c.name, u)
+		}
+	}
+}
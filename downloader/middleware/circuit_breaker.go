@@ -0,0 +1,226 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/LQR471814/scavenge"
+	"github.com/LQR471814/scavenge/downloader"
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitClosed:
+		return "closed"
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half_open"
+	}
+	return "unknown"
+}
+
+type circuitBreakerCfg struct {
+	threshold int
+	cooldown  time.Duration
+	drop      bool
+	isFailure func(res *downloader.Response) bool
+}
+
+type circuitBreakerOption = func(cfg *circuitBreakerCfg)
+
+// WithCircuitBreakerThreshold sets the amount of consecutive failures for a host before its circuit opens.
+func WithCircuitBreakerThreshold(failures int) circuitBreakerOption {
+	return func(cfg *circuitBreakerCfg) {
+		if failures < 1 {
+			panic(fmt.Errorf("circuit breaker: threshold '%d' must be at least 1", failures))
+		}
+		cfg.threshold = failures
+	}
+}
+
+// WithCircuitBreakerCooldown sets the amount of time a circuit stays open before a probe request is let through.
+func WithCircuitBreakerCooldown(cooldown time.Duration) circuitBreakerOption {
+	return func(cfg *circuitBreakerCfg) {
+		cfg.cooldown = cooldown
+	}
+}
+
+// WithCircuitBreakerDrop makes requests to hosts with an open circuit be dropped instead of
+// deferred (failed in a way that causes them to be retried later).
+func WithCircuitBreakerDrop() circuitBreakerOption {
+	return func(cfg *circuitBreakerCfg) {
+		cfg.drop = true
+	}
+}
+
+// WithCircuitBreakerFailure sets the function used to determine if a response counts as a failure,
+// by default, all responses with a 5xx status are failures.
+//
+// Note: requests that fail without a response (ex. timeouts) are always counted as failures.
+func WithCircuitBreakerFailure(isFailure func(res *downloader.Response) bool) circuitBreakerOption {
+	return func(cfg *circuitBreakerCfg) {
+		cfg.isFailure = isFailure
+	}
+}
+
+type circuit struct {
+	mu           sync.Mutex
+	state        circuitState
+	failures     int
+	openedAt     time.Time
+	probing      bool
+	probeStarted time.Time
+}
+
+// CircuitBreaker stops sending requests to hosts that are consistently failing.
+//
+//   - After a given amount of consecutive failures for a host, the circuit for that host opens and
+//     requests to it are deferred (or dropped).
+//   - Once the cooldown has passed, a single probe request is let through (the circuit is half-open),
+//     if it succeeds the circuit closes, otherwise it opens again.
+type CircuitBreaker struct {
+	cfg      circuitBreakerCfg
+	circuits sync.Map
+}
+
+func NewCircuitBreaker(options ...circuitBreakerOption) *CircuitBreaker {
+	cfg := circuitBreakerCfg{
+		threshold: 5,
+		cooldown:  30 * time.Second,
+		isFailure: func(res *downloader.Response) bool {
+			return res.Status() >= 500
+		},
+	}
+	for _, o := range options {
+		o(&cfg)
+	}
+	return &CircuitBreaker{
+		cfg:      cfg,
+		circuits: sync.Map{},
+	}
+}
+
+func (c *CircuitBreaker) circuit(host string) *circuit {
+	v, ok := c.circuits.Load(host)
+	if !ok {
+		v, _ = c.circuits.LoadOrStore(host, &circuit{})
+	}
+	return v.(*circuit)
+}
+
+// transition must be called with the circuit's lock held.
+func (c *CircuitBreaker) transition(ctx context.Context, host string, circ *circuit, to circuitState) {
+	logger := scavenge.LoggerFromContext(ctx)
+	stats := scavenge.StatsFromContext(ctx)
+
+	from := circ.state
+	circ.state = to
+	circ.probing = false
+	switch to {
+	case circuitOpen:
+		circ.openedAt = time.Now()
+		logger.Warn(
+			"circuit_breaker", "circuit opened",
+			"host", host,
+			"from", from,
+			"failures", circ.failures,
+		)
+	case circuitClosed:
+		circ.failures = 0
+		logger.Info("circuit_breaker", "circuit closed", "host", host, "from", from)
+	case circuitHalfOpen:
+		logger.Info("circuit_breaker", "circuit half-open", "host", host, "from", from)
+	}
+	stats.Inc("circuit_breaker", to.String(), 1)
+}
+
+func (c *CircuitBreaker) reject(ctx context.Context, host string) error {
+	stats := scavenge.StatsFromContext(ctx)
+	err := fmt.Errorf("circuit breaker: circuit for host '%s' is open", host)
+	if c.cfg.drop {
+		stats.Inc("circuit_breaker", "requests_dropped", 1)
+		return downloader.DroppedRequest(err)
+	}
+	stats.Inc("circuit_breaker", "requests_deferred", 1)
+	return err
+}
+
+func (c *CircuitBreaker) record(ctx context.Context, host string, failed bool) {
+	circ := c.circuit(host)
+	circ.mu.Lock()
+	defer circ.mu.Unlock()
+
+	switch circ.state {
+	case circuitClosed:
+		if !failed {
+			circ.failures = 0
+			return
+		}
+		circ.failures++
+		if circ.failures >= c.cfg.threshold {
+			c.transition(ctx, host, circ, circuitOpen)
+		}
+	case circuitHalfOpen:
+		if failed {
+			circ.failures++
+			c.transition(ctx, host, circ, circuitOpen)
+			return
+		}
+		c.transition(ctx, host, circ, circuitClosed)
+	}
+}
+
+func (c *CircuitBreaker) HandleRequest(ctx context.Context, req *downloader.Request, meta downloader.RequestMetadata) (*downloader.Response, error) {
+	host := req.Url.Host
+	circ := c.circuit(host)
+	circ.mu.Lock()
+	defer circ.mu.Unlock()
+
+	switch circ.state {
+	case circuitOpen:
+		if time.Since(circ.openedAt) < c.cfg.cooldown {
+			return nil, c.reject(ctx, host)
+		}
+		c.transition(ctx, host, circ, circuitHalfOpen)
+	case circuitHalfOpen:
+		// the probe may never come back if a later middleware dropped it, so a new probe is let through
+		// after another cooldown
+		if circ.probing && time.Since(circ.probeStarted) < c.cfg.cooldown {
+			return nil, c.reject(ctx, host)
+		}
+	default:
+		return nil, nil
+	}
+
+	circ.probing = true
+	circ.probeStarted = time.Now()
+	return nil, nil
+}
+
+func (c *CircuitBreaker) HandleResponse(ctx context.Context, res *downloader.Response, meta downloader.ResponseMetadata) (*downloader.Response, error) {
+	// replayed responses say nothing about the health of the host
+	if meta.Replayed {
+		return nil, nil
+	}
+	c.record(ctx, res.Request().Url.Host, c.cfg.isFailure(res))
+	return nil, nil
+}
+
+func (c *CircuitBreaker) HandleError(ctx context.Context, req *downloader.Request, meta downloader.RequestMetadata, err error) {
+	// the scraping context being canceled says nothing about the health of the host
+	if ctx.Err() != nil {
+		return
+	}
+	c.record(ctx, req.Url.Host, true)
+}
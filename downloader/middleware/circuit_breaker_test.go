@@ -0,0 +1,151 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LQR471814/scavenge/downloader"
+)
+
+func TestCircuitBreakerOpensAfterThreshold(t *testing.T) {
+	ctx, stats := testContext()
+	c := NewCircuitBreaker(WithCircuitBreakerThreshold(2), WithCircuitBreakerCooldown(time.Hour))
+	req := testGET("https://example.com/a")
+
+	for i := range 2 {
+		_, err := c.HandleRequest(ctx, req, downloader.RequestMetadata{})
+		if err != nil {
+			t.Fatalf("request %d: unexpected error: %v", i, err)
+		}
+		c.HandleResponse(ctx, testResponse(req, 503), downloader.ResponseMetadata{})
+	}
+
+	_, err := c.HandleRequest(ctx, req, downloader.RequestMetadata{})
+	if err == nil {
+		t.Fatal("expected the open circuit to reject the request")
+	}
+	if strings.Contains(err.Error(), "dropped request:") {
+		t.Fatalf("expected the request to be deferred, got: %v", err)
+	}
+	if stats.Get("circuit_breaker", "open") != 1 {
+		t.Fatalf("expected one open transition, got %d", stats.Get("circuit_breaker", "open"))
+	}
+
+	// other hosts are not affected
+	_, err = c.HandleRequest(ctx, testGET("https://other.com"), downloader.RequestMetadata{})
+	if err != nil {
+		t.Fatalf("unexpected error for another host: %v", err)
+	}
+}
+
+func TestCircuitBreakerSuccessResetsFailures(t *testing.T) {
+	ctx, _ := testContext()
+	c := NewCircuitBreaker(WithCircuitBreakerThreshold(2))
+	req := testGET("https://example.com")
+
+	for _, status := range []int{500, 200, 500, 200} {
+		_, err := c.HandleRequest(ctx, req, downloader.RequestMetadata{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		c.HandleResponse(ctx, testResponse(req, status), downloader.ResponseMetadata{})
+	}
+}
+
+func TestCircuitBreakerDrop(t *testing.T) {
+	ctx, _ := testContext()
+	c := NewCircuitBreaker(WithCircuitBreakerThreshold(1), WithCircuitBreakerDrop())
+	req := testGET("https://example.com")
+
+	c.HandleError(ctx, req, downloader.RequestMetadata{}, errors.New("timeout"))
+	_, err := c.HandleRequest(ctx, req, downloader.RequestMetadata{})
+	if err == nil || !strings.Contains(err.Error(), "dropped request:") {
+		t.Fatalf("expected a dropped request, got: %v", err)
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	ctx, _ := testContext()
+	cooldown := 20 * time.Millisecond
+	c := NewCircuitBreaker(WithCircuitBreakerThreshold(1), WithCircuitBreakerCooldown(cooldown))
+	req := testGET("https://example.com")
+
+	c.HandleResponse(ctx, testResponse(req, 500), downloader.ResponseMetadata{})
+	time.Sleep(cooldown)
+
+	_, err := c.HandleRequest(ctx, req, downloader.RequestMetadata{})
+	if err != nil {
+		t.Fatalf("expected the probe to be let through: %v", err)
+	}
+	_, err = c.HandleRequest(ctx, req, downloader.RequestMetadata{})
+	if err == nil {
+		t.Fatal("expected only a single probe to be let through")
+	}
+
+	// a failed probe opens the circuit again
+	c.HandleResponse(ctx, testResponse(req, 500), downloader.ResponseMetadata{})
+	_, err = c.HandleRequest(ctx, req, downloader.RequestMetadata{})
+	if err == nil {
+		t.Fatal("expected the circuit to open again after a failed probe")
+	}
+
+	// a successful probe closes the circuit
+	time.Sleep(cooldown)
+	_, err = c.HandleRequest(ctx, req, downloader.RequestMetadata{})
+	if err != nil {
+		t.Fatalf("expected the probe to be let through: %v", err)
+	}
+	c.HandleResponse(ctx, testResponse(req, 200), downloader.ResponseMetadata{})
+	for range 3 {
+		_, err = c.HandleRequest(ctx, req, downloader.RequestMetadata{})
+		if err != nil {
+			t.Fatalf("expected the circuit to be closed: %v", err)
+		}
+	}
+}
+
+func TestCircuitBreakerIgnoresCanceledContext(t *testing.T) {
+	ctx, _ := testContext()
+	c := NewCircuitBreaker(WithCircuitBreakerThreshold(1))
+	req := testGET("https://example.com")
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	c.HandleError(canceled, req, downloader.RequestMetadata{}, canceled.Err())
+
+	_, err := c.HandleRequest(ctx, req, downloader.RequestMetadata{})
+	if err != nil {
+		t.Fatalf("a canceled context should not count as a failure: %v", err)
+	}
+}
+
+// hangingClient is a Client whose requests never finish before their context is done.
+type hangingClient struct{}
+
+func (hangingClient) Do(ctx context.Context, req *downloader.Request) (*downloader.Response, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestCircuitBreakerCountsTimeouts(t *testing.T) {
+	ctx, _ := testContext()
+	c := NewCircuitBreaker(WithCircuitBreakerThreshold(1), WithCircuitBreakerCooldown(time.Hour))
+	dl := downloader.NewDownloader(hangingClient{}, c)
+
+	req := testGET("https://example.com")
+	req.AddMeta(downloader.Timeout{Duration: 10 * time.Millisecond})
+	_, err := dl.Download(ctx, req, downloader.RequestMetadata{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the request to time out, got %v", err)
+	}
+
+	req = testGET("https://example.com")
+	req.AddMeta(downloader.Timeout{Duration: 10 * time.Millisecond})
+	_, err = dl.Download(ctx, req, downloader.RequestMetadata{})
+	if err == nil || !strings.Contains(err.Error(), "is open") {
+		t.Fatalf("expected the timeout to open the circuit, got %v", err)
+	}
+}
@@ -0,0 +1,238 @@
+package middleware
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const netscapeHttpOnlyPrefix = "#HttpOnly_"
+
+func netscapeBool(value string) bool {
+	return strings.EqualFold(value, "TRUE")
+}
+
+func formatNetscapeBool(value bool) string {
+	if value {
+		return "TRUE"
+	}
+	return "FALSE"
+}
+
+// ImportNetscape adds the cookies in the Netscape cookies.txt format (as exported by browser
+// extensions and curl) to the jar.
+func (j *CookieJar) ImportNetscape(r io.Reader) error {
+	var cookies []JarCookie
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		httpOnly := false
+		if strings.HasPrefix(line, netscapeHttpOnlyPrefix) {
+			httpOnly = true
+			line = line[len(netscapeHttpOnlyPrefix):]
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return fmt.Errorf("import netscape cookies: line %d: expected 7 fields, got %d", lineNo, len(fields))
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return fmt.Errorf("import netscape cookies: line %d: expires: %w", lineNo, err)
+		}
+
+		c := JarCookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Domain:   fields[0],
+			Path:     fields[2],
+			Secure:   netscapeBool(fields[3]),
+			HttpOnly: httpOnly,
+			HostOnly: !netscapeBool(fields[1]) && !strings.HasPrefix(fields[0], "."),
+		}
+		if expires > 0 {
+			c.Expires = time.Unix(expires, 0)
+		}
+		cookies = append(cookies, c)
+	}
+	err := scanner.Err()
+	if err != nil {
+		return fmt.Errorf("import netscape cookies: %w", err)
+	}
+
+	j.Add(cookies...)
+	return nil
+}
+
+// ExportNetscape writes the cookies in the jar in the Netscape cookies.txt format.
+func (j *CookieJar) ExportNetscape(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	_, err := bw.WriteString("# Netscape HTTP Cookie File\n\n")
+	if err != nil {
+		return fmt.Errorf("export netscape cookies: %w", err)
+	}
+
+	for _, c := range j.All() {
+		domain := c.Domain
+		if !c.HostOnly {
+			domain = "." + domain
+		}
+		if c.HttpOnly {
+			domain = netscapeHttpOnlyPrefix + domain
+		}
+		expires := int64(0)
+		if !c.Expires.IsZero() {
+			expires = c.Expires.Unix()
+		}
+
+		_, err = fmt.Fprintf(
+			bw,
+			"%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			domain,
+			formatNetscapeBool(!c.HostOnly),
+			c.Path,
+			formatNetscapeBool(c.Secure),
+			expires,
+			c.Name,
+			c.Value,
+		)
+		if err != nil {
+			return fmt.Errorf("export netscape cookies: %w", err)
+		}
+	}
+
+	err = bw.Flush()
+	if err != nil {
+		return fmt.Errorf("export netscape cookies: %w", err)
+	}
+	return nil
+}
+
+// jsonCookie is the format of the cookies exported by browser extensions and devtools.
+type jsonCookie struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Domain string `json:"domain"`
+	Path   string `json:"path"`
+	// Expires is a unix timestamp in seconds, it is absent or not positive for session cookies.
+	Expires *float64 `json:"expires,omitempty"`
+	// ExpirationDate is an alias of Expires used by some browser extensions.
+	ExpirationDate *float64 `json:"expirationDate,omitempty"`
+	Secure         bool     `json:"secure"`
+	HttpOnly       bool     `json:"httpOnly"`
+	SameSite       string   `json:"sameSite,omitempty"`
+	HostOnly       *bool    `json:"hostOnly,omitempty"`
+}
+
+func parseSameSite(value string) http.SameSite {
+	switch strings.ToLower(value) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "lax":
+		return http.SameSiteLaxMode
+	case "none", "no_restriction":
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteDefaultMode
+}
+
+func formatSameSite(value http.SameSite) string {
+	switch value {
+	case http.SameSiteStrictMode:
+		return "Strict"
+	case http.SameSiteLaxMode:
+		return "Lax"
+	case http.SameSiteNoneMode:
+		return "None"
+	}
+	return ""
+}
+
+// ImportJSON adds the cookies in a json array to the jar, each cookie should be an object with
+// the fields: name, value, domain, path, expires (unix seconds), secure, httpOnly and sameSite.
+//
+// A domain starting with "." (or hostOnly set to false) indicates the cookie is also sent to subdomains.
+func (j *CookieJar) ImportJSON(r io.Reader) error {
+	var parsed []jsonCookie
+	err := json.NewDecoder(r).Decode(&parsed)
+	if err != nil {
+		return fmt.Errorf("import json cookies: %w", err)
+	}
+
+	cookies := make([]JarCookie, len(parsed))
+	for i, p := range parsed {
+		c := JarCookie{
+			Name:     p.Name,
+			Value:    p.Value,
+			Domain:   p.Domain,
+			Path:     p.Path,
+			Secure:   p.Secure,
+			HttpOnly: p.HttpOnly,
+			SameSite: parseSameSite(p.SameSite),
+			HostOnly: !strings.HasPrefix(p.Domain, "."),
+		}
+		if p.HostOnly != nil {
+			c.HostOnly = *p.HostOnly
+		}
+		expires := p.Expires
+		if expires == nil {
+			expires = p.ExpirationDate
+		}
+		if expires != nil && *expires > 0 {
+			sec, frac := math.Modf(*expires)
+			c.Expires = time.Unix(int64(sec), int64(frac*1e9))
+		}
+		cookies[i] = c
+	}
+
+	j.Add(cookies...)
+	return nil
+}
+
+// ExportJSON writes the cookies in the jar in the json format read by ImportJSON.
+func (j *CookieJar) ExportJSON(w io.Writer) error {
+	all := j.All()
+	out := make([]jsonCookie, len(all))
+	for i, c := range all {
+		domain := c.Domain
+		if !c.HostOnly {
+			domain = "." + domain
+		}
+		hostOnly := c.HostOnly
+		out[i] = jsonCookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Domain:   domain,
+			Path:     c.Path,
+			Secure:   c.Secure,
+			HttpOnly: c.HttpOnly,
+			SameSite: formatSameSite(c.SameSite),
+			HostOnly: &hostOnly,
+		}
+		if !c.Expires.IsZero() {
+			expires := float64(c.Expires.UnixNano()) / 1e9
+			out[i].Expires = &expires
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	err := enc.Encode(out)
+	if err != nil {
+		return fmt.Errorf("export json cookies: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package middleware
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LQR471814/scavenge/downloader"
+)
+
+const testNetscapeCookies = "# Netscape HTTP Cookie File\n" +
+	"\n" +
+	".example.com\tTRUE\t/\tTRUE\t4102444800\tshared\t1\n" +
+	"#HttpOnly_www.example.com\tFALSE\t/app\tFALSE\t0\tsession\tabc\n" +
+	"expired.com\tFALSE\t/\tFALSE\t1\told\t1\n"
+
+func TestImportNetscape(t *testing.T) {
+	jar := NewCookieJar()
+	err := jar.ImportNetscape(strings.NewReader(testNetscapeCookies))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all := jar.All()
+	if len(all) != 2 {
+		t.Fatalf("expected 2 cookies (the expired one skipped), got %+v", all)
+	}
+	byName := map[string]JarCookie{}
+	for _, c := range all {
+		byName[c.Name] = c
+	}
+
+	shared := byName["shared"]
+	if shared.Domain != "example.com" || shared.HostOnly || !shared.Secure || shared.Expires.Unix() != 4102444800 {
+		t.Fatalf("unexpected shared cookie: %+v", shared)
+	}
+	session := byName["session"]
+	if session.Domain != "www.example.com" || !session.HostOnly || !session.HttpOnly ||
+		session.Path != "/app" || !session.Expires.IsZero() {
+		t.Fatalf("unexpected session cookie: %+v", session)
+	}
+
+	got := jar.Cookies(downloader.MustParseUrl("https://sub.example.com/"))
+	if len(got) != 1 || got[0].Name != "shared" {
+		t.Fatalf("expected only the domain cookie for a subdomain, got %v", got)
+	}
+}
+
+func TestImportNetscapeInvalid(t *testing.T) {
+	jar := NewCookieJar()
+	err := jar.ImportNetscape(strings.NewReader("example.com\tTRUE\t/\n"))
+	if err == nil {
+		t.Fatal("expected an error for a line with missing fields")
+	}
+}
+
+func TestImportJSON(t *testing.T) {
+	jar := NewCookieJar()
+	err := jar.ImportJSON(strings.NewReader(`[
+		{"name": "a", "value": "1", "domain": ".example.com", "path": "/", "expirationDate": 4102444800.5, "sameSite": "lax"},
+		{"name": "b", "value": "2", "domain": "example.com", "path": "/", "hostOnly": false, "secure": true},
+		{"name": "c", "value": "3", "domain": "example.com", "path": "/", "expires": -1}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byName := map[string]JarCookie{}
+	for _, c := range jar.All() {
+		byName[c.Name] = c
+	}
+	a := byName["a"]
+	if a.HostOnly || a.SameSite != http.SameSiteLaxMode || a.Expires.Unix() != 4102444800 {
+		t.Fatalf("unexpected cookie a: %+v", a)
+	}
+	if byName["b"].HostOnly || !byName["b"].Secure {
+		t.Fatalf("unexpected cookie b: %+v", byName["b"])
+	}
+	if !byName["c"].HostOnly || !byName["c"].Expires.IsZero() {
+		t.Fatalf("expected c to be a host only session cookie: %+v", byName["c"])
+	}
+}
+
+func TestCookieFormatsRoundTrip(t *testing.T) {
+	jar := NewCookieJar()
+	jar.Add(
+		JarCookie{Name: "a", Value: "1", Domain: "example.com", Path: "/", HostOnly: true, HttpOnly: true},
+		JarCookie{Name: "b", Value: "2", Domain: "example.com", Path: "/x", Secure: true, Expires: time.Unix(4102444800, 0)},
+	)
+
+	formats := []struct {
+		name    string
+		export  func(jar *CookieJar, buf *bytes.Buffer) error
+		import_ func(jar *CookieJar, buf *bytes.Buffer) error
+	}{
+		{
+			"netscape",
+			func(jar *CookieJar, buf *bytes.Buffer) error { return jar.ExportNetscape(buf) },
+			func(jar *CookieJar, buf *bytes.Buffer) error { return jar.ImportNetscape(buf) },
+		},
+		{
+			"json",
+			func(jar *CookieJar, buf *bytes.Buffer) error { return jar.ExportJSON(buf) },
+			func(jar *CookieJar, buf *bytes.Buffer) error { return jar.ImportJSON(buf) },
+		},
+	}
+	for _, f := range formats {
+		t.Run(f.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := f.export(jar, &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			imported := NewCookieJar()
+			err = f.import_(imported, &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := jar.All()
+			got := imported.All()
+			if len(got) != len(want) {
+				t.Fatalf("expected %d cookies, got %d", len(want), len(got))
+			}
+			for i := range want {
+				w, g := want[i], got[i]
+				if w.Name != g.Name || w.Value != g.Value || w.Domain != g.Domain || w.Path != g.Path ||
+					w.HostOnly != g.HostOnly || w.Secure != g.Secure || w.HttpOnly != g.HttpOnly ||
+					!w.Expires.Equal(g.Expires) {
+					t.Fatalf("cookie changed in the round trip:\nwant %+v\ngot  %+v", w, g)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JarCookie is a cookie stored in a CookieJar.
+type JarCookie struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Domain string `json:"domain"`
+	Path   string `json:"path"`
+	// Expires is zero for session cookies.
+	Expires  time.Time     `json:"expires"`
+	Secure   bool          `json:"secure"`
+	HttpOnly bool          `json:"httpOnly"`
+	SameSite http.SameSite `json:"sameSite"`
+	// HostOnly is true if the cookie should only be sent to Domain and not its subdomains.
+	HostOnly bool      `json:"hostOnly"`
+	Created  time.Time `json:"created"`
+}
+
+func (c JarCookie) id() string {
+	return c.Domain + ";" + c.Path + ";" + c.Name
+}
+
+func (c JarCookie) expired(now time.Time) bool {
+	return !c.Expires.IsZero() && !now.Before(c.Expires)
+}
+
+// CookieJar implements [http.CookieJar] following the storage model of
+// [RFC 6265](https://datatracker.ietf.org/doc/html/rfc6265#section-5.3), unlike
+// [net/http/cookiejar.Jar] its cookies can be listed.
+//
+// Note: CookieJar does not consult a public suffix list, so it will accept cookies set on
+// domains like "co.uk".
+type CookieJar struct {
+	mu      sync.Mutex
+	cookies map[string]JarCookie
+}
+
+func NewCookieJar() *CookieJar {
+	return &CookieJar{
+		cookies: map[string]JarCookie{},
+	}
+}
+
+func isIP(host string) bool {
+	return net.ParseIP(host) != nil
+}
+
+// domainMatch implements https://datatracker.ietf.org/doc/html/rfc6265#section-5.1.3
+func domainMatch(host, domain string) bool {
+	if host == domain {
+		return true
+	}
+	return strings.HasSuffix(host, "."+domain) && !isIP(host)
+}
+
+// pathMatch implements https://datatracker.ietf.org/doc/html/rfc6265#section-5.1.4
+func pathMatch(reqPath, cookiePath string) bool {
+	if reqPath == cookiePath {
+		return true
+	}
+	if !strings.HasPrefix(reqPath, cookiePath) {
+		return false
+	}
+	return strings.HasSuffix(cookiePath, "/") || reqPath[len(cookiePath)] == '/'
+}
+
+// defaultPath implements https://datatracker.ietf.org/doc/html/rfc6265#section-5.1.4
+func defaultPath(reqPath string) string {
+	if reqPath == "" || reqPath[0] != '/' {
+		return "/"
+	}
+	i := strings.LastIndex(reqPath, "/")
+	if i == 0 {
+		return "/"
+	}
+	return reqPath[:i]
+}
+
+// SetCookies implements [http.CookieJar.SetCookies]
+func (j *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	host := strings.ToLower(u.Hostname())
+	now := time.Now()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, c := range cookies {
+		jc := JarCookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Domain:   host,
+			Path:     c.Path,
+			Secure:   c.Secure,
+			HttpOnly: c.HttpOnly,
+			SameSite: c.SameSite,
+			HostOnly: true,
+			Created:  now,
+		}
+
+		domain := strings.ToLower(strings.TrimPrefix(c.Domain, "."))
+		if domain != "" && domain != host {
+			// a cookie cannot be set for another site or on a top-level domain
+			if isIP(host) || !strings.Contains(domain, ".") || !domainMatch(host, domain) {
+				continue
+			}
+			jc.Domain = domain
+			jc.HostOnly = false
+		}
+		if jc.Path == "" || jc.Path[0] != '/' {
+			jc.Path = defaultPath(u.Path)
+		}
+
+		switch {
+		case c.MaxAge < 0:
+			jc.Expires = now
+		case c.MaxAge > 0:
+			jc.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+		case !c.Expires.IsZero():
+			jc.Expires = c.Expires
+		}
+
+		id := jc.id()
+		if jc.expired(now) {
+			delete(j.cookies, id)
+			continue
+		}
+		old, ok := j.cookies[id]
+		if ok {
+			jc.Created = old.Created
+		}
+		j.cookies[id] = jc
+	}
+}
+
+// Cookies implements [http.CookieJar.Cookies]
+func (j *CookieJar) Cookies(u *url.URL) []*http.Cookie {
+	host := strings.ToLower(u.Hostname())
+	secure := u.Scheme == "https" || u.Scheme == "wss"
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	now := time.Now()
+
+	j.mu.Lock()
+	var matched []JarCookie
+	for id, c := range j.cookies {
+		if c.expired(now) {
+			delete(j.cookies, id)
+			continue
+		}
+		if c.HostOnly && host != c.Domain {
+			continue
+		}
+		if !c.HostOnly && !domainMatch(host, c.Domain) {
+			continue
+		}
+		if c.Secure && !secure {
+			continue
+		}
+		if !pathMatch(path, c.Path) {
+			continue
+		}
+		matched = append(matched, c)
+	}
+	j.mu.Unlock()
+
+	// https://datatracker.ietf.org/doc/html/rfc6265#section-5.4
+	sort.Slice(matched, func(a, b int) bool {
+		if len(matched[a].Path) != len(matched[b].Path) {
+			return len(matched[a].Path) > len(matched[b].Path)
+		}
+		return matched[a].Created.Before(matched[b].Created)
+	})
+
+	out := make([]*http.Cookie, len(matched))
+	for i, c := range matched {
+		out[i] = &http.Cookie{Name: c.Name, Value: c.Value}
+	}
+	return out
+}
+
+// All returns all the cookies in the jar that have not expired.
+func (j *CookieJar) All() []JarCookie {
+	now := time.Now()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	out := make([]JarCookie, 0, len(j.cookies))
+	for _, c := range j.cookies {
+		if c.expired(now) {
+			continue
+		}
+		out = append(out, c)
+	}
+	sort.Slice(out, func(a, b int) bool {
+		return out[a].id() < out[b].id()
+	})
+	return out
+}
+
+// Add adds the given cookies to the jar as-is, replacing any cookies with the same name, domain
+// and path.
+func (j *CookieJar) Add(cookies ...JarCookie) {
+	now := time.Now()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, c := range cookies {
+		c.Domain = strings.ToLower(strings.TrimPrefix(c.Domain, "."))
+		if c.Path == "" {
+			c.Path = "/"
+		}
+		if c.Created.IsZero() {
+			c.Created = now
+		}
+		if c.expired(now) {
+			continue
+		}
+		j.cookies[c.id()] = c
+	}
+}
+
+// Clear removes all cookies from the jar.
+func (j *CookieJar) Clear() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.cookies = map[string]JarCookie{}
+}
@@ -2,53 +2,167 @@ package middleware
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
-	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/LQR471814/scavenge"
 	"github.com/LQR471814/scavenge/downloader"
 )
 
+// originalCookieHeader keeps the cookie header a request had before cookies from the jar were
+// added, since requests are reused between retries.
+type originalCookieHeader struct {
+	value string
+}
+
 // Cookies persists cookies across requests.
+//
+// Each [Session] has its own CookieJar, so a crawl can be logged in as several accounts at once.
+// A session logged into by hand in a browser can be reused by importing its cookies with
+// [CookieJar.ImportNetscape] or [CookieJar.ImportJSON].
+//
+// The cookies set by the redirects [downloader.HttpClient] follows are stored and sent with the
+// redirected requests.
+//
+// The cookies of replayed responses are also stored, so a crawl replayed from a ReplayStore
+// sends the same cookies as the crawl that recorded it.
 type Cookies struct {
-	jar *cookiejar.Jar
+	mu   sync.Mutex
+	jars map[string]*CookieJar
+}
+
+func NewCookies() *Cookies {
+	return &Cookies{
+		jars: map[string]*CookieJar{},
+	}
 }
 
-func NewCookies(jar *cookiejar.Jar) Cookies {
-	return Cookies{
-		jar: jar,
+// Jar returns the CookieJar of the given session, creating it if it does not exist.
+func (c *Cookies) Jar(session string) *CookieJar {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	jar, ok := c.jars[session]
+	if !ok {
+		jar = NewCookieJar()
+		c.jars[session] = jar
 	}
+	return jar
 }
 
-func (c Cookies) HandleRequest(ctx context.Context, req *downloader.Request, meta downloader.RequestMetadata) (*downloader.Response, error) {
-	cookies := c.jar.Cookies(req.Url)
+// Sessions returns the names of all the sessions that have a CookieJar.
+func (c *Cookies) Sessions() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]string, 0, len(c.jars))
+	for name := range c.jars {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Save writes the cookies of all sessions to a json file at the given path.
+func (c *Cookies) Save(path string) error {
+	saved := map[string][]JarCookie{}
+	for _, session := range c.Sessions() {
+		saved[session] = c.Jar(session).All()
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("save cookies: %w", err)
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "\t")
+	err = enc.Encode(saved)
+	if err != nil {
+		return fmt.Errorf("save cookies: %w", err)
+	}
+	return nil
+}
+
+// Load adds the cookies of all sessions from a json file written by Save.
+func (c *Cookies) Load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("load cookies: %w", err)
+	}
+	defer f.Close()
+
+	saved := map[string][]JarCookie{}
+	err = json.NewDecoder(f).Decode(&saved)
+	if err != nil {
+		return fmt.Errorf("load cookies: %w", err)
+	}
+	for session, cookies := range saved {
+		c.Jar(session).Add(cookies...)
+	}
+	return nil
+}
+
+func (c *Cookies) HandleRequest(ctx context.Context, req *downloader.Request, meta downloader.RequestMetadata) (*downloader.Response, error) {
 	if req.Headers == nil {
 		req.Headers = http.Header{}
 	}
-	for _, c := range cookies {
-		req.Headers.Add("cookie", c.String())
+
+	original, ok := downloader.GetRequestMeta[originalCookieHeader](req)
+	if !ok {
+		original = originalCookieHeader{value: req.Headers.Get("Cookie")}
+		req.AddMeta(original)
+	}
+
+	jar := c.Jar(requestSession(req))
+	req.SetMeta(downloader.RedirectCookies{Jar: jar, Header: original.value})
+
+	cookies := jar.Cookies(req.Url)
+	pairs := make([]string, 0, len(cookies)+1)
+	if original.value != "" {
+		pairs = append(pairs, original.value)
+	}
+	for _, cookie := range cookies {
+		pairs = append(pairs, cookie.String())
 	}
+
+	if len(pairs) == 0 {
+		req.Headers.Del("Cookie")
+		return nil, nil
+	}
+	req.Headers.Set("Cookie", strings.Join(pairs, "; "))
 	return nil, nil
 }
 
-func (c Cookies) HandleResponse(ctx context.Context, res *downloader.Response, meta downloader.ResponseMetadata) error {
-	logger := scavenge.LoggerFromContext(ctx)
+func (c *Cookies) HandleResponse(ctx context.Context, res *downloader.Response, meta downloader.ResponseMetadata) (*downloader.Response, error) {
+	jar := c.Jar(requestSession(res.Request()))
+	// the cookies set by redirects are usually already stored by the client while following them,
+	// but not for responses from other clients (or replayed responses)
+	for _, r := range res.Redirects() {
+		c.setCookies(ctx, jar, r.Url, r.Headers)
+	}
+	c.setCookies(ctx, jar, res.Url(), res.Headers())
+	return nil, nil
+}
 
-	for k, values := range res.Headers() {
-		if k != "Cookie" {
+func (c *Cookies) setCookies(ctx context.Context, jar *CookieJar, u *url.URL, headers http.Header) {
+	values := headers.Values("Set-Cookie")
+	if len(values) == 0 {
+		return
+	}
+	cookies := make([]*http.Cookie, 0, len(values))
+	for _, v := range values {
+		cookie, err := http.ParseSetCookie(v)
+		if err != nil {
+			scavenge.LoggerFromContext(ctx).Warn("cookies", "parse set-cookie", "err", err)
 			continue
 		}
-		cookies := make([]*http.Cookie, 0, len(values))
-		for _, v := range values {
-			c, err := http.ParseSetCookie(v)
-			if err != nil {
-				logger.Warn("cookies", "parse set-cookie", "err", err)
-				continue
-			}
-			cookies = append(cookies, c)
-		}
-		c.jar.SetCookies(res.Url(), cookies)
+		cookies = append(cookies, cookie)
 	}
-
-	return nil
+	jar.SetCookies(u, cookies)
 }
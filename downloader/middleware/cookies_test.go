@@ -0,0 +1,179 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/LQR471814/scavenge/downloader"
+)
+
+func TestCookiesFollowLoginRedirect(t *testing.T) {
+	ctx, _ := testContext()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Path: "/"})
+			http.Redirect(w, r, "/home", http.StatusFound)
+		case "/home":
+			c, err := r.Cookie("session")
+			if err != nil || c.Value != "abc" {
+				w.Write([]byte("no cookie"))
+				return
+			}
+			w.Write([]byte("logged in"))
+		}
+	}))
+	defer srv.Close()
+
+	cookies := NewCookies()
+	dl := downloader.NewDownloader(downloader.NewHttpClient(http.DefaultClient), cookies)
+
+	res, err := dl.Download(ctx, downloader.POSTRequest(downloader.MustParseUrl(srv.URL+"/login")), downloader.RequestMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res.RawBody()) != "logged in" {
+		t.Fatalf("expected the redirected request to carry the cookie, got '%s'", res.RawBody())
+	}
+	if len(cookies.Jar("").All()) != 1 {
+		t.Fatalf("expected the cookie to be stored, got %v", cookies.Jar("").All())
+	}
+
+	res, err = dl.Download(ctx, testGET(srv.URL+"/home"), downloader.RequestMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res.RawBody()) != "logged in" {
+		t.Fatalf("expected later requests to carry the cookie, got '%s'", res.RawBody())
+	}
+}
+
+func TestCookiesFromRedirectsOfResponse(t *testing.T) {
+	ctx, _ := testContext()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "hop", Value: "1", Path: "/"})
+			http.Redirect(w, r, "/home", http.StatusFound)
+		case "/home":
+			http.SetCookie(w, &http.Cookie{Name: "final", Value: "1", Path: "/"})
+		}
+	}))
+	defer srv.Close()
+
+	// a response downloaded without the Cookies middleware (ex. a replayed one)
+	req := testGET(srv.URL + "/login")
+	res, err := downloader.NewHttpClient(http.DefaultClient).Do(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cookies := NewCookies()
+	cookies.HandleResponse(ctx, res, downloader.ResponseMetadata{})
+	got := map[string]bool{}
+	for _, c := range cookies.Jar("").Cookies(downloader.MustParseUrl(srv.URL)) {
+		got[c.Name] = true
+	}
+	if !got["hop"] || !got["final"] {
+		t.Fatalf("expected the cookies of the redirect and the final response, got %v", got)
+	}
+}
+
+func TestCookiesKeepOriginalHeaderOnRetry(t *testing.T) {
+	ctx, _ := testContext()
+	cookies := NewCookies()
+	cookies.Jar("").SetCookies(downloader.MustParseUrl("https://example.com"), []*http.Cookie{{Name: "jar", Value: "1"}})
+
+	req := testGET("https://example.com")
+	req.SetHeader("Cookie", "own=1")
+	for range 3 {
+		cookies.HandleRequest(ctx, req, downloader.RequestMetadata{})
+	}
+	if req.Headers.Get("Cookie") != "own=1; jar=1" {
+		t.Fatalf("unexpected Cookie header '%s'", req.Headers.Get("Cookie"))
+	}
+}
+
+func TestCookiesSessions(t *testing.T) {
+	ctx, _ := testContext()
+	cookies := NewCookies()
+	u := downloader.MustParseUrl("https://example.com")
+	cookies.Jar("alice").SetCookies(u, []*http.Cookie{{Name: "user", Value: "alice"}})
+	cookies.Jar("bob").SetCookies(u, []*http.Cookie{{Name: "user", Value: "bob"}})
+
+	for _, name := range []string{"alice", "bob"} {
+		req := testGET("https://example.com")
+		req.AddMeta(Session{Name: name})
+		cookies.HandleRequest(ctx, req, downloader.RequestMetadata{})
+		if req.Headers.Get("Cookie") != "user="+name {
+			t.Fatalf("expected the cookie of session '%s', got '%s'", name, req.Headers.Get("Cookie"))
+		}
+	}
+
+	req := testGET("https://example.com")
+	cookies.HandleRequest(ctx, req, downloader.RequestMetadata{})
+	if req.Headers.Get("Cookie") != "" {
+		t.Fatalf("expected no cookies for the default session, got '%s'", req.Headers.Get("Cookie"))
+	}
+}
+
+func TestCookiesSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cookies.json")
+	u := downloader.MustParseUrl("https://example.com")
+
+	cookies := NewCookies()
+	cookies.Jar("alice").SetCookies(u, []*http.Cookie{{Name: "a", Value: "1"}})
+	cookies.Jar("").SetCookies(u, []*http.Cookie{{Name: "b", Value: "2"}})
+	err := cookies.Save(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewCookies()
+	err = loaded.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Sessions()) != 2 {
+		t.Fatalf("expected 2 sessions, got %v", loaded.Sessions())
+	}
+	got := loaded.Jar("alice").Cookies(u)
+	if len(got) != 1 || got[0].Value != "1" {
+		t.Fatalf("unexpected cookies: %v", got)
+	}
+}
+
+func TestCookieJarRules(t *testing.T) {
+	jar := NewCookieJar()
+	jar.SetCookies(downloader.MustParseUrl("https://www.example.com/a/b"), []*http.Cookie{
+		{Name: "host", Value: "1"},
+		{Name: "domain", Value: "1", Domain: "example.com"},
+		{Name: "secure", Value: "1", Secure: true, Path: "/"},
+		{Name: "path", Value: "1", Path: "/other"},
+		{Name: "foreign", Value: "1", Domain: "other.com"},
+	})
+
+	names := func(rawUrl string) map[string]bool {
+		out := map[string]bool{}
+		for _, c := range jar.Cookies(downloader.MustParseUrl(rawUrl)) {
+			out[c.Name] = true
+		}
+		return out
+	}
+
+	got := names("https://www.example.com/a/c")
+	if !got["host"] || !got["domain"] || !got["secure"] || got["path"] || got["foreign"] {
+		t.Fatalf("unexpected cookies for the same host: %v", got)
+	}
+	got = names("http://sub.example.com/a")
+	if got["host"] || !got["domain"] || got["secure"] {
+		t.Fatalf("unexpected cookies for a subdomain over http: %v", got)
+	}
+
+	jar.SetCookies(downloader.MustParseUrl("https://www.example.com"), []*http.Cookie{{Name: "domain", Domain: "example.com", Path: "/a", MaxAge: -1}})
+	if names("https://www.example.com/a/c")["domain"] {
+		t.Fatal("expected the deleted cookie to be removed")
+	}
+}
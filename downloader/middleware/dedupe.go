@@ -4,40 +4,109 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"sync"
 
+	"github.com/LQR471814/scavenge"
 	"github.com/LQR471814/scavenge/downloader"
 
 	"github.com/PuerkitoBio/purell"
 )
 
+type dedupeCfg struct {
+	key        func(req *downloader.Request) string
+	set        FingerprintSet
+	canonical  Canonicalizer
+	allMethods bool
+}
+
+type dedupeOption = func(cfg *dedupeCfg)
+
+// WithDedupeFingerprinter makes requests be differentiated by the fingerprint created by the given
+// Fingerprinter instead of only their normalized url.
+func WithDedupeFingerprinter(f Fingerprinter) dedupeOption {
+	return func(cfg *dedupeCfg) {
+		cfg.key = f.Fingerprint
+	}
+}
+
+// WithDedupeCanonicalizer canonicalizes urls with the given Canonicalizer before they are
+// normalized (ex. DefaultCanonicalizer), it has no effect with WithDedupeFingerprinter.
+func WithDedupeCanonicalizer(c Canonicalizer) dedupeOption {
+	return func(cfg *dedupeCfg) {
+		cfg.canonical = c
+	}
+}
+
+// WithDedupeAllMethods also drops duplicate requests that are not GET requests, they are
+// differentiated by their Fingerprint (so by their method, url and body).
+func WithDedupeAllMethods() dedupeOption {
+	return func(cfg *dedupeCfg) {
+		cfg.allMethods = true
+	}
+}
+
+// WithDedupeSet sets the set the keys of requests are stored in, by default it is a
+// MemoryFingerprintSet.
+//
+// Persisting the set (ex. with DiskFingerprintSet or BloomFingerprintSet.Save) makes requests
+// made by previous crawls be dropped as duplicates.
+func WithDedupeSet(set FingerprintSet) dedupeOption {
+	return func(cfg *dedupeCfg) {
+		cfg.set = set
+	}
+}
+
 // Dedupe drops duplicate GET requests, requests are differentiated by their normalized url.
+//
+// Requests with downloader.DontFilter meta are never dropped (or added to the set).
 type Dedupe struct {
-	reqs sync.Map
+	cfg dedupeCfg
 }
 
-func NewDedupe() *Dedupe {
-	return &Dedupe{
-		reqs: sync.Map{},
+func NewDedupe(options ...dedupeOption) *Dedupe {
+	cfg := dedupeCfg{}
+	for _, o := range options {
+		o(&cfg)
+	}
+	if cfg.key == nil {
+		canonical := cfg.canonical
+		cfg.key = func(req *downloader.Request) string {
+			if req.Method == http.MethodGet {
+				return purell.NormalizeURL(canonical.Canonicalize(req.Url), purell.FlagsSafe)
+			}
+			return Fingerprinter{Canonicalizer: canonical}.Fingerprint(req)
+		}
+	}
+	if cfg.set == nil {
+		cfg.set = NewMemoryFingerprintSet()
 	}
+	return &Dedupe{cfg: cfg}
 }
 
 func (d *Dedupe) HandleRequest(ctx context.Context, req *downloader.Request, meta downloader.RequestMetadata) (*downloader.Response, error) {
-	if req.Method != http.MethodGet {
+	if req.Method != http.MethodGet && !d.cfg.allMethods {
+		return nil, nil
+	}
+	_, dontFilter := downloader.GetRequestMeta[downloader.DontFilter](req)
+	if dontFilter {
 		return nil, nil
 	}
 	// only deduplicate requests on their first try
 	if meta.AttemptNo > 0 {
 		return nil, nil
 	}
-	normalized := purell.NormalizeURL(req.Url, purell.FlagsSafe)
-	_, loaded := d.reqs.LoadOrStore(normalized, struct{}{})
-	if loaded {
-		return nil, downloader.DroppedRequest(fmt.Errorf("duplicate request: GET %s", normalized))
+	key := d.cfg.key(req)
+	added, err := d.cfg.set.Add(key)
+	if err != nil {
+		// a request should not be lost because the set failed
+		scavenge.LoggerFromContext(ctx).Error("dedupe", "add to set", "key", key, "err", err)
+		return nil, nil
+	}
+	if !added {
+		return nil, downloader.DroppedRequest(fmt.Errorf("duplicate request: %s %s", req.Method, req.Url))
 	}
 	return nil, nil
 }
 
-func (d *Dedupe) HandleResponse(ctx context.Context, res *downloader.Response, meta downloader.ResponseMetadata) error {
-	return nil
+func (d *Dedupe) HandleResponse(ctx context.Context, res *downloader.Response, meta downloader.ResponseMetadata) (*downloader.Response, error) {
+	return nil, nil
 }
@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/LQR471814/scavenge/downloader"
+)
+
+func TestDedupe(t *testing.T) {
+	ctx, _ := testContext()
+	dedupe := NewDedupe(WithDedupeCanonicalizer(DefaultCanonicalizer))
+	handle := func(req *downloader.Request, meta downloader.RequestMetadata) bool {
+		t.Helper()
+		_, err := dedupe.HandleRequest(ctx, req, meta)
+		return err == nil
+	}
+
+	if !handle(testGET("https://example.com/page?a=1&b=2"), downloader.RequestMetadata{}) {
+		t.Fatal("expected the first request to go through")
+	}
+	if handle(testGET("https://EXAMPLE.com/page?b=2&a=1&utm_source=x#top"), downloader.RequestMetadata{}) {
+		t.Fatal("expected a request to the same canonical url to be dropped")
+	}
+	if !handle(testGET("https://example.com/page?a=1&b=2"), downloader.RequestMetadata{AttemptNo: 1}) {
+		t.Fatal("expected retries to not be dropped")
+	}
+
+	dontFilter := testGET("https://example.com/page?a=1&b=2")
+	dontFilter.AddMeta(downloader.DontFilter{})
+	if !handle(dontFilter, downloader.RequestMetadata{}) {
+		t.Fatal("expected a request with DontFilter to not be dropped")
+	}
+
+	post := downloader.POSTRequest(downloader.MustParseUrl("https://example.com/submit"))
+	post.Body = []byte("a")
+	for range 2 {
+		if !handle(post, downloader.RequestMetadata{}) {
+			t.Fatal("expected POST requests to not be deduplicated by default")
+		}
+	}
+}
+
+func TestDedupeAllMethods(t *testing.T) {
+	ctx, _ := testContext()
+	dedupe := NewDedupe(WithDedupeAllMethods(), WithDedupeSet(NewBloomFingerprintSet(0.001, 100)))
+	post := func(body string) *downloader.Request {
+		req := downloader.POSTRequest(downloader.MustParseUrl("https://example.com/submit"))
+		req.Body = []byte(body)
+		return req
+	}
+
+	_, err := dedupe.HandleRequest(ctx, post("a"), downloader.RequestMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dedupe.HandleRequest(ctx, post("a"), downloader.RequestMetadata{})
+	if err == nil {
+		t.Fatal("expected a duplicate POST request to be dropped")
+	}
+	_, err = dedupe.HandleRequest(ctx, post("b"), downloader.RequestMetadata{})
+	if err != nil {
+		t.Fatal("expected a POST request with a different body to go through")
+	}
+
+	put := post("a")
+	put.Method = http.MethodPut
+	_, err = dedupe.HandleRequest(ctx, put, downloader.RequestMetadata{})
+	if err != nil {
+		t.Fatal("expected a request with a different method to go through")
+	}
+}
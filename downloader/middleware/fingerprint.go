@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/LQR471814/scavenge/downloader"
+
+	"github.com/PuerkitoBio/purell"
+	"github.com/zeebo/xxh3"
+)
+
+// Fingerprinter creates keys that identify requests by their method, normalized url, body
+// and (optionally) some of their headers.
+type Fingerprinter struct {
+	// Headers are the headers whose values differentiate requests (ex. Accept-Language).
+	Headers []string
+	// IgnoreQuery are the query parameters that do not differentiate requests (ex. a cache buster).
+	IgnoreQuery []string
+	// Canonicalizer is applied to the url before it is normalized.
+	Canonicalizer Canonicalizer
+}
+
+func (f Fingerprinter) normalizeUrl(u *url.URL) string {
+	u = f.Canonicalizer.Canonicalize(u)
+	if len(f.IgnoreQuery) > 0 && u.RawQuery != "" {
+		query := u.Query()
+		for _, param := range f.IgnoreQuery {
+			query.Del(param)
+		}
+		stripped := *u
+		stripped.RawQuery = query.Encode()
+		u = &stripped
+	}
+	return purell.NormalizeURL(u, purell.FlagsSafe)
+}
+
+// Fingerprint returns the key of the given request, it has the form:
+//
+//	<method> <normalized url>[ body:<xxh3 hash of body>][ <header>:<value>...]
+//
+// The DirectBody of a request is not considered.
+func (f Fingerprinter) Fingerprint(req *downloader.Request) string {
+	var sb strings.Builder
+	sb.WriteString(strings.ToUpper(req.Method))
+	sb.WriteString(" ")
+	sb.WriteString(f.normalizeUrl(req.Url))
+
+	if len(req.Body) > 0 {
+		hash := xxh3.Hash128(req.Body).Bytes()
+		sb.WriteString(" body:")
+		sb.WriteString(hex.EncodeToString(hash[:]))
+	}
+
+	for _, key := range f.Headers {
+		key = http.CanonicalHeaderKey(key)
+		values := req.Headers.Values(key)
+		if len(values) == 0 {
+			continue
+		}
+		sb.WriteString(" ")
+		sb.WriteString(key)
+		sb.WriteString(":")
+		sb.WriteString(strings.Join(values, ","))
+	}
+
+	return sb.String()
+}
+
+// Fingerprint returns the key of the given request using a Fingerprinter with no options.
+func Fingerprint(req *downloader.Request) string {
+	return Fingerprinter{}.Fingerprint(req)
+}
+
+// NewReplayHandler creates a ReplayHandler that replays all requests (except those with a
+// DirectBody) using the fingerprint of the request as its key.
+func NewReplayHandler(f Fingerprinter) ReplayHandler {
+	return func(ctx context.Context, req *downloader.Request, meta downloader.RequestMetadata) (string, bool) {
+		if req.DirectBody != nil {
+			return "", false
+		}
+		return f.Fingerprint(req), true
+	}
+}
+
+// ReplayAllRequests is a ReplayHandler that replays all requests (except those with a
+// DirectBody) and uses their Fingerprint as the request key.
+var ReplayAllRequests = NewReplayHandler(Fingerprinter{})
@@ -0,0 +1,463 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/zeebo/xxh3"
+)
+
+// FingerprintSet is a set of request fingerprints (or any other keys) used by Dedupe.
+//
+// Note: FingerprintSet should be safe to be called concurrently.
+type FingerprintSet interface {
+	// Add adds the fingerprint to the set, it returns false if it was already in the set.
+	Add(fingerprint string) (added bool, err error)
+}
+
+type fingerprintHash [16]byte
+
+func hashFingerprint(fingerprint string) fingerprintHash {
+	return xxh3.HashString128(fingerprint).Bytes()
+}
+
+// saveFile atomically writes the file at the given path with write.
+func saveFile(path string, write func(w io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	err = write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// MemoryFingerprintSet is an exact FingerprintSet kept in memory, it stores the 128 bit hashes
+// of fingerprints instead of the fingerprints themselves.
+type MemoryFingerprintSet struct {
+	hashes sync.Map
+}
+
+func NewMemoryFingerprintSet() *MemoryFingerprintSet {
+	return &MemoryFingerprintSet{}
+}
+
+func (s *MemoryFingerprintSet) Add(fingerprint string) (bool, error) {
+	_, loaded := s.hashes.LoadOrStore(hashFingerprint(fingerprint), struct{}{})
+	return !loaded, nil
+}
+
+// Save writes the set to the file at the given path.
+func (s *MemoryFingerprintSet) Save(path string) error {
+	err := saveFile(path, func(w io.Writer) error {
+		var hashes []fingerprintHash
+		s.hashes.Range(func(key, value any) bool {
+			hashes = append(hashes, key.(fingerprintHash))
+			return true
+		})
+		return gob.NewEncoder(w).Encode(hashes)
+	})
+	if err != nil {
+		return fmt.Errorf("memory fingerprint set: save: %w", err)
+	}
+	return nil
+}
+
+// LoadMemoryFingerprintSet loads a set written by MemoryFingerprintSet.Save.
+func LoadMemoryFingerprintSet(path string) (*MemoryFingerprintSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("memory fingerprint set: load: %w", err)
+	}
+	defer f.Close()
+	var hashes []fingerprintHash
+	err = gob.NewDecoder(f).Decode(&hashes)
+	if err != nil {
+		return nil, fmt.Errorf("memory fingerprint set: load: %w", err)
+	}
+	s := NewMemoryFingerprintSet()
+	for _, h := range hashes {
+		s.hashes.Store(h, struct{}{})
+	}
+	return s, nil
+}
+
+// The DiskFingerprintSet file format is:
+//
+//	magic "SCVFPS01" | capacity (uint64, little endian) | capacity slots of 16 bytes
+//
+// A slot holds the 128 bit hash of a fingerprint or zeros if it is empty.
+var diskFingerprintMagic = []byte("SCVFPS01")
+
+const (
+	diskFingerprintHeaderSize = 16
+	diskFingerprintSlotSize   = 16
+)
+
+// DiskFingerprintSet is an exact FingerprintSet stored in an open addressing hash table on
+// disk, so its memory usage does not grow with the amount of fingerprints.
+//
+// Every Add is written to the file directly, so the set is persisted without being saved,
+// Close must still be called to sync the file.
+type DiskFingerprintSet struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	capacity uint64
+	count    uint64
+}
+
+// OpenDiskFingerprintSet opens the set stored in the file at the given path, creating it if it
+// does not exist.
+func OpenDiskFingerprintSet(path string) (*DiskFingerprintSet, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("disk fingerprint set: %w", err)
+	}
+	s := &DiskFingerprintSet{path: path, file: f}
+	err = s.load()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("disk fingerprint set: %w", err)
+	}
+	return s, nil
+}
+
+func (s *DiskFingerprintSet) load() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		s.capacity = 1024
+		return initFingerprintTable(s.file, s.capacity)
+	}
+
+	header := make([]byte, diskFingerprintHeaderSize)
+	_, err = s.file.ReadAt(header, 0)
+	if err != nil {
+		return fmt.Errorf("read header: %w", err)
+	}
+	if !bytes.Equal(header[:len(diskFingerprintMagic)], diskFingerprintMagic) {
+		return errors.New("not a fingerprint set file")
+	}
+	s.capacity = binary.LittleEndian.Uint64(header[len(diskFingerprintMagic):])
+	if info.Size() != diskFingerprintHeaderSize+int64(s.capacity)*diskFingerprintSlotSize {
+		return errors.New("file is truncated")
+	}
+
+	// the count is not stored so that it is never out of date after a crash
+	return s.scan(func(h fingerprintHash) error {
+		s.count++
+		return nil
+	})
+}
+
+// initFingerprintTable writes an empty table with the given capacity to the file.
+func initFingerprintTable(f *os.File, capacity uint64) error {
+	header := make([]byte, diskFingerprintHeaderSize)
+	copy(header, diskFingerprintMagic)
+	binary.LittleEndian.PutUint64(header[len(diskFingerprintMagic):], capacity)
+	_, err := f.WriteAt(header, 0)
+	if err != nil {
+		return err
+	}
+	return f.Truncate(diskFingerprintHeaderSize + int64(capacity)*diskFingerprintSlotSize)
+}
+
+// scan calls fn with every hash in the table.
+func (s *DiskFingerprintSet) scan(fn func(h fingerprintHash) error) error {
+	r := io.NewSectionReader(s.file, diskFingerprintHeaderSize, int64(s.capacity)*diskFingerprintSlotSize)
+	buff := make([]byte, 4096*diskFingerprintSlotSize)
+	for {
+		n, err := io.ReadFull(r, buff)
+		for i := 0; i+diskFingerprintSlotSize <= n; i += diskFingerprintSlotSize {
+			var h fingerprintHash
+			copy(h[:], buff[i:])
+			if h == (fingerprintHash{}) {
+				continue
+			}
+			ferr := fn(h)
+			if ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// insertFingerprint adds the hash to the table in the given file, it returns false if it is
+// already in the table.
+func insertFingerprint(f *os.File, capacity uint64, h fingerprintHash) (bool, error) {
+	slot := binary.LittleEndian.Uint64(h[:]) % capacity
+	existing := make([]byte, diskFingerprintSlotSize)
+	for {
+		offset := diskFingerprintHeaderSize + int64(slot)*diskFingerprintSlotSize
+		_, err := f.ReadAt(existing, offset)
+		if err != nil {
+			return false, err
+		}
+		if bytes.Equal(existing, h[:]) {
+			return false, nil
+		}
+		if bytes.Equal(existing, make([]byte, diskFingerprintSlotSize)) {
+			_, err = f.WriteAt(h[:], offset)
+			return err == nil, err
+		}
+		slot = (slot + 1) % capacity
+	}
+}
+
+// grow rehashes the table into a new file with double the capacity.
+func (s *DiskFingerprintSet) grow() error {
+	f, err := os.CreateTemp(filepath.Dir(s.path), "."+filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	capacity := s.capacity * 2
+	err = initFingerprintTable(f, capacity)
+	if err == nil {
+		err = s.scan(func(h fingerprintHash) error {
+			_, err := insertFingerprint(f, capacity, h)
+			return err
+		})
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("grow: %w", err)
+	}
+	s.file.Close()
+	s.file = f
+	s.capacity = capacity
+	return nil
+}
+
+func (s *DiskFingerprintSet) Add(fingerprint string) (bool, error) {
+	h := hashFingerprint(fingerprint)
+	// the zero hash marks empty slots
+	if h == (fingerprintHash{}) {
+		h[15] = 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// keep the load factor under 1/2 so probing stays short
+	if (s.count+1)*2 > s.capacity {
+		err := s.grow()
+		if err != nil {
+			return false, fmt.Errorf("disk fingerprint set: %w", err)
+		}
+	}
+	added, err := insertFingerprint(s.file, s.capacity, h)
+	if err != nil {
+		return false, fmt.Errorf("disk fingerprint set: %w", err)
+	}
+	if added {
+		s.count++
+	}
+	return added, nil
+}
+
+// Len returns the amount of fingerprints in the set.
+func (s *DiskFingerprintSet) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int(s.count)
+}
+
+// Close syncs and closes the file.
+func (s *DiskFingerprintSet) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.file.Sync()
+	if err != nil {
+		s.file.Close()
+		return fmt.Errorf("disk fingerprint set: %w", err)
+	}
+	err = s.file.Close()
+	if err != nil {
+		return fmt.Errorf("disk fingerprint set: %w", err)
+	}
+	return nil
+}
+
+// bloomFilter is a single bloom filter in a BloomFingerprintSet, fields are exported for gob.
+type bloomFilter struct {
+	Bits     []uint64
+	K        uint64
+	Capacity uint64
+	Count    uint64
+}
+
+func newBloomFilter(capacity uint64, falsePositiveRate float64) *bloomFilter {
+	// https://en.wikipedia.org/wiki/Bloom_filter#Optimal_number_of_hash_functions
+	m := math.Ceil(-float64(capacity) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	k := math.Ceil(-math.Log2(falsePositiveRate))
+	return &bloomFilter{
+		Bits:     make([]uint64, (uint64(m)+63)/64),
+		K:        uint64(k),
+		Capacity: capacity,
+	}
+}
+
+// locations calls fn with the bits of the hash using double hashing.
+func (f *bloomFilter) locations(h xxh3.Uint128, fn func(word uint64, mask uint64) bool) bool {
+	m := uint64(len(f.Bits)) * 64
+	for i := range f.K {
+		bit := (h.Lo + i*h.Hi) % m
+		if !fn(bit/64, 1<<(bit%64)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *bloomFilter) has(h xxh3.Uint128) bool {
+	return f.locations(h, func(word, mask uint64) bool {
+		return f.Bits[word]&mask != 0
+	})
+}
+
+func (f *bloomFilter) add(h xxh3.Uint128) {
+	f.locations(h, func(word, mask uint64) bool {
+		f.Bits[word] |= mask
+		return true
+	})
+	f.Count++
+}
+
+// bloomState is the persisted state of a BloomFingerprintSet.
+type bloomState struct {
+	FalsePositiveRate float64
+	InitialCapacity   uint64
+	Filters           []*bloomFilter
+}
+
+const (
+	// bloomGrowth is how much larger each new filter is than the last.
+	bloomGrowth = 2
+	// bloomTightening is how much lower the false positive rate of each new filter is than
+	// the last.
+	bloomTightening = 0.5
+)
+
+// BloomFingerprintSet is a scalable bloom filter, it uses a fixed amount of memory for the
+// amount of fingerprints it has seen at the cost of falsely reporting that some fingerprints
+// are in the set (so some requests are wrongly dropped as duplicates).
+//
+// When a filter is full, a larger filter with a lower false positive rate is added so that the
+// overall false positive rate stays under the configured rate however many fingerprints are
+// added.
+//
+// https://gsd.di.uminho.pt/members/cbm/ps/dbloom.pdf
+type BloomFingerprintSet struct {
+	mu    sync.Mutex
+	state bloomState
+}
+
+// NewBloomFingerprintSet creates a BloomFingerprintSet with the given overall false positive
+// rate (ex. 0.001) whose first filter holds initialCapacity fingerprints.
+func NewBloomFingerprintSet(falsePositiveRate float64, initialCapacity int) *BloomFingerprintSet {
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		panic("bloom fingerprint set: false positive rate must be between 0 and 1")
+	}
+	if initialCapacity <= 0 {
+		panic("bloom fingerprint set: initial capacity must be positive")
+	}
+	return &BloomFingerprintSet{state: bloomState{
+		FalsePositiveRate: falsePositiveRate,
+		InitialCapacity:   uint64(initialCapacity),
+	}}
+}
+
+func (s *BloomFingerprintSet) addFilter() *bloomFilter {
+	i := len(s.state.Filters)
+	capacity := s.state.InitialCapacity * uint64(math.Pow(bloomGrowth, float64(i)))
+	// the sum of the rates of all filters converges to the configured rate
+	rate := s.state.FalsePositiveRate * (1 - bloomTightening) * math.Pow(bloomTightening, float64(i))
+	f := newBloomFilter(capacity, rate)
+	s.state.Filters = append(s.state.Filters, f)
+	return f
+}
+
+func (s *BloomFingerprintSet) Add(fingerprint string) (bool, error) {
+	h := xxh3.HashString128(fingerprint)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, f := range s.state.Filters {
+		if f.has(h) {
+			return false, nil
+		}
+	}
+	var last *bloomFilter
+	if len(s.state.Filters) > 0 {
+		last = s.state.Filters[len(s.state.Filters)-1]
+	}
+	if last == nil || last.Count >= last.Capacity {
+		last = s.addFilter()
+	}
+	last.add(h)
+	return true, nil
+}
+
+// Save writes the set to the file at the given path.
+func (s *BloomFingerprintSet) Save(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := saveFile(path, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(s.state)
+	})
+	if err != nil {
+		return fmt.Errorf("bloom fingerprint set: save: %w", err)
+	}
+	return nil
+}
+
+// LoadBloomFingerprintSet loads a set written by BloomFingerprintSet.Save.
+func LoadBloomFingerprintSet(path string) (*BloomFingerprintSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("bloom fingerprint set: load: %w", err)
+	}
+	defer f.Close()
+	s := &BloomFingerprintSet{}
+	err = gob.NewDecoder(f).Decode(&s.state)
+	if err != nil {
+		return nil, fmt.Errorf("bloom fingerprint set: load: %w", err)
+	}
+	return s, nil
+}
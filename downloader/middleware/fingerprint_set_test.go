@@ -0,0 +1,126 @@
+package middleware
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// checkFingerprintSet adds n fingerprints twice, the second time they must all be reported as
+// already in the set.
+func checkFingerprintSet(t *testing.T, set FingerprintSet, n int) {
+	t.Helper()
+	for i := range n {
+		added, err := set.Add(fmt.Sprintf("fingerprint-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !added {
+			t.Fatalf("expected fingerprint %d to be added", i)
+		}
+	}
+	checkFingerprintsPresent(t, set, n)
+}
+
+func checkFingerprintsPresent(t *testing.T, set FingerprintSet, n int) {
+	t.Helper()
+	for i := range n {
+		added, err := set.Add(fmt.Sprintf("fingerprint-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if added {
+			t.Fatalf("expected fingerprint %d to already be in the set", i)
+		}
+	}
+}
+
+func TestMemoryFingerprintSet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fingerprints")
+	set := NewMemoryFingerprintSet()
+	checkFingerprintSet(t, set, 100)
+
+	err := set.Save(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadMemoryFingerprintSet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFingerprintsPresent(t, loaded, 100)
+}
+
+func TestDiskFingerprintSet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fingerprints")
+	set, err := OpenDiskFingerprintSet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// enough fingerprints for the table to grow several times
+	checkFingerprintSet(t, set, 5000)
+	if set.Len() != 5000 {
+		t.Fatalf("expected 5000 fingerprints, got %d", set.Len())
+	}
+	err = set.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set, err = OpenDiskFingerprintSet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer set.Close()
+	if set.Len() != 5000 {
+		t.Fatalf("expected the fingerprints to be persisted, got %d", set.Len())
+	}
+	checkFingerprintsPresent(t, set, 5000)
+	matches, err := filepath.Glob(filepath.Join(filepath.Dir(path), ".*"))
+	if err != nil || len(matches) != 0 {
+		t.Fatalf("expected no temporary files to be left behind, got %v", matches)
+	}
+}
+
+func TestBloomFingerprintSet(t *testing.T) {
+	const n = 10000
+	const rate = 0.01
+	set := NewBloomFingerprintSet(rate, 100)
+	for i := range n {
+		_, err := set.Add(fmt.Sprintf("fingerprint-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// bloom filters have false positives but no false negatives
+	checkFingerprintsPresent(t, set, n)
+	if len(set.state.Filters) < 2 {
+		t.Fatalf("expected the set to grow past its initial capacity, got %d filters", len(set.state.Filters))
+	}
+
+	falsePositives := 0
+	for i := range n {
+		added, err := set.Add(fmt.Sprintf("other-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !added {
+			falsePositives++
+		}
+	}
+	// the fingerprints added above also fill the set, so allow some slack over the rate
+	if float64(falsePositives)/n > 2*rate {
+		t.Fatalf("expected a false positive rate around %v, got %v", rate, float64(falsePositives)/n)
+	}
+
+	path := filepath.Join(t.TempDir(), "bloom")
+	err := set.Save(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadBloomFingerprintSet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFingerprintsPresent(t, loaded, n)
+}
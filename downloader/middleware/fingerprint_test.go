@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/LQR471814/scavenge/downloader"
+)
+
+func TestFingerprint(t *testing.T) {
+	post := func(rawUrl, body string) *downloader.Request {
+		req := downloader.POSTRequest(downloader.MustParseUrl(rawUrl))
+		req.SetBody("text/plain", []byte(body))
+		return req
+	}
+
+	if Fingerprint(testGET("HTTP://Example.com:80/a")) != Fingerprint(testGET("http://example.com/a")) {
+		t.Fatal("expected equivalent urls to have the same fingerprint")
+	}
+	if !strings.HasPrefix(Fingerprint(post("http://example.com/a", "x")), "POST http://example.com/a body:") {
+		t.Fatalf("unexpected fingerprint '%s'", Fingerprint(post("http://example.com/a", "x")))
+	}
+	if Fingerprint(post("http://example.com/a", "x")) == Fingerprint(post("http://example.com/a", "y")) {
+		t.Fatal("expected different bodies to have different fingerprints")
+	}
+	if Fingerprint(post("http://example.com/a", "x")) == Fingerprint(testGET("http://example.com/a")) {
+		t.Fatal("expected different methods to have different fingerprints")
+	}
+
+	f := Fingerprinter{Headers: []string{"accept-language"}, IgnoreQuery: []string{"cb"}}
+	en := testGET("http://example.com/a?cb=1&q=x")
+	en.SetHeader("Accept-Language", "en")
+	fr := testGET("http://example.com/a?cb=1&q=x")
+	fr.SetHeader("Accept-Language", "fr")
+	if f.Fingerprint(en) != "GET http://example.com/a?q=x Accept-Language:en" {
+		t.Fatalf("unexpected fingerprint '%s'", f.Fingerprint(en))
+	}
+	if f.Fingerprint(en) == f.Fingerprint(fr) {
+		t.Fatal("expected requests with different headers to have different fingerprints")
+	}
+	if Fingerprint(en) != Fingerprint(fr) {
+		t.Fatal("expected headers to be ignored by default")
+	}
+
+	canonical := Fingerprinter{Canonicalizer: DefaultCanonicalizer}
+	if canonical.Fingerprint(testGET("http://example.com/a?utm_source=x&b=1&a=2")) != "GET http://example.com/a?a=2&b=1" {
+		t.Fatalf("unexpected fingerprint '%s'", canonical.Fingerprint(testGET("http://example.com/a?utm_source=x&b=1&a=2")))
+	}
+}
+
+func TestReplayAllRequests(t *testing.T) {
+	ctx := context.Background()
+	req := downloader.POSTRequest(downloader.MustParseUrl("http://example.com/a"))
+	key, replay := ReplayAllRequests(ctx, req, downloader.RequestMetadata{})
+	if !replay || key != Fingerprint(req) {
+		t.Fatalf("expected a POST request to be replayed by its fingerprint, got '%s' %v", key, replay)
+	}
+
+	req.DirectBody = strings.NewReader("body")
+	_, replay = ReplayAllRequests(ctx, req, downloader.RequestMetadata{})
+	if replay {
+		t.Fatal("expected a request with a DirectBody to not be replayed")
+	}
+}
+
+func TestDedupeFingerprinter(t *testing.T) {
+	ctx, _ := testContext()
+	dedupe := NewDedupe(WithDedupeFingerprinter(Fingerprinter{Headers: []string{"Accept-Language"}}))
+	download := func(lang string) error {
+		req := testGET("http://example.com/a")
+		req.SetHeader("Accept-Language", lang)
+		_, err := dedupe.HandleRequest(ctx, req, downloader.RequestMetadata{})
+		return err
+	}
+
+	if download("en") != nil || download("fr") != nil {
+		t.Fatal("expected requests with different fingerprints to be kept")
+	}
+	if err := download("en"); err == nil || !strings.Contains(err.Error(), "dropped request") {
+		t.Fatalf("expected a request with the same fingerprint to be dropped, got %v", err)
+	}
+}
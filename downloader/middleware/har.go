@@ -0,0 +1,468 @@
+package middleware
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/LQR471814/scavenge"
+	"github.com/LQR471814/scavenge/downloader"
+
+	"github.com/gobwas/glob"
+)
+
+// The HAR 1.2 format, fields that scavenge does not know about are left out.
+//
+// http://www.softwareishard.com/blog/har-12-spec/
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	HttpOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	Url         string         `json:"url"`
+	HttpVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HttpVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+// harTimings are in milliseconds, -1 means the phase does not apply to the request.
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+func harMillis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func harOptionalMillis(d time.Duration) float64 {
+	if d == 0 {
+		return -1
+	}
+	return harMillis(d)
+}
+
+// harHeaders returns the headers sorted by name, since http.Header does not keep the order they
+// were sent in.
+func harHeaders(headers http.Header) []harNameValue {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	out := []harNameValue{}
+	for _, name := range names {
+		for _, v := range headers[name] {
+			out = append(out, harNameValue{Name: name, Value: v})
+		}
+	}
+	return out
+}
+
+// harQuery returns the query parameters in the order they appear in the url.
+func harQuery(u *url.URL) []harNameValue {
+	out := []harNameValue{}
+	for _, pair := range strings.Split(u.RawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(pair, "=")
+		unescapedName, err := url.QueryUnescape(name)
+		if err == nil {
+			name = unescapedName
+		}
+		unescapedValue, err := url.QueryUnescape(value)
+		if err == nil {
+			value = unescapedValue
+		}
+		out = append(out, harNameValue{Name: name, Value: value})
+	}
+	return out
+}
+
+func harCookies(cookies []*http.Cookie) []harCookie {
+	out := make([]harCookie, len(cookies))
+	for i, c := range cookies {
+		out[i] = harCookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			HttpOnly: c.HttpOnly,
+			Secure:   c.Secure,
+		}
+		if !c.Expires.IsZero() {
+			out[i].Expires = c.Expires.UTC().Format(time.RFC3339)
+		}
+	}
+	return out
+}
+
+type harCfg struct {
+	hosts        []glob.Glob
+	contentTypes []string
+	maxBodySize  int
+	replayed     bool
+}
+
+type harOption = func(cfg *harCfg)
+
+// WithHARHosts only records requests to hosts matching one of the given globs.
+func WithHARHosts(hosts ...string) harOption {
+	return func(cfg *harCfg) {
+		for _, h := range hosts {
+			cfg.hosts = append(cfg.hosts, glob.MustCompile(h, '.'))
+		}
+	}
+}
+
+// WithHARContentTypes only records responses whose mimetype starts with one of the given
+// prefixes (ex. "text/html", "application/").
+func WithHARContentTypes(prefixes ...string) harOption {
+	return func(cfg *harCfg) {
+		cfg.contentTypes = append(cfg.contentTypes, prefixes...)
+	}
+}
+
+// WithHARMaxBodySize sets the maximum amount of bytes of a request or response body that are
+// recorded, larger bodies are truncated, by default it is 1 MiB, 0 does not record bodies and -1
+// records bodies of any size.
+func WithHARMaxBodySize(size int) harOption {
+	return func(cfg *harCfg) {
+		cfg.maxBodySize = size
+	}
+}
+
+// WithHARReplayed also records the responses returned by request middleware (ex. replayed
+// responses), their entries have no timings.
+func WithHARReplayed() harOption {
+	return func(cfg *harCfg) {
+		cfg.replayed = true
+	}
+}
+
+// HAR is a middleware that records requests and responses in an HTTP Archive (HAR 1.2) that can
+// be opened in a browser's network panel.
+//
+//   - Redirects followed by the client are recorded as their own entries before the entry of
+//     the final response.
+//   - Timings come from Response.Timings when the response has them, otherwise the whole
+//     ResponseMetadata.Elapsed is counted as waiting. The time of an entry is always
+//     ResponseMetadata.Elapsed.
+//   - Responses returned by request middleware (ex. replayed responses) are not recorded unless
+//     WithHARReplayed is given, they were not sent over the network.
+//
+// The archive is kept in memory and written to the file by Close (or Write).
+type HAR struct {
+	path string
+	cfg  harCfg
+
+	mu      sync.Mutex
+	entries []harEntry
+}
+
+func NewHAR(path string, options ...harOption) *HAR {
+	cfg := harCfg{maxBodySize: 1 << 20}
+	for _, o := range options {
+		o(&cfg)
+	}
+	return &HAR{path: path, cfg: cfg}
+}
+
+func (h *HAR) matchesHost(u *url.URL) bool {
+	if len(h.cfg.hosts) == 0 {
+		return true
+	}
+	for _, g := range h.cfg.hosts {
+		if g.Match(u.Hostname()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *HAR) matchesContentType(mimeType string) bool {
+	if len(h.cfg.contentTypes) == 0 {
+		return true
+	}
+	for _, prefix := range h.cfg.contentTypes {
+		if strings.HasPrefix(mimeType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// body returns the recorded body text, its encoding and a comment if it was truncated.
+func (h *HAR) body(body []byte) (text, encoding, comment string) {
+	if h.cfg.maxBodySize >= 0 && len(body) > h.cfg.maxBodySize {
+		comment = fmt.Sprintf("body truncated from %d bytes", len(body))
+		body = body[:h.cfg.maxBodySize]
+	}
+	if utf8.Valid(body) {
+		return string(body), "", comment
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64", comment
+}
+
+func (h *HAR) request(method string, u *url.URL, headers http.Header, body []byte) harRequest {
+	req := harRequest{
+		Method:      method,
+		Url:         u.String(),
+		HttpVersion: "HTTP/1.1",
+		Cookies:     harCookies((&http.Request{Header: headers}).Cookies()),
+		Headers:     harHeaders(headers),
+		QueryString: harQuery(u),
+		HeadersSize: -1,
+		BodySize:    len(body),
+	}
+	if len(body) > 0 {
+		text, encoding, comment := h.body(body)
+		if encoding != "" {
+			comment = strings.TrimPrefix(comment+", body is base64 encoded", ", ")
+		}
+		req.PostData = &harPostData{
+			MimeType: headers.Get("Content-Type"),
+			Text:     text,
+			Comment:  comment,
+		}
+	}
+	return req
+}
+
+func (h *HAR) response(status int, headers http.Header, body []byte) harResponse {
+	res := harResponse{
+		Status:      status,
+		StatusText:  http.StatusText(status),
+		HttpVersion: "HTTP/1.1",
+		Cookies:     harCookies((&http.Response{Header: headers}).Cookies()),
+		Headers:     harHeaders(headers),
+		Content: harContent{
+			Size:     len(body),
+			MimeType: headers.Get("Content-Type"),
+		},
+		RedirectURL: headers.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    len(body),
+	}
+	if len(body) > 0 {
+		res.Content.Text, res.Content.Encoding, res.Content.Comment = h.body(body)
+	}
+	return res
+}
+
+// followRedirect returns the method, headers and body of the request made after a redirect with
+// the given status like http.Client does.
+func followRedirect(status int, method string, headers http.Header, body []byte) (string, http.Header, []byte) {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther:
+		if method != http.MethodGet && method != http.MethodHead {
+			headers = headers.Clone()
+			headers.Del("Content-Type")
+			headers.Del("Content-Length")
+			return http.MethodGet, headers, nil
+		}
+	}
+	return method, headers, body
+}
+
+func (h *HAR) record(res *downloader.Response, meta downloader.ResponseMetadata) []harEntry {
+	req := res.Request()
+	redirects := res.Redirects()
+	timings := res.Timings()
+
+	start := time.Now().Add(-meta.Elapsed)
+	if timings != nil && len(redirects) == 0 {
+		start = timings.Start
+	}
+	startedDateTime := start.UTC().Format(time.RFC3339Nano)
+
+	method, headers, body := req.Method, req.Headers, req.Body
+	var entries []harEntry
+	for _, r := range redirects {
+		entries = append(entries, harEntry{
+			StartedDateTime: startedDateTime,
+			Request:         h.request(r.Method, r.Url, headers, body),
+			Response:        h.response(r.Status, r.Headers, nil),
+			Timings:         harTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1},
+			Comment:         "redirect followed by the client",
+		})
+		method, headers, body = followRedirect(r.Status, method, headers, body)
+	}
+
+	entry := harEntry{
+		StartedDateTime: startedDateTime,
+		Time:            harMillis(meta.Elapsed),
+		Request:         h.request(method, res.Url(), headers, body),
+		Response:        h.response(res.Status(), res.Headers(), res.RawBody()),
+		Timings:         harTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1, Wait: harMillis(meta.Elapsed)},
+	}
+	if timings != nil {
+		entry.Timings = harTimings{
+			Blocked: harOptionalMillis(timings.Blocked),
+			DNS:     harOptionalMillis(timings.DNS),
+			// in HAR, connect includes ssl
+			Connect: harOptionalMillis(timings.Connect + timings.TLS),
+			SSL:     harOptionalMillis(timings.TLS),
+			Send:    harMillis(timings.Send),
+			Wait:    harMillis(timings.Wait),
+			Receive: harMillis(timings.Receive),
+		}
+		if len(redirects) > 0 {
+			// the timings are of the last round trip, everything before it is counted as blocked
+			blocked := meta.Elapsed - (timings.DNS + timings.Connect + timings.TLS +
+				timings.Send + timings.Wait + timings.Receive)
+			entry.Timings.Blocked = harMillis(max(blocked, 0))
+		}
+	}
+	return append(entries, entry)
+}
+
+func (h *HAR) HandleRequest(ctx context.Context, req *downloader.Request, meta downloader.RequestMetadata) (*downloader.Response, error) {
+	return nil, nil
+}
+
+func (h *HAR) HandleResponse(ctx context.Context, res *downloader.Response, meta downloader.ResponseMetadata) (*downloader.Response, error) {
+	if meta.Replayed && !h.cfg.replayed || !h.matchesHost(res.Request().Url) {
+		return nil, nil
+	}
+	mimeType, _, _ := mime.ParseMediaType(res.ContentType())
+	if !h.matchesContentType(mimeType) {
+		return nil, nil
+	}
+	entries := h.record(res, meta)
+
+	h.mu.Lock()
+	h.entries = append(h.entries, entries...)
+	h.mu.Unlock()
+
+	scavenge.StatsFromContext(ctx).Inc("har", "entries", int64(len(entries)))
+	return nil, nil
+}
+
+// Write writes the archive recorded so far to the given writer.
+func (h *HAR) Write(w io.Writer) error {
+	h.mu.Lock()
+	entries := append([]harEntry{}, h.entries...)
+	h.mu.Unlock()
+
+	file := harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "scavenge", Version: "1"},
+		Entries: entries,
+	}}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(file)
+	if err != nil {
+		return fmt.Errorf("har: %w", err)
+	}
+	return nil
+}
+
+// Close writes the archive to the file.
+func (h *HAR) Close() error {
+	f, err := os.CreateTemp(filepath.Dir(h.path), "."+filepath.Base(h.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("har: %w", err)
+	}
+	defer os.Remove(f.Name())
+	err = h.Write(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("har: %w", err)
+	}
+	err = os.Rename(f.Name(), h.path)
+	if err != nil {
+		return fmt.Errorf("har: %w", err)
+	}
+	return nil
+}
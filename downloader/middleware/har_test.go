@@ -0,0 +1,154 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/LQR471814/scavenge/downloader"
+)
+
+func readHAR(t *testing.T, h *HAR) harFile {
+	t.Helper()
+	var buff bytes.Buffer
+	err := h.Write(&buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file harFile
+	err = json.Unmarshal(buff.Bytes(), &file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestHARRedirects(t *testing.T) {
+	ctx, stats := testContext()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.Redirect(w, r, "/home", http.StatusFound)
+		case "/home":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("home"))
+		}
+	}))
+	defer srv.Close()
+
+	har := NewHAR(filepath.Join(t.TempDir(), "out.har"))
+	dl := downloader.NewDownloader(downloader.NewHttpClient(http.DefaultClient), har)
+	req := downloader.POSTRequest(downloader.MustParseUrl(srv.URL + "/login"))
+	req.SetHeader("Content-Type", "application/x-www-form-urlencoded")
+	req.Body = []byte("user=a")
+	_, err := dl.Download(ctx, req, downloader.RequestMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := readHAR(t, har).Log.Entries
+	if len(entries) != 2 || stats.Get("har", "entries") != 2 {
+		t.Fatalf("expected an entry per hop, got %d", len(entries))
+	}
+	login, home := entries[0], entries[1]
+	if login.Request.Method != http.MethodPost || login.Request.Url != srv.URL+"/login" ||
+		login.Request.PostData == nil || login.Request.PostData.Text != "user=a" {
+		t.Fatalf("expected the redirected request to be recorded as sent, got %+v", login.Request)
+	}
+	if login.Response.Status != http.StatusFound || login.Response.RedirectURL != "/home" {
+		t.Fatalf("expected the redirect response, got %+v", login.Response)
+	}
+	if home.Request.Method != http.MethodGet || home.Request.Url != srv.URL+"/home" || home.Request.PostData != nil {
+		t.Fatalf("expected the redirect to be followed with a GET request, got %+v", home.Request)
+	}
+	if home.Response.Status != 200 || home.Response.Content.Text != "home" {
+		t.Fatalf("expected the final response, got %+v", home.Response)
+	}
+}
+
+func TestHARFilters(t *testing.T) {
+	ctx, _ := testContext()
+	har := NewHAR(
+		filepath.Join(t.TempDir(), "out.har"),
+		WithHARHosts("*.example.com"),
+		WithHARContentTypes("text/"),
+		WithHARMaxBodySize(4),
+	)
+	response := func(rawUrl, contentType string, body []byte) *downloader.Response {
+		req := testGET(rawUrl)
+		return downloader.NewResponse(req, 200, req.Url, http.Header{"Content-Type": {contentType}}, body)
+	}
+
+	for _, res := range []*downloader.Response{
+		response("https://www.example.com/page", "text/html; charset=utf-8", []byte("truncated")),
+		response("https://www.example.com/image", "text/plain", []byte{0xff, 0xfe}),
+		response("https://other.com/page", "text/html", []byte("other host")),
+		response("https://www.example.com/data", "application/json", []byte("{}")),
+	} {
+		_, err := har.HandleResponse(ctx, res, downloader.ResponseMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries := readHAR(t, har).Log.Entries
+	if len(entries) != 2 {
+		t.Fatalf("expected only the matching responses to be recorded, got %d", len(entries))
+	}
+	content := entries[0].Response.Content
+	if content.Text != "trun" || content.Size != 9 || !strings.Contains(content.Comment, "truncated") {
+		t.Fatalf("expected the body to be truncated, got %+v", content)
+	}
+	content = entries[1].Response.Content
+	if content.Encoding != "base64" || content.Text != "//4=" {
+		t.Fatalf("expected a binary body to be base64 encoded, got %+v", content)
+	}
+}
+
+func TestHARDeterministicOrder(t *testing.T) {
+	ctx, _ := testContext()
+	har := NewHAR(filepath.Join(t.TempDir(), "out.har"))
+
+	req := testGET("https://example.com/search?z=1&a=2&m=3&a=4")
+	for _, name := range []string{"X-Z", "Accept", "X-M", "User-Agent", "X-B"} {
+		req.SetHeader(name, "1")
+	}
+	headers := http.Header{}
+	for _, name := range []string{"Set-Cookie", "Content-Type", "X-Z", "Etag", "X-A"} {
+		headers.Set(name, "1")
+	}
+	for range 2 {
+		_, err := har.HandleResponse(ctx, downloader.NewResponse(req, 200, req.Url, headers, nil), downloader.ResponseMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names := func(values []harNameValue) []string {
+		var out []string
+		for _, v := range values {
+			out = append(out, v.Name+"="+v.Value)
+		}
+		return out
+	}
+	entries := readHAR(t, har).Log.Entries
+	for _, entry := range entries {
+		expected := []string{"Accept=1", "User-Agent=1", "X-B=1", "X-M=1", "X-Z=1"}
+		if !slices.Equal(names(entry.Request.Headers), expected) {
+			t.Fatalf("expected the request headers sorted by name, got %v", names(entry.Request.Headers))
+		}
+		expected = []string{"Content-Type=1", "Etag=1", "Set-Cookie=1", "X-A=1", "X-Z=1"}
+		if !slices.Equal(names(entry.Response.Headers), expected) {
+			t.Fatalf("expected the response headers sorted by name, got %v", names(entry.Response.Headers))
+		}
+		expected = []string{"z=1", "a=2", "m=3", "a=4"}
+		if !slices.Equal(names(entry.Request.QueryString), expected) {
+			t.Fatalf("expected the query in the order of the url, got %v", names(entry.Request.QueryString))
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/LQR471814/scavenge/downloader"
+)
+
+// HeaderField is a single header in a HeaderProfile.
+type HeaderField struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// HeaderProfile is a coherent set of headers sent by a single browser, the order of the headers
+// is the order the browser sends them in.
+type HeaderProfile struct {
+	Name    string        `json:"name"`
+	Headers []HeaderField `json:"headers"`
+}
+
+// LoadHeaderProfiles reads a json array of HeaderProfile in the following format:
+//
+//	[
+//		{
+//			"name": "chrome-windows",
+//			"headers": [
+//				{ "key": "User-Agent", "value": "Mozilla/5.0 ..." },
+//				{ "key": "Accept", "value": "text/html,..." }
+//			]
+//		}
+//	]
+func LoadHeaderProfiles(r io.Reader) ([]HeaderProfile, error) {
+	var profiles []HeaderProfile
+	err := json.NewDecoder(r).Decode(&profiles)
+	if err != nil {
+		return nil, fmt.Errorf("load header profiles: %w", err)
+	}
+	return profiles, nil
+}
+
+// HeaderProfileSelection determines how often a new profile is picked.
+type HeaderProfileSelection int
+
+const (
+	// HeaderProfilePerRequest picks a random profile for each request.
+	HeaderProfilePerRequest HeaderProfileSelection = iota
+	// HeaderProfileStickyPerHost picks a profile once for each host.
+	HeaderProfileStickyPerHost
+	// HeaderProfileStickyPerSession picks a profile once for each [Session].
+	HeaderProfileStickyPerSession
+)
+
+// headerProfileApplied is the request meta containing the headers set by HeaderProfiles.
+type headerProfileApplied struct {
+	keys []string
+}
+
+// HeaderProfiles fills in the headers of each request with those of a browser profile, so that
+// each request looks like it came from a single browser rather than mixing headers of different
+// browsers.
+//
+// Headers the request already has (ex. an Accept set by the spider) are kept, the headers set
+// from a profile are replaced when the request is retried. The order of the profile's headers is
+// set as the request's [downloader.HeaderOrder].
+type HeaderProfiles struct {
+	profiles  []HeaderProfile
+	selection HeaderProfileSelection
+	sticky    sync.Map
+}
+
+func NewHeaderProfiles(profiles []HeaderProfile, selection HeaderProfileSelection) *HeaderProfiles {
+	if len(profiles) == 0 {
+		panic("header profiles: at least one profile must be given")
+	}
+	return &HeaderProfiles{
+		profiles:  profiles,
+		selection: selection,
+		sticky:    sync.Map{},
+	}
+}
+
+func (h *HeaderProfiles) pick(req *downloader.Request) HeaderProfile {
+	var key string
+	switch h.selection {
+	case HeaderProfileStickyPerHost:
+		key = req.Url.Host
+	case HeaderProfileStickyPerSession:
+		key = requestSession(req)
+	default:
+		return h.profiles[rand.IntN(len(h.profiles))]
+	}
+
+	v, ok := h.sticky.Load(key)
+	if !ok {
+		v, _ = h.sticky.LoadOrStore(key, h.profiles[rand.IntN(len(h.profiles))])
+	}
+	return v.(HeaderProfile)
+}
+
+func (h *HeaderProfiles) HandleRequest(ctx context.Context, req *downloader.Request, meta downloader.RequestMetadata) (*downloader.Response, error) {
+	if req.Headers == nil {
+		req.Headers = http.Header{}
+	}
+	// the headers of a previous attempt are removed, so that headers from different profiles are
+	// never mixed
+	prev, _ := downloader.GetRequestMeta[headerProfileApplied](req)
+	for _, k := range prev.keys {
+		req.Headers.Del(k)
+	}
+
+	profile := h.pick(req)
+	var applied headerProfileApplied
+	var order downloader.HeaderOrder
+	for _, field := range profile.Headers {
+		key := http.CanonicalHeaderKey(field.Key)
+		if !slices.Contains(order.Keys, key) {
+			order.Keys = append(order.Keys, key)
+		}
+		if !slices.Contains(applied.keys, key) {
+			if len(req.Headers.Values(key)) > 0 {
+				continue
+			}
+			applied.keys = append(applied.keys, key)
+		}
+		req.Headers.Add(key, field.Value)
+	}
+	req.SetMeta(applied)
+	req.SetMeta(order)
+
+	return nil, nil
+}
+
+func (h *HeaderProfiles) HandleResponse(ctx context.Context, res *downloader.Response, meta downloader.ResponseMetadata) (*downloader.Response, error) {
+	return nil, nil
+}
@@ -0,0 +1,133 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/LQR471814/scavenge/downloader"
+)
+
+var testProfiles = []HeaderProfile{
+	{
+		Name: "firefox",
+		Headers: []HeaderField{
+			{Key: "user-agent", Value: "firefox"},
+			{Key: "Accept", Value: "text/html"},
+			{Key: "DNT", Value: "1"},
+		},
+	},
+	{
+		Name: "chrome",
+		Headers: []HeaderField{
+			{Key: "User-Agent", Value: "chrome"},
+			{Key: "Accept", Value: "*/*"},
+			{Key: "Sec-Ch-Ua", Value: "chromium"},
+		},
+	},
+}
+
+func TestLoadHeaderProfiles(t *testing.T) {
+	profiles, err := LoadHeaderProfiles(strings.NewReader(`[
+		{"name": "a", "headers": [{"key": "User-Agent", "value": "a"}]}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 1 || profiles[0].Name != "a" || profiles[0].Headers[0].Value != "a" {
+		t.Fatalf("unexpected profiles: %+v", profiles)
+	}
+}
+
+func TestHeaderProfilesKeepExplicitHeaders(t *testing.T) {
+	ctx, _ := testContext()
+	h := NewHeaderProfiles(testProfiles, HeaderProfilePerRequest)
+
+	req := testGET("https://example.com")
+	req.SetHeader("Accept", "application/json")
+	h.HandleRequest(ctx, req, downloader.RequestMetadata{})
+
+	if req.Headers.Get("Accept") != "application/json" {
+		t.Fatalf("expected the explicit Accept header to be kept, got '%s'", req.Headers.Get("Accept"))
+	}
+	if len(req.Headers.Values("Accept")) != 1 {
+		t.Fatalf("expected a single Accept header, got %v", req.Headers.Values("Accept"))
+	}
+	ua := req.Headers.Get("User-Agent")
+	if ua != "firefox" && ua != "chrome" {
+		t.Fatalf("expected the User-Agent of a profile, got '%s'", ua)
+	}
+	// the explicit header is still sent where the profile puts it
+	order, _ := downloader.GetRequestMeta[downloader.HeaderOrder](req)
+	if len(order.Keys) != 3 || order.Keys[0] != "User-Agent" || order.Keys[1] != "Accept" {
+		t.Fatalf("expected the header order of the profile, got %v", order.Keys)
+	}
+}
+
+func TestHeaderProfilesDoNotMixOnRetry(t *testing.T) {
+	ctx, _ := testContext()
+	h := NewHeaderProfiles(testProfiles, HeaderProfilePerRequest)
+
+	req := testGET("https://example.com")
+	req.SetHeader("X-Spider", "1")
+	for range 20 {
+		h.HandleRequest(ctx, req, downloader.RequestMetadata{})
+
+		switch req.Headers.Get("User-Agent") {
+		case "firefox":
+			if req.Headers.Get("Sec-Ch-Ua") != "" || req.Headers.Get("Accept") != "text/html" {
+				t.Fatalf("headers of different profiles were mixed: %v", req.Headers)
+			}
+		case "chrome":
+			if req.Headers.Get("Dnt") != "" || req.Headers.Get("Accept") != "*/*" {
+				t.Fatalf("headers of different profiles were mixed: %v", req.Headers)
+			}
+		default:
+			t.Fatalf("unexpected User-Agent '%s'", req.Headers.Get("User-Agent"))
+		}
+		if len(req.Headers.Values("User-Agent")) != 1 {
+			t.Fatalf("expected a single User-Agent, got %v", req.Headers.Values("User-Agent"))
+		}
+		if req.Headers.Get("X-Spider") != "1" {
+			t.Fatal("expected the headers of the spider to be kept")
+		}
+	}
+}
+
+func TestHeaderProfilesStickyPerHost(t *testing.T) {
+	ctx, _ := testContext()
+	h := NewHeaderProfiles(testProfiles, HeaderProfileStickyPerHost)
+
+	var first string
+	for i := range 10 {
+		req := testGET("https://example.com")
+		h.HandleRequest(ctx, req, downloader.RequestMetadata{})
+		if i == 0 {
+			first = req.Headers.Get("User-Agent")
+		} else if req.Headers.Get("User-Agent") != first {
+			t.Fatalf("expected the same profile for a host, got '%s' and '%s'", first, req.Headers.Get("User-Agent"))
+		}
+	}
+}
+
+func TestHeaderProfilesReachServer(t *testing.T) {
+	ctx, _ := testContext()
+	var received http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+	defer srv.Close()
+
+	dl := downloader.NewDownloader(
+		downloader.NewHttpClient(http.DefaultClient),
+		NewHeaderProfiles(testProfiles[:1], HeaderProfilePerRequest),
+	)
+	_, err := dl.Download(ctx, testGET(srv.URL), downloader.RequestMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.Get("User-Agent") != "firefox" || received.Get("Dnt") != "1" {
+		t.Fatalf("expected the profile headers to reach the server, got %v", received)
+	}
+}
@@ -31,6 +31,6 @@ func (h *Headers) HandleRequest(ctx context.Context, req *downloader.Request, me
 	return nil, nil
 }
 
-func (h *Headers) HandleResponse(ctx context.Context, res *downloader.Response, meta downloader.ResponseMetadata) error {
-	return nil
+func (h *Headers) HandleResponse(ctx context.Context, res *downloader.Response, meta downloader.ResponseMetadata) (*downloader.Response, error) {
+	return nil, nil
 }
@@ -0,0 +1,380 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LQR471814/scavenge"
+	"github.com/LQR471814/scavenge/downloader"
+)
+
+// HTTPCachePolicy decides which responses are stored in an HTTPCache and which stored responses
+// can be served without revalidating them.
+type HTTPCachePolicy interface {
+	Storable(req *downloader.Request, res *downloader.Response) bool
+	Fresh(req *downloader.Request, cached *downloader.Response, now time.Time) bool
+}
+
+// DummyCachePolicy stores every response and always serves them without revalidation.
+type DummyCachePolicy struct{}
+
+func (DummyCachePolicy) Storable(req *downloader.Request, res *downloader.Response) bool {
+	return true
+}
+
+func (DummyCachePolicy) Fresh(req *downloader.Request, cached *downloader.Response, now time.Time) bool {
+	return true
+}
+
+// cacheableByDefault are the status codes that are heuristically cacheable.
+//
+// https://www.rfc-editor.org/rfc/rfc9110#section-15.1
+var cacheableByDefault = map[int]bool{
+	200: true, 203: true, 204: true, 206: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// parseCacheControl returns the directives in the Cache-Control header with lowercase names.
+func parseCacheControl(headers http.Header) map[string]string {
+	directives := map[string]string{}
+	for _, line := range headers.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, value, _ := strings.Cut(part, "=")
+			directives[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return directives
+}
+
+func parseSeconds(value string) (time.Duration, bool) {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// RFCCachePolicy follows the caching rules of [RFC 9111](https://www.rfc-editor.org/rfc/rfc9111)
+// for a private cache.
+//
+// Only the responses to GET and HEAD requests are stored, a stored response with a Vary header is
+// only fresh for requests with the same values of the headers it lists.
+type RFCCachePolicy struct {
+	// HeuristicFraction is the fraction of the time since a response was last modified that it is
+	// considered fresh for when it has no explicit expiration, by default it is 0.1.
+	HeuristicFraction float64
+}
+
+func (p RFCCachePolicy) Storable(req *downloader.Request, res *downloader.Response) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if _, ok := parseCacheControl(req.Headers)["no-store"]; ok {
+		return false
+	}
+	directives := parseCacheControl(res.Headers())
+	if _, ok := directives["no-store"]; ok {
+		return false
+	}
+	if cacheableByDefault[res.Status()] {
+		return true
+	}
+	// https://www.rfc-editor.org/rfc/rfc9111#section-3
+	_, maxAge := directives["max-age"]
+	_, public := directives["public"]
+	return maxAge || public || res.Headers().Get("Expires") != ""
+}
+
+// lifetime implements https://www.rfc-editor.org/rfc/rfc9111#section-4.2.1
+func (p RFCCachePolicy) lifetime(res *downloader.Response, date time.Time) time.Duration {
+	directives := parseCacheControl(res.Headers())
+	maxAge, ok := parseSeconds(directives["max-age"])
+	if ok {
+		return maxAge
+	}
+
+	expires := res.Headers().Get("Expires")
+	if expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			// invalid dates (like "0") represent a time in the past
+			return 0
+		}
+		return t.Sub(date)
+	}
+
+	// https://www.rfc-editor.org/rfc/rfc9111#section-4.2.2
+	lastModified, err := http.ParseTime(res.Headers().Get("Last-Modified"))
+	if err != nil || !cacheableByDefault[res.Status()] {
+		return 0
+	}
+	fraction := p.HeuristicFraction
+	if fraction == 0 {
+		fraction = 0.1
+	}
+	return time.Duration(float64(date.Sub(lastModified)) * fraction)
+}
+
+// varyMatches reports whether the request has the same values for the headers listed in the Vary
+// header of the cached response as the request of the cached response.
+//
+// https://www.rfc-editor.org/rfc/rfc9111#section-4.1
+func varyMatches(req *downloader.Request, cached *downloader.Response) bool {
+	normalize := func(headers http.Header, name string) string {
+		var values []string
+		for _, line := range headers.Values(name) {
+			for _, v := range strings.Split(line, ",") {
+				values = append(values, strings.TrimSpace(v))
+			}
+		}
+		return strings.Join(values, ",")
+	}
+
+	for _, line := range cached.Headers().Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if name == "*" {
+				return false
+			}
+			if normalize(req.Headers, name) != normalize(cached.Request().Headers, name) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (p RFCCachePolicy) Fresh(req *downloader.Request, cached *downloader.Response, now time.Time) bool {
+	reqDirectives := parseCacheControl(req.Headers)
+	if _, ok := reqDirectives["no-cache"]; ok {
+		return false
+	}
+	if _, ok := parseCacheControl(cached.Headers())["no-cache"]; ok {
+		return false
+	}
+	if !varyMatches(req, cached) {
+		return false
+	}
+
+	// HTTPCache dates the responses without a Date header with the time they were stored
+	date, err := http.ParseTime(cached.Headers().Get("Date"))
+	if err != nil {
+		return false
+	}
+
+	// https://www.rfc-editor.org/rfc/rfc9111#section-4.2.3
+	age := max(now.Sub(date), 0)
+	ageHeader, ok := parseSeconds(cached.Headers().Get("Age"))
+	if ok {
+		age += ageHeader
+	}
+
+	maxAge, ok := parseSeconds(reqDirectives["max-age"])
+	if ok && age > maxAge {
+		return false
+	}
+	return age < p.lifetime(cached, date)
+}
+
+// mergeNotModified returns the cached response with its headers updated by the headers of a 304
+// (Not Modified) response.
+//
+// https://www.rfc-editor.org/rfc/rfc9111#section-4.3.4
+func mergeNotModified(req *downloader.Request, cached, notModified *downloader.Response) *downloader.Response {
+	headers := cached.Headers().Clone()
+	if headers == nil {
+		headers = http.Header{}
+	}
+	for k, values := range notModified.Headers() {
+		switch k {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding":
+			continue
+		}
+		headers[k] = values
+	}
+	return downloader.NewResponse(req, cached.Status(), cached.Url(), headers, cached.RawBody())
+}
+
+// withDate returns the response with a Date header set to the given time if it does not have one.
+//
+// https://www.rfc-editor.org/rfc/rfc9110#section-6.6.1
+func withDate(res *downloader.Response, now time.Time) *downloader.Response {
+	if res.Headers().Get("Date") != "" {
+		return res
+	}
+	headers := res.Headers().Clone()
+	if headers == nil {
+		headers = http.Header{}
+	}
+	headers.Set("Date", now.UTC().Format(http.TimeFormat))
+	return downloader.NewResponse(res.Request(), res.Status(), res.Url(), headers, res.RawBody())
+}
+
+// HTTPCache caches responses in a ReplayStore according to an HTTPCachePolicy, unlike Replay,
+// stored responses that are no longer fresh are revalidated with a conditional request
+// (If-None-Match / If-Modified-Since) so only responses that changed are downloaded again.
+//
+// The downloader.CacheControl meta of a request is respected, NoCache always revalidates a stored
+// response and NoStore does not store the response.
+//
+// Responses returned by request middleware (ex. by Replay) are never stored, storing them again
+// would make them look like they were just downloaded.
+//
+// Conditional requests are downloaded like any other request, a 304 (Not Modified) response is
+// replaced by the stored response in HandleResponse, so the response middlewares before HTTPCache
+// will see the 304 response and the ones after it will see the stored response.
+type HTTPCache struct {
+	sessionId string
+	store     ReplayStore
+	handler   ReplayHandler
+	policy    HTTPCachePolicy
+}
+
+func NewHTTPCache(
+	sessionId string,
+	store ReplayStore,
+	handler ReplayHandler,
+	policy HTTPCachePolicy,
+) *HTTPCache {
+	return &HTTPCache{
+		sessionId: sessionId,
+		store:     store,
+		handler:   handler,
+		policy:    policy,
+	}
+}
+
+// conditionalHeaders are the headers HTTPCache sets to revalidate a stored response.
+var conditionalHeaders = []string{"If-None-Match", "If-Modified-Since"}
+
+// httpCacheRevalidation is the request meta of a request that revalidates a stored response.
+type httpCacheRevalidation struct {
+	key    string
+	cached *downloader.Response
+	// original are the conditional headers of the request before they were set by HTTPCache.
+	original http.Header
+}
+
+// restore undoes the conditional headers set for the revalidation.
+func (r httpCacheRevalidation) restore(req *downloader.Request) {
+	if r.cached == nil {
+		return
+	}
+	for _, name := range conditionalHeaders {
+		req.Headers.Del(name)
+		for _, v := range r.original.Values(name) {
+			req.Headers.Add(name, v)
+		}
+	}
+}
+
+func (c *HTTPCache) storable(req *downloader.Request, res *downloader.Response) bool {
+	return !downloader.GetCacheControl(req).NoStore && c.policy.Storable(req, res)
+}
+
+func (c *HTTPCache) revalidate(key string, req *downloader.Request, cached *downloader.Response) {
+	r := httpCacheRevalidation{key: key, cached: cached, original: http.Header{}}
+	if req.Headers == nil {
+		req.Headers = http.Header{}
+	}
+	for _, name := range conditionalHeaders {
+		for _, v := range req.Headers.Values(name) {
+			r.original.Add(name, v)
+		}
+	}
+
+	etag := cached.Headers().Get("ETag")
+	if etag != "" {
+		req.SetHeader("If-None-Match", etag)
+	}
+	lastModified := cached.Headers().Get("Last-Modified")
+	if lastModified != "" {
+		req.SetHeader("If-Modified-Since", lastModified)
+	}
+	req.SetMeta(r)
+}
+
+func (c *HTTPCache) HandleRequest(ctx context.Context, req *downloader.Request, meta downloader.RequestMetadata) (*downloader.Response, error) {
+	logger := scavenge.LoggerFromContext(ctx)
+	stats := scavenge.StatsFromContext(ctx)
+
+	// a request that is downloaded again (ex. when it is retried) is revalidated from scratch
+	prev, _ := downloader.GetRequestMeta[httpCacheRevalidation](req)
+	prev.restore(req)
+	req.SetMeta(httpCacheRevalidation{})
+
+	key, cache := c.handler(ctx, req, meta)
+	if !cache {
+		return nil, nil
+	}
+	cached := c.store.Get(ctx, c.sessionId, key)
+	if cached == nil {
+		stats.Inc("http_cache", "miss", 1)
+		return nil, nil
+	}
+	if cached.Headers().Get("Date") == "" {
+		managed, ok := c.store.(ManagedReplayStore)
+		if ok {
+			entry, ok := managed.Stat(ctx, c.sessionId, key)
+			if ok {
+				cached = withDate(cached, entry.Stored)
+			}
+		}
+	}
+
+	noCache := downloader.GetCacheControl(req).NoCache
+	if !noCache && c.policy.Fresh(req, cached, time.Now()) {
+		logger.Debug("http_cache", "serving fresh response", "key", key)
+		stats.Inc("http_cache", "hit", 1)
+		return downloader.NewResponse(req, cached.Status(), cached.Url(), cached.Headers(), cached.RawBody()), nil
+	}
+
+	if cached.Headers().Get("ETag") == "" && cached.Headers().Get("Last-Modified") == "" {
+		stats.Inc("http_cache", "stale", 1)
+		return nil, nil
+	}
+	logger.Debug("http_cache", "revalidating response", "key", key)
+	c.revalidate(key, req, cached)
+	return nil, nil
+}
+
+func (c *HTTPCache) HandleResponse(ctx context.Context, res *downloader.Response, meta downloader.ResponseMetadata) (*downloader.Response, error) {
+	if meta.Replayed {
+		return nil, nil
+	}
+	stats := scavenge.StatsFromContext(ctx)
+	req := res.Request()
+
+	r, _ := downloader.GetRequestMeta[httpCacheRevalidation](req)
+	key, cache := r.key, true
+	if r.cached == nil {
+		key, cache = c.handler(ctx, req, meta.RequestMetadata)
+	} else {
+		if res.Status() == http.StatusNotModified {
+			merged := mergeNotModified(req, r.cached, res)
+			if !downloader.GetCacheControl(req).NoStore {
+				c.store.Set(ctx, c.sessionId, key, withDate(merged, time.Now()))
+			}
+			stats.Inc("http_cache", "revalidated", 1)
+			return merged, nil
+		}
+		stats.Inc("http_cache", "changed", 1)
+	}
+
+	if !cache || !c.storable(req, res) {
+		return nil, nil
+	}
+	c.store.Set(ctx, c.sessionId, key, withDate(res, time.Now()))
+	stats.Inc("http_cache", "stored", 1)
+	return nil, nil
+}
@@ -0,0 +1,300 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LQR471814/scavenge/downloader"
+)
+
+func cachedResponse(req *downloader.Request, status int, headers http.Header) *downloader.Response {
+	return downloader.NewResponse(req, status, req.Url, headers, []byte("cached"))
+}
+
+func TestRFCCachePolicyStorable(t *testing.T) {
+	policy := RFCCachePolicy{}
+	head := testGET("https://example.com")
+	head.Method = http.MethodHead
+	post := downloader.POSTRequest(downloader.MustParseUrl("https://example.com"))
+	noStore := testGET("https://example.com")
+	noStore.SetHeader("Cache-Control", "no-store")
+
+	cases := []struct {
+		name     string
+		req      *downloader.Request
+		status   int
+		headers  http.Header
+		storable bool
+	}{
+		{"get", testGET("https://example.com"), 200, http.Header{}, true},
+		{"head", head, 200, http.Header{}, true},
+		{"post", post, 200, http.Header{"Cache-Control": {"max-age=60"}}, false},
+		{"request no-store", noStore, 200, http.Header{}, false},
+		{"response no-store", testGET("https://example.com"), 200, http.Header{"Cache-Control": {"no-store"}}, false},
+		{"not cacheable by default", testGET("https://example.com"), 500, http.Header{}, false},
+		{"explicitly cacheable", testGET("https://example.com"), 500, http.Header{"Cache-Control": {"max-age=60"}}, true},
+	}
+	for _, c := range cases {
+		res := cachedResponse(c.req, c.status, c.headers)
+		if policy.Storable(c.req, res) != c.storable {
+			t.Fatalf("%s: expected storable to be %v", c.name, c.storable)
+		}
+	}
+}
+
+func TestRFCCachePolicyFresh(t *testing.T) {
+	policy := RFCCachePolicy{}
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	date := now.Format(http.TimeFormat)
+	maxAge0 := testGET("https://example.com")
+	maxAge0.SetHeader("Cache-Control", "max-age=0")
+	noCache := testGET("https://example.com")
+	noCache.SetHeader("Cache-Control", "no-cache")
+
+	cases := []struct {
+		name    string
+		req     *downloader.Request
+		headers http.Header
+		at      time.Duration
+		fresh   bool
+	}{
+		{"max-age", nil, http.Header{"Date": {date}, "Cache-Control": {"max-age=60"}}, 30 * time.Second, true},
+		{"max-age expired", nil, http.Header{"Date": {date}, "Cache-Control": {"max-age=60"}}, 90 * time.Second, false},
+		{"age header", nil, http.Header{"Date": {date}, "Cache-Control": {"max-age=60"}, "Age": {"50"}}, 30 * time.Second, false},
+		{"expires", nil, http.Header{"Date": {date}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, time.Minute, true},
+		{"invalid expires", nil, http.Header{"Date": {date}, "Expires": {"0"}}, 0, false},
+		{"heuristic", nil, http.Header{"Date": {date}, "Last-Modified": {now.Add(-10 * time.Hour).Format(http.TimeFormat)}}, 30 * time.Minute, true},
+		{"heuristic expired", nil, http.Header{"Date": {date}, "Last-Modified": {now.Add(-10 * time.Hour).Format(http.TimeFormat)}}, 2 * time.Hour, false},
+		{"no date", nil, http.Header{"Cache-Control": {"max-age=60"}}, 0, false},
+		{"request max-age", maxAge0, http.Header{"Date": {date}, "Cache-Control": {"max-age=60"}}, time.Second, false},
+		{"request no-cache", noCache, http.Header{"Date": {date}, "Cache-Control": {"max-age=60"}}, 0, false},
+		{"response no-cache", nil, http.Header{"Date": {date}, "Cache-Control": {"max-age=60, no-cache"}}, 0, false},
+	}
+	for _, c := range cases {
+		req := c.req
+		if req == nil {
+			req = testGET("https://example.com")
+		}
+		cached := cachedResponse(testGET("https://example.com"), 200, c.headers)
+		if policy.Fresh(req, cached, now.Add(c.at)) != c.fresh {
+			t.Fatalf("%s: expected fresh to be %v", c.name, c.fresh)
+		}
+	}
+}
+
+func TestRFCCachePolicyVary(t *testing.T) {
+	policy := RFCCachePolicy{}
+	now := time.Now()
+	stored := testGET("https://example.com")
+	stored.SetHeader("Accept-Language", "en")
+	headers := func(vary string) http.Header {
+		return http.Header{
+			"Date":          {now.UTC().Format(http.TimeFormat)},
+			"Cache-Control": {"max-age=60"},
+			"Vary":          {vary},
+		}
+	}
+
+	same := testGET("https://example.com")
+	same.SetHeader("Accept-Language", "en")
+	other := testGET("https://example.com")
+	other.SetHeader("Accept-Language", "fr")
+
+	if !policy.Fresh(same, cachedResponse(stored, 200, headers("Accept-Language")), now) {
+		t.Fatal("expected a request with the same varying headers to be served")
+	}
+	if policy.Fresh(other, cachedResponse(stored, 200, headers("accept-language")), now) {
+		t.Fatal("expected a request with different varying headers to not be served")
+	}
+	if policy.Fresh(testGET("https://example.com"), cachedResponse(stored, 200, headers("Accept-Language")), now) {
+		t.Fatal("expected a request without the varying header to not be served")
+	}
+	if policy.Fresh(same, cachedResponse(stored, 200, headers("*")), now) {
+		t.Fatal("expected a response that varies on everything to never be served")
+	}
+}
+
+func TestHTTPCacheDatesStoredResponses(t *testing.T) {
+	ctx, stats := testContext()
+	store := NewMemoryReplayStore()
+	cache := NewHTTPCache("session", store, ReplayGetRequests, RFCCachePolicy{})
+
+	req := testGET("https://example.com/page")
+	res := cachedResponse(req, 200, http.Header{"Cache-Control": {"max-age=60"}})
+	_, err := cache.HandleResponse(ctx, res, downloader.ResponseMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served, err := cache.HandleRequest(ctx, testGET("https://example.com/page"), downloader.RequestMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if served == nil || string(served.RawBody()) != "cached" {
+		t.Fatal("expected a stored response without a Date header to be fresh")
+	}
+	if stats.Get("http_cache", "hit") != 1 {
+		t.Fatalf("expected 1 hit, got %d", stats.Get("http_cache", "hit"))
+	}
+
+	// a response stored without a Date header (by something other than HTTPCache) is dated with
+	// the time it was stored
+	store.Set(ctx, "session", "other", cachedResponse(testGET("https://example.com/other"), 200, http.Header{"Cache-Control": {"max-age=60"}}))
+	cache = NewHTTPCache("session", store, func(ctx context.Context, req *downloader.Request, meta downloader.RequestMetadata) (string, bool) {
+		return "other", true
+	}, RFCCachePolicy{})
+	served, err = cache.HandleRequest(ctx, testGET("https://example.com/other"), downloader.RequestMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if served == nil {
+		t.Fatal("expected the time the response was stored to be used as its date")
+	}
+
+	post := downloader.POSTRequest(downloader.MustParseUrl("https://example.com/page"))
+	_, err = cache.HandleResponse(ctx, cachedResponse(post, 200, http.Header{"Cache-Control": {"max-age=60"}}), downloader.ResponseMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Get("http_cache", "stored") != 1 {
+		t.Fatal("expected the response to a POST request to not be stored")
+	}
+}
+
+func TestHTTPCacheCacheControlMeta(t *testing.T) {
+	ctx, stats := testContext()
+	store := NewMemoryReplayStore()
+	cache := NewHTTPCache("session", store, ReplayGetRequests, RFCCachePolicy{})
+	headers := http.Header{"Cache-Control": {"max-age=60"}, "Etag": {`"v1"`}}
+
+	noStore := testGET("https://example.com/page")
+	noStore.SetMeta(downloader.CacheControl{NoStore: true})
+	_, err := cache.HandleResponse(ctx, cachedResponse(noStore, 200, headers), downloader.ResponseMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Get("http_cache", "stored") != 0 {
+		t.Fatal("expected a NoStore response to not be stored")
+	}
+
+	_, err = cache.HandleResponse(ctx, cachedResponse(testGET("https://example.com/page"), 200, headers), downloader.ResponseMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	noCache := testGET("https://example.com/page")
+	noCache.SetMeta(downloader.CacheControl{NoCache: true})
+	served, err := cache.HandleRequest(ctx, noCache, downloader.RequestMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if served != nil || noCache.Headers.Get("If-None-Match") != `"v1"` {
+		t.Fatal("expected a fresh response to be revalidated for a NoCache request")
+	}
+}
+
+func TestHTTPCacheRevalidatesWithFSReplayStore(t *testing.T) {
+	ctx, stats := testContext()
+	var conditional []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conditional = append(conditional, r.Header.Get("If-None-Match"))
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("page"))
+	}))
+	defer srv.Close()
+
+	// the store only knows the meta of the spider, not the meta HTTPCache adds to requests
+	store := NewFSReplayStore(t.TempDir(), NewGobMetaEncoder(testStoredMeta{}))
+	dl := downloader.NewDownloader(
+		downloader.NewHttpClient(http.DefaultClient),
+		NewHTTPCache("session", store, ReplayGetRequests, RFCCachePolicy{}),
+	)
+	for range 3 {
+		req := testGET(srv.URL + "/page")
+		req.AddMeta(testStoredMeta{Page: 1})
+		res, err := dl.Download(ctx, req, downloader.RequestMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Status() != 200 || string(res.RawBody()) != "page" {
+			t.Fatalf("expected the stored response, got %d '%s'", res.Status(), res.RawBody())
+		}
+		if res.Request() != req {
+			t.Fatal("expected the response to be for the downloaded request")
+		}
+	}
+	if strings.Join(conditional, ",") != `,"v1","v1"` {
+		t.Fatalf("expected the stored response to be revalidated, got %v", conditional)
+	}
+	if stats.Get("http_cache", "revalidated") != 2 {
+		t.Fatalf("expected 2 revalidations, got %d", stats.Get("http_cache", "revalidated"))
+	}
+
+	stored := store.Get(ctx, "session", srv.URL+"/page")
+	if stored == nil {
+		t.Fatal("expected the revalidated response to be stored")
+	}
+	_, ok := downloader.GetRequestMeta[httpCacheRevalidation](stored.Request())
+	if ok {
+		t.Fatal("expected the revalidation meta to not be stored")
+	}
+	meta, ok := downloader.GetRequestMeta[testStoredMeta](stored.Request())
+	if !ok || meta.Page != 1 {
+		t.Fatal("expected the meta of the spider to be stored")
+	}
+}
+
+func TestHTTPCacheRetriedRevalidation(t *testing.T) {
+	ctx, _ := testContext()
+	store := NewMemoryReplayStore()
+	cache := NewHTTPCache("session", store, ReplayGetRequests, RFCCachePolicy{})
+	_, err := cache.HandleResponse(ctx, cachedResponse(testGET("https://example.com/page"), 200, http.Header{
+		"Cache-Control": {"max-age=0"},
+		"Etag":          {`"v1"`},
+	}), downloader.ResponseMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := testGET("https://example.com/page")
+	req.SetHeader("If-None-Match", `"mine"`)
+	_, err = cache.HandleRequest(ctx, req, downloader.RequestMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Headers.Get("If-None-Match") != `"v1"` {
+		t.Fatalf("expected the request to be revalidated, got %v", req.Headers)
+	}
+
+	// the stored response is removed before the retry, so the request is downloaded as it was
+	store.Delete(ctx, "session", "https://example.com/page")
+	_, err = cache.HandleRequest(ctx, req, downloader.RequestMetadata{AttemptNo: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(req.Headers.Values("If-None-Match")) != 1 || req.Headers.Get("If-None-Match") != `"mine"` {
+		t.Fatalf("expected the conditional headers of the request to be restored, got %v", req.Headers)
+	}
+	r, _ := downloader.GetRequestMeta[httpCacheRevalidation](req)
+	if r.cached != nil {
+		t.Fatal("expected the retried request to not be a revalidation")
+	}
+
+	// a reissued response is stored like any other response
+	res := cachedResponse(req, 200, http.Header{"Cache-Control": {"max-age=60"}})
+	_, err = cache.HandleResponse(ctx, res, downloader.ResponseMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !store.Has(ctx, "session", "https://example.com/page") {
+		t.Fatal("expected the response to the retried request to be stored")
+	}
+}
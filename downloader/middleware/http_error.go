@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+
+	"github.com/LQR471814/scavenge"
+	"github.com/LQR471814/scavenge/downloader"
+)
+
+// HttpStatusError is the error of a response dropped by HttpError because of its status.
+type HttpStatusError struct {
+	Status int
+	Url    *url.URL
+}
+
+func (e HttpStatusError) Error() string {
+	return fmt.Sprintf("http error: status %d (%s) for '%s'", e.Status, http.StatusText(e.Status), e.Url)
+}
+
+type httpErrorCfg struct {
+	allowed []int
+}
+
+type httpErrorOption = func(cfg *httpErrorCfg)
+
+// WithHttpErrorAllowed allows responses with the given statuses (besides 2xx) for all requests.
+func WithHttpErrorAllowed(statuses ...int) httpErrorOption {
+	return func(cfg *httpErrorCfg) {
+		cfg.allowed = append(cfg.allowed, statuses...)
+	}
+}
+
+// HttpError drops responses with a status outside of 2xx so spiders only receive successful
+// responses, the request is dropped with an HttpStatusError (which can be found with errors.As).
+//
+//   - Statuses can be allowed for all requests with WithHttpErrorAllowed, or for a single request
+//     with the downloader.AllowStatus meta.
+//   - Middleware that handle specific statuses (ex. Auth, HTTPCache) should be placed before it.
+type HttpError struct {
+	cfg httpErrorCfg
+}
+
+func NewHttpError(options ...httpErrorOption) HttpError {
+	cfg := httpErrorCfg{}
+	for _, o := range options {
+		o(&cfg)
+	}
+	return HttpError{cfg: cfg}
+}
+
+func (h HttpError) allowed(req *downloader.Request, status int) bool {
+	if status >= 200 && status < 300 || slices.Contains(h.cfg.allowed, status) {
+		return true
+	}
+	for _, allow := range downloader.ListRequestMeta[downloader.AllowStatus](req) {
+		if allow.All || slices.Contains(allow.Statuses, status) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h HttpError) HandleRequest(ctx context.Context, req *downloader.Request, meta downloader.RequestMetadata) (*downloader.Response, error) {
+	return nil, nil
+}
+
+func (h HttpError) HandleResponse(ctx context.Context, res *downloader.Response, meta downloader.ResponseMetadata) (*downloader.Response, error) {
+	status := res.Status()
+	if h.allowed(res.Request(), status) {
+		return nil, nil
+	}
+	scavenge.LoggerFromContext(ctx).Debug(
+		"http_error", "dropped response",
+		"url", scavenge.ShortUrl(res.Url()),
+		"status", status,
+	)
+	scavenge.StatsFromContext(ctx).Inc("http_error", fmt.Sprintf("dropped_%d", status), 1)
+	return nil, downloader.DroppedRequest(HttpStatusError{Status: status, Url: res.Url()})
+}
@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/LQR471814/scavenge/downloader"
+)
+
+func TestHttpError(t *testing.T) {
+	ctx, stats := testContext()
+	h := NewHttpError(WithHttpErrorAllowed(404))
+
+	allowStatus := testGET("https://example.com")
+	allowStatus.AddMeta(downloader.AllowStatus{Statuses: []int{500}})
+	allowAll := testGET("https://example.com")
+	allowAll.AddMeta(downloader.AllowStatus{All: true})
+
+	cases := []struct {
+		name    string
+		req     *downloader.Request
+		status  int
+		allowed bool
+	}{
+		{"ok", testGET("https://example.com"), 200, true},
+		{"no content", testGET("https://example.com"), 204, true},
+		{"redirect", testGET("https://example.com"), 302, false},
+		{"allowed for all requests", testGET("https://example.com"), 404, true},
+		{"server error", testGET("https://example.com"), 500, false},
+		{"allowed by meta", allowStatus, 500, true},
+		{"not allowed by meta", allowStatus, 503, false},
+		{"all allowed by meta", allowAll, 503, true},
+	}
+	for _, c := range cases {
+		_, err := h.HandleResponse(ctx, testResponse(c.req, c.status), downloader.ResponseMetadata{})
+		if c.allowed {
+			if err != nil {
+				t.Fatalf("%s: expected the response to be allowed, got %v", c.name, err)
+			}
+			continue
+		}
+		var statusErr HttpStatusError
+		if !errors.As(err, &statusErr) || statusErr.Status != c.status {
+			t.Fatalf("%s: expected an HttpStatusError, got %v", c.name, err)
+		}
+		if !strings.Contains(err.Error(), "dropped request") {
+			t.Fatalf("%s: expected the request to be dropped, got %v", c.name, err)
+		}
+	}
+	if stats.Get("http_error", "dropped_500") != 1 || stats.Get("http_error", "dropped_503") != 1 {
+		t.Fatal("expected the dropped responses to be counted by status")
+	}
+}
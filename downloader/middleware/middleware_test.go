@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/LQR471814/scavenge"
+	"github.com/LQR471814/scavenge/downloader"
+)
+
+// testContext returns a context with the Logger and Stats middleware expect from a Scavenger.
+func testContext() (context.Context, *scavenge.MemoryStats) {
+	stats := scavenge.NewMemoryStats()
+	logger := scavenge.NewSlogLogger(slog.New(slog.NewTextHandler(io.Discard, nil)), false)
+	ctx := scavenge.ContextWithLogger(context.Background(), logger)
+	return scavenge.ContextWithStats(ctx, stats), stats
+}
+
+// testResponse returns an empty response with the given status to the request.
+func testResponse(req *downloader.Request, status int) *downloader.Response {
+	return downloader.NewResponse(req, status, req.Url, http.Header{}, nil)
+}
+
+func testGET(rawUrl string) *downloader.Request {
+	return downloader.GETRequest(downloader.MustParseUrl(rawUrl))
+}
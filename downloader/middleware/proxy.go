@@ -0,0 +1,307 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/LQR471814/scavenge"
+	"github.com/LQR471814/scavenge/downloader"
+)
+
+// ProxyStrategy determines how a proxy is picked from the pool for a request.
+type ProxyStrategy int
+
+const (
+	// ProxyRoundRobin cycles through the proxies in order.
+	ProxyRoundRobin ProxyStrategy = iota
+	// ProxyRandom picks a random proxy for each request.
+	ProxyRandom
+	// ProxyStickyPerHost always uses the same proxy for a given host (until that proxy is benched).
+	ProxyStickyPerHost
+)
+
+type proxyCfg struct {
+	strategy       ProxyStrategy
+	window         int
+	minSamples     int
+	maxFailureRate float64
+	benchDuration  time.Duration
+	isFailure      func(res *downloader.Response) bool
+}
+
+type proxyOption = func(cfg *proxyCfg)
+
+// WithProxyStrategy sets the strategy used to pick proxies, by default it is ProxyRoundRobin.
+func WithProxyStrategy(strategy ProxyStrategy) proxyOption {
+	return func(cfg *proxyCfg) {
+		cfg.strategy = strategy
+	}
+}
+
+// WithProxyMaxFailureRate sets the failure rate (between 0 and 1) over the last window requests
+// at which a proxy is benched, a proxy will not be benched until it has at least minSamples
+// requests in its window.
+func WithProxyMaxFailureRate(rate float64, window, minSamples int) proxyOption {
+	return func(cfg *proxyCfg) {
+		if rate < 0 || rate > 1 {
+			panic(fmt.Errorf("proxy: max failure rate '%v' must be between 0 and 1", rate))
+		}
+		if window < 1 {
+			panic(fmt.Errorf("proxy: window '%d' must be at least 1", window))
+		}
+		if minSamples > window {
+			panic(fmt.Errorf("proxy: min samples '%d' cannot be greater than window '%d'", minSamples, window))
+		}
+		cfg.maxFailureRate = rate
+		cfg.window = window
+		cfg.minSamples = minSamples
+	}
+}
+
+// WithProxyBenchDuration sets the amount of time a bad proxy is benched for.
+func WithProxyBenchDuration(duration time.Duration) proxyOption {
+	return func(cfg *proxyCfg) {
+		cfg.benchDuration = duration
+	}
+}
+
+// WithProxyFailure sets the function used to determine if a response counts as a failure of the
+// proxy, by default responses with the status 407, 502, 503 and 504 are failures.
+//
+// Note: requests that fail without a response are always counted as failures.
+func WithProxyFailure(isFailure func(res *downloader.Response) bool) proxyOption {
+	return func(cfg *proxyCfg) {
+		cfg.isFailure = isFailure
+	}
+}
+
+// ProxyHealth is a snapshot of the health of a proxy.
+type ProxyHealth struct {
+	Url      *url.URL
+	Requests int64
+	Failures int64
+	// FailureRate is the failure rate over the window of recent requests.
+	FailureRate  float64
+	BenchedUntil time.Time
+}
+
+type proxyState struct {
+	url      *url.URL
+	requests atomic.Int64
+	failures atomic.Int64
+
+	mu           sync.Mutex
+	outcomes     []bool
+	next         int
+	samples      int
+	benchedUntil time.Time
+}
+
+// failureRate must be called with the lock held.
+func (p *proxyState) failureRate() float64 {
+	if p.samples == 0 {
+		return 0
+	}
+	failed := 0
+	for i := range p.samples {
+		if p.outcomes[i] {
+			failed++
+		}
+	}
+	return float64(failed) / float64(p.samples)
+}
+
+func (p *proxyState) benched(now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return now.Before(p.benchedUntil)
+}
+
+// Proxy sends requests through a pool of proxies, proxies that fail too often are temporarily
+// benched.
+//
+// Requests that already have a Proxy set (that is not from the pool) are left alone. Proxy
+// requires a client that supports per-request proxies like [downloader.HttpClient].
+type Proxy struct {
+	cfg     proxyCfg
+	proxies []*proxyState
+	byUrl   map[string]*proxyState
+	counter atomic.Uint64
+	sticky  sync.Map
+}
+
+func NewProxy(proxies []*url.URL, options ...proxyOption) *Proxy {
+	if len(proxies) == 0 {
+		panic("proxy: at least one proxy must be given")
+	}
+	cfg := proxyCfg{
+		strategy:       ProxyRoundRobin,
+		window:         20,
+		minSamples:     5,
+		maxFailureRate: 0.5,
+		benchDuration:  time.Minute,
+		isFailure: func(res *downloader.Response) bool {
+			switch res.Status() {
+			case 407, 502, 503, 504:
+				return true
+			}
+			return false
+		},
+	}
+	for _, o := range options {
+		o(&cfg)
+	}
+
+	states := make([]*proxyState, len(proxies))
+	byUrl := make(map[string]*proxyState, len(proxies))
+	for i, u := range proxies {
+		states[i] = &proxyState{
+			url:      u,
+			outcomes: make([]bool, cfg.window),
+		}
+		byUrl[u.String()] = states[i]
+	}
+
+	return &Proxy{
+		cfg:     cfg,
+		proxies: states,
+		byUrl:   byUrl,
+		sticky:  sync.Map{},
+	}
+}
+
+// Health returns the health of each proxy in the pool.
+func (p *Proxy) Health() []ProxyHealth {
+	out := make([]ProxyHealth, len(p.proxies))
+	for i, state := range p.proxies {
+		state.mu.Lock()
+		out[i] = ProxyHealth{
+			Url:          state.url,
+			Requests:     state.requests.Load(),
+			Failures:     state.failures.Load(),
+			FailureRate:  state.failureRate(),
+			BenchedUntil: state.benchedUntil,
+		}
+		state.mu.Unlock()
+	}
+	return out
+}
+
+func (p *Proxy) pick(host string) *proxyState {
+	now := time.Now()
+
+	if p.cfg.strategy == ProxyStickyPerHost {
+		v, ok := p.sticky.Load(host)
+		if ok && !v.(*proxyState).benched(now) {
+			return v.(*proxyState)
+		}
+	}
+
+	start := 0
+	switch p.cfg.strategy {
+	case ProxyRandom:
+		start = rand.IntN(len(p.proxies))
+	default:
+		start = int(p.counter.Add(1) % uint64(len(p.proxies)))
+	}
+	for i := range len(p.proxies) {
+		state := p.proxies[(start+i)%len(p.proxies)]
+		if state.benched(now) {
+			continue
+		}
+		if p.cfg.strategy == ProxyStickyPerHost {
+			p.sticky.Store(host, state)
+		}
+		return state
+	}
+	return nil
+}
+
+func (p *Proxy) record(ctx context.Context, proxy *url.URL, failed bool) {
+	if proxy == nil {
+		return
+	}
+	state, ok := p.byUrl[proxy.String()]
+	if !ok {
+		return
+	}
+
+	state.requests.Add(1)
+	if failed {
+		state.failures.Add(1)
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	state.outcomes[state.next] = failed
+	state.next = (state.next + 1) % len(state.outcomes)
+	if state.samples < len(state.outcomes) {
+		state.samples++
+	}
+	if state.samples < p.cfg.minSamples {
+		return
+	}
+	rate := state.failureRate()
+	if rate < p.cfg.maxFailureRate {
+		return
+	}
+
+	state.benchedUntil = time.Now().Add(p.cfg.benchDuration)
+	state.samples = 0
+	state.next = 0
+
+	scavenge.LoggerFromContext(ctx).Warn(
+		"proxy", "benched proxy",
+		"proxy", shortProxyUrl(proxy),
+		"failure_rate", rate,
+		"until", state.benchedUntil,
+	)
+	scavenge.StatsFromContext(ctx).Inc("proxy", "benched", 1)
+}
+
+func (p *Proxy) HandleRequest(ctx context.Context, req *downloader.Request, meta downloader.RequestMetadata) (*downloader.Response, error) {
+	// requests are reused between retries, so a proxy assigned from the pool in a previous
+	// attempt is reassigned
+	if req.Proxy != nil {
+		_, fromPool := p.byUrl[req.Proxy.String()]
+		if !fromPool {
+			return nil, nil
+		}
+	}
+	state := p.pick(req.Url.Host)
+	if state == nil {
+		scavenge.StatsFromContext(ctx).Inc("proxy", "requests_deferred", 1)
+		return nil, fmt.Errorf("proxy: all proxies are benched")
+	}
+	req.Proxy = state.url
+	return nil, nil
+}
+
+func (p *Proxy) HandleResponse(ctx context.Context, res *downloader.Response, meta downloader.ResponseMetadata) (*downloader.Response, error) {
+	if meta.Replayed {
+		return nil, nil
+	}
+	p.record(ctx, res.Request().Proxy, p.cfg.isFailure(res))
+	return nil, nil
+}
+
+func (p *Proxy) HandleError(ctx context.Context, req *downloader.Request, meta downloader.RequestMetadata, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	p.record(ctx, req.Proxy, true)
+}
+
+// shortProxyUrl formats a proxy url without its credentials for use in logging and errors.
+func shortProxyUrl(u *url.URL) string {
+	if u == nil {
+		return "<nil>"
+	}
+	return u.Scheme + "://" + u.Host
+}
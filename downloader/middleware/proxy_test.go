@@ -0,0 +1,152 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/LQR471814/scavenge/downloader"
+)
+
+// newTestProxy starts an HTTP forward proxy that answers every request itself with the url it
+// was asked for and the Proxy-Authorization header it received.
+func newTestProxy(t *testing.T, name string) *url.URL {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s", name, r.URL.String(), r.Header.Get("Proxy-Authorization"))
+	}))
+	t.Cleanup(srv.Close)
+	return downloader.MustParseUrl(srv.URL)
+}
+
+func TestProxyRoutesThroughPool(t *testing.T) {
+	ctx, _ := testContext()
+	a := newTestProxy(t, "a")
+	b := newTestProxy(t, "b")
+	a.User = url.UserPassword("user", "pass")
+
+	dl := downloader.NewDownloader(
+		downloader.NewHttpClient(http.DefaultClient),
+		NewProxy([]*url.URL{a, b}),
+	)
+
+	seen := map[string]int{}
+	for range 4 {
+		res, err := dl.Download(ctx, testGET("http://example.com/page"), downloader.RequestMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var name, target, auth string
+		fmt.Sscanf(string(res.RawBody()), "%s %s %s", &name, &target, &auth)
+		if target != "http://example.com/page" {
+			t.Fatalf("proxy received unexpected target '%s'", target)
+		}
+		if name == "a" && auth == "" {
+			t.Fatal("expected the credentials of the proxy url to be sent")
+		}
+		seen[name]++
+	}
+	if seen["a"] != 2 || seen["b"] != 2 {
+		t.Fatalf("expected round robin between proxies, got %v", seen)
+	}
+}
+
+func TestProxyKeepsRequestProxy(t *testing.T) {
+	ctx, _ := testContext()
+	own := downloader.MustParseUrl("http://own-proxy:8080")
+	p := NewProxy([]*url.URL{downloader.MustParseUrl("http://pool:8080")})
+
+	req := testGET("http://example.com")
+	req.Proxy = own
+	_, err := p.HandleRequest(ctx, req, downloader.RequestMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Proxy != own {
+		t.Fatalf("expected the proxy of the request to be kept, got %s", req.Proxy)
+	}
+}
+
+func TestProxyBenchesFailingProxies(t *testing.T) {
+	ctx, stats := testContext()
+	bad := downloader.MustParseUrl("http://bad:8080")
+	good := downloader.MustParseUrl("http://good:8080")
+	p := NewProxy(
+		[]*url.URL{bad, good},
+		WithProxyMaxFailureRate(0.5, 4, 2),
+	)
+
+	for range 2 {
+		req := testGET("http://example.com")
+		req.Proxy = bad
+		p.HandleError(ctx, req, downloader.RequestMetadata{}, errors.New("connection refused"))
+	}
+	if stats.Get("proxy", "benched") != 1 {
+		t.Fatalf("expected the failing proxy to be benched")
+	}
+
+	for range 4 {
+		req := testGET("http://example.com")
+		_, err := p.HandleRequest(ctx, req, downloader.RequestMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.Proxy.String() != good.String() {
+			t.Fatalf("expected only the healthy proxy to be used, got %s", req.Proxy)
+		}
+	}
+
+	for range 2 {
+		req := testGET("http://example.com")
+		req.Proxy = good
+		p.HandleResponse(ctx, testResponse(req, 502), downloader.ResponseMetadata{})
+	}
+	_, err := p.HandleRequest(ctx, testGET("http://example.com"), downloader.RequestMetadata{})
+	if err == nil {
+		t.Fatal("expected the request to be deferred when all proxies are benched")
+	}
+
+	health := p.Health()
+	if health[0].Failures != 2 || health[1].Failures != 2 {
+		t.Fatalf("unexpected proxy health: %+v", health)
+	}
+}
+
+func TestProxyStickyPerHost(t *testing.T) {
+	ctx := context.Background()
+	p := NewProxy(
+		[]*url.URL{
+			downloader.MustParseUrl("http://a:8080"),
+			downloader.MustParseUrl("http://b:8080"),
+			downloader.MustParseUrl("http://c:8080"),
+		},
+		WithProxyStrategy(ProxyStickyPerHost),
+	)
+
+	var first string
+	for i := range 5 {
+		req := testGET("http://example.com")
+		p.HandleRequest(ctx, req, downloader.RequestMetadata{})
+		if i == 0 {
+			first = req.Proxy.String()
+		} else if req.Proxy.String() != first {
+			t.Fatalf("expected the same proxy for a host, got %s and %s", first, req.Proxy)
+		}
+	}
+}
+
+func TestProxyMaxFailureRateValidation(t *testing.T) {
+	for _, window := range []int{0, -1} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("expected a panic for the window %d", window)
+				}
+			}()
+			WithProxyMaxFailureRate(0.5, window, 0)(&proxyCfg{})
+		}()
+	}
+}
@@ -2,7 +2,11 @@ package middleware
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/LQR471814/scavenge"
 	"github.com/LQR471814/scavenge/downloader"
@@ -10,11 +14,58 @@ import (
 	"github.com/PuerkitoBio/purell"
 )
 
+// ReplayMode determines when Replay downloads responses.
+type ReplayMode int
+
+const (
+	// ReplayRecordMissing replays stored responses and downloads and stores the rest.
+	ReplayRecordMissing ReplayMode = iota
+	// ReplayRecord always downloads and stores responses, replacing stored responses.
+	ReplayRecord
+	// ReplayOnly only replays stored responses, requests that do not have a stored response are
+	// dropped so that no request is ever made over the network.
+	ReplayOnly
+)
+
+type replayCfg struct {
+	maxAge time.Duration
+	mode   ReplayMode
+}
+
+type replayOption = func(cfg *replayCfg)
+
+// WithReplayMode sets the mode of the replay middleware, by default it is ReplayRecordMissing.
+func WithReplayMode(mode ReplayMode) replayOption {
+	return func(cfg *replayCfg) {
+		cfg.mode = mode
+	}
+}
+
+// WithReplayMaxAge makes responses stored longer than the given duration ago be downloaded
+// again instead of replayed, it requires the store to be a ManagedReplayStore.
+//
+// The max age is ignored in the ReplayOnly mode.
+func WithReplayMaxAge(maxAge time.Duration) replayOption {
+	return func(cfg *replayCfg) {
+		cfg.maxAge = maxAge
+	}
+}
+
 // Replay provides response replay (and caching) functionality.
+//
+// The downloader.CacheControl meta of a request is respected, NoCache downloads the request
+// again (except in ReplayOnly) and NoStore does not store its response.
+//
+// Responses returned by request middleware (ex. by another Replay or HTTPCache) are never stored,
+// storing them again would make them look like they were just downloaded.
 type Replay struct {
+	cfg       replayCfg
 	sessionId string
 	store     ReplayStore
 	handler   ReplayHandler
+
+	mu        sync.Mutex
+	unmatched map[string]struct{}
 }
 
 // ReplayHandler determines what requests to replay and what the unique key for
@@ -30,37 +81,96 @@ func ReplayGetRequests(ctx context.Context, req *downloader.Request, meta downlo
 	return purell.NormalizeURL(req.Url, purell.FlagsSafe), true
 }
 
-func NewReplay(sessionId string, store ReplayStore, handler ReplayHandler) Replay {
-	return Replay{
+func NewReplay(sessionId string, store ReplayStore, handler ReplayHandler, options ...replayOption) *Replay {
+	cfg := replayCfg{}
+	for _, o := range options {
+		o(&cfg)
+	}
+	if cfg.maxAge > 0 {
+		if _, ok := store.(ManagedReplayStore); !ok {
+			panic(fmt.Errorf("replay: a max age requires a ManagedReplayStore, got %T", store))
+		}
+	}
+	return &Replay{
+		cfg:       cfg,
 		sessionId: sessionId,
 		store:     store,
 		handler:   handler,
+		unmatched: map[string]struct{}{},
 	}
 }
 
-func (c Replay) HandleRequest(ctx context.Context, req *downloader.Request, meta downloader.RequestMetadata) (*downloader.Response, error) {
+// Unmatched returns the keys of the requests that were dropped in the ReplayOnly mode because they
+// did not have a stored response, requests that are not replayed by the ReplayHandler are
+// represented as "<method> <url>".
+func (c *Replay) Unmatched() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]string, 0, len(c.unmatched))
+	for key := range c.unmatched {
+		out = append(out, key)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (c *Replay) miss(ctx context.Context, key string) error {
+	c.mu.Lock()
+	c.unmatched[key] = struct{}{}
+	c.mu.Unlock()
+
+	scavenge.LoggerFromContext(ctx).Warn("replay", "no stored response", "key", key)
+	scavenge.StatsFromContext(ctx).Inc("replay", "unmatched", 1)
+	return downloader.DroppedRequest(fmt.Errorf("replay: no stored response for '%s'", key))
+}
+
+func (c *Replay) HandleRequest(ctx context.Context, req *downloader.Request, meta downloader.RequestMetadata) (*downloader.Response, error) {
 	logger := scavenge.LoggerFromContext(ctx)
 	key, replay := c.handler(ctx, req, meta)
 	if !replay {
+		if c.cfg.mode == ReplayOnly {
+			return nil, c.miss(ctx, req.Method+" "+req.Url.String())
+		}
+		return nil, nil
+	}
+	if c.cfg.mode == ReplayRecord {
+		return nil, nil
+	}
+	if downloader.GetCacheControl(req).NoCache && c.cfg.mode != ReplayOnly {
 		return nil, nil
 	}
+	if c.cfg.maxAge > 0 && c.cfg.mode != ReplayOnly {
+		entry, ok := c.store.(ManagedReplayStore).Stat(ctx, c.sessionId, key)
+		if ok && time.Since(entry.Stored) > c.cfg.maxAge {
+			logger.Debug("replay", "stored response expired", "key", key, "stored", entry.Stored)
+			scavenge.StatsFromContext(ctx).Inc("replay", "expired", 1)
+			return nil, nil
+		}
+	}
 	res := c.store.Get(ctx, c.sessionId, key)
 	if res == nil {
+		if c.cfg.mode == ReplayOnly {
+			return nil, c.miss(ctx, key)
+		}
 		return nil, nil
 	}
 	logger.Debug("replay", "replaying response", "key", key)
-	return res, nil
+	// the stored response is for the request that was stored, not this one
+	return downloader.NewResponse(req, res.Status(), res.Url(), res.Headers(), res.RawBody()), nil
 }
 
-func (c Replay) HandleResponse(
+func (c *Replay) HandleResponse(
 	ctx context.Context,
 	res *downloader.Response,
 	meta downloader.ResponseMetadata,
-) error {
+) (*downloader.Response, error) {
+	if meta.Replayed || downloader.GetCacheControl(res.Request()).NoStore {
+		return nil, nil
+	}
 	key, replay := c.handler(ctx, res.Request(), meta.RequestMetadata)
 	if !replay {
-		return nil
+		return nil, nil
 	}
 	c.store.Set(ctx, c.sessionId, key, res)
-	return nil
+	return nil, nil
 }
@@ -7,14 +7,11 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
-	"os"
-	"path/filepath"
+	"reflect"
 	"sync"
+	"time"
 
-	"github.com/LQR471814/scavenge"
 	"github.com/LQR471814/scavenge/downloader"
-
-	"github.com/zeebo/xxh3"
 )
 
 // ReplayStore is an abstract interface various cache storing mechanism can implement to be able to be
@@ -26,6 +23,31 @@ type ReplayStore interface {
 	Set(ctx context.Context, session, id string, res *downloader.Response)
 }
 
+// ReplayEntry describes a stored response.
+type ReplayEntry struct {
+	Key    string
+	Stored time.Time
+}
+
+// ManagedReplayStore is a ReplayStore whose entries can be inspected, listed and deleted.
+type ManagedReplayStore interface {
+	ReplayStore
+	// Stat should return false if a stored request with the given id does not yet exist.
+	Stat(ctx context.Context, session, id string) (ReplayEntry, bool)
+	Delete(ctx context.Context, session, id string)
+	List(ctx context.Context, session string) ([]ReplayEntry, error)
+}
+
+type memoryReplayKey struct {
+	session string
+	id      string
+}
+
+type memoryReplayEntry struct {
+	res    *downloader.Response
+	stored time.Time
+}
+
 // MemoryReplayStore implements CacheStore with an in-memory [sync.Map]
 type MemoryReplayStore struct {
 	store sync.Map
@@ -38,16 +60,15 @@ func NewMemoryReplayStore() *MemoryReplayStore {
 }
 
 func (s *MemoryReplayStore) Get(ctx context.Context, session, id string) *downloader.Response {
-	v, ok := s.store.Load(session + id)
+	v, ok := s.store.Load(memoryReplayKey{session: session, id: id})
 	if !ok {
 		return nil
 	}
-	res := v.(*downloader.Response)
-	return res
+	return v.(memoryReplayEntry).res
 }
 
 func (s *MemoryReplayStore) Has(ctx context.Context, session, id string) bool {
-	_, ok := s.store.Load(session + id)
+	_, ok := s.store.Load(memoryReplayKey{session: session, id: id})
 	if !ok {
 		return false
 	}
@@ -55,7 +76,35 @@ func (s *MemoryReplayStore) Has(ctx context.Context, session, id string) bool {
 }
 
 func (s *MemoryReplayStore) Set(ctx context.Context, session, id string, res *downloader.Response) {
-	s.store.Store(session+id, res)
+	s.store.Store(memoryReplayKey{session: session, id: id}, memoryReplayEntry{
+		res:    res,
+		stored: time.Now(),
+	})
+}
+
+func (s *MemoryReplayStore) Stat(ctx context.Context, session, id string) (ReplayEntry, bool) {
+	v, ok := s.store.Load(memoryReplayKey{session: session, id: id})
+	if !ok {
+		return ReplayEntry{}, false
+	}
+	return ReplayEntry{Key: id, Stored: v.(memoryReplayEntry).stored}, true
+}
+
+func (s *MemoryReplayStore) Delete(ctx context.Context, session, id string) {
+	s.store.Delete(memoryReplayKey{session: session, id: id})
+}
+
+func (s *MemoryReplayStore) List(ctx context.Context, session string) ([]ReplayEntry, error) {
+	var entries []ReplayEntry
+	s.store.Range(func(key, value any) bool {
+		k := key.(memoryReplayKey)
+		if k.session != session {
+			return true
+		}
+		entries = append(entries, ReplayEntry{Key: k.id, Stored: value.(memoryReplayEntry).stored})
+		return true
+	})
+	return entries, nil
 }
 
 // MetaEncoder takes in an any value used as an element in request metadata and serializes it.
@@ -69,7 +118,30 @@ type MetaEncoder interface {
 	Unmarshal(buff []byte) (any, error)
 }
 
+// gobMetaTypes are the types registered with NewGobMetaEncoder.
+var gobMetaTypes sync.Map
+
+// gobSkippedMetaTypes are the types of the metadata of the downloader and the built-in middleware,
+// they only control how a request is downloaded so they are not serialized.
+var gobSkippedMetaTypes = map[reflect.Type]struct{}{
+	reflect.TypeFor[downloader.SkipMiddleware]():  {},
+	reflect.TypeFor[downloader.Timeout]():         {},
+	reflect.TypeFor[downloader.DontFilter]():      {},
+	reflect.TypeFor[downloader.AllowStatus]():     {},
+	reflect.TypeFor[downloader.RedirectCookies](): {},
+	reflect.TypeFor[downloader.HeaderOrder]():     {},
+	reflect.TypeFor[downloader.CacheControl]():    {},
+	reflect.TypeFor[Session]():                    {},
+	reflect.TypeFor[originalCookieHeader]():       {},
+	reflect.TypeFor[httpCacheRevalidation]():      {},
+	reflect.TypeFor[authRetry]():                  {},
+	reflect.TypeFor[headerProfileApplied]():       {},
+}
+
 // GobMetaEncoder implements MetaEncoder using [encoding/gob].
+//
+// Only the metadata with a type registered with NewGobMetaEncoder is serialized, the metadata of
+// the downloader and the built-in middleware is skipped and Marshal fails for other metadata.
 type GobMetaEncoder struct{}
 
 // NewGobMetaEncoder creates a MetaEncoder that uses [encoding/gob], all
@@ -78,6 +150,7 @@ type GobMetaEncoder struct{}
 func NewGobMetaEncoder(types ...any) GobMetaEncoder {
 	for _, t := range types {
 		gob.Register(t)
+		gobMetaTypes.Store(reflect.TypeOf(t), struct{}{})
 
 		// test if all types can be serialized and deserialized with gob
 		buff := bytes.NewBuffer(nil)
@@ -97,6 +170,14 @@ func NewGobMetaEncoder(types ...any) GobMetaEncoder {
 }
 
 func (GobMetaEncoder) Marshal(meta any) ([]byte, error) {
+	t := reflect.TypeOf(meta)
+	if _, skipped := gobSkippedMetaTypes[t]; skipped {
+		return nil, nil
+	}
+	_, registered := gobMetaTypes.Load(t)
+	if !registered {
+		return nil, fmt.Errorf("gob meta encoder: type %v is not registered with NewGobMetaEncoder", t)
+	}
 	w := bytes.NewBuffer(nil)
 	enc := gob.NewEncoder(w)
 	err := enc.Encode(&meta)
@@ -117,17 +198,43 @@ func (GobMetaEncoder) Unmarshal(buff []byte) (any, error) {
 	return out, nil
 }
 
+// rawRequest is the serialized form of a downloader.Request, it is separate from
+// downloader.Request so that changes to downloader.Request do not break stored responses.
+type rawRequest struct {
+	Method  string
+	Url     string
+	Headers http.Header
+	Body    []byte
+}
+
+// rawResponse is the serialized form of a downloader.Response.
 type rawResponse struct {
+	Key         string
+	Stored      time.Time
 	Status      int
-	Request     downloader.Request
+	Request     rawRequest
 	RequestMeta [][]byte
-	Url         *url.URL
+	Url         string
 	Headers     http.Header
 	Body        []byte
 }
 
 func (r rawResponse) Response(menc MetaEncoder) (*downloader.Response, error) {
-	req := &r.Request
+	reqUrl, err := url.Parse(r.Request.Url)
+	if err != nil {
+		return nil, fmt.Errorf("parse request url: %w", err)
+	}
+	resUrl, err := url.Parse(r.Url)
+	if err != nil {
+		return nil, fmt.Errorf("parse response url: %w", err)
+	}
+
+	req := &downloader.Request{
+		Method:  r.Request.Method,
+		Url:     reqUrl,
+		Headers: r.Request.Headers,
+		Body:    r.Request.Body,
+	}
 	for _, buff := range r.RequestMeta {
 		rmeta, err := menc.Unmarshal(buff)
 		if err != nil {
@@ -135,10 +242,10 @@ func (r rawResponse) Response(menc MetaEncoder) (*downloader.Response, error) {
 		}
 		req.AddMeta(rmeta)
 	}
-	return downloader.NewResponse(req, r.Status, r.Url, r.Headers, r.Body), nil
+	return downloader.NewResponse(req, r.Status, resUrl, r.Headers, r.Body), nil
 }
 
-func newRawResponse(r *downloader.Response, menc MetaEncoder) (rawResponse, error) {
+func newRawResponse(key string, r *downloader.Response, menc MetaEncoder) (rawResponse, error) {
 	meta := r.Request().Meta()
 	var serialized [][]byte
 	for _, e := range meta {
@@ -151,106 +258,20 @@ func newRawResponse(r *downloader.Response, menc MetaEncoder) (rawResponse, erro
 		}
 		serialized = append(serialized, marshalled)
 	}
+	req := r.Request()
 	return rawResponse{
-		Status:      r.Status(),
-		Request:     *r.Request(),
+		Key:    key,
+		Stored: time.Now(),
+		Status: r.Status(),
+		Request: rawRequest{
+			Method:  req.Method,
+			Url:     req.Url.String(),
+			Headers: req.Headers,
+			Body:    req.Body,
+		},
 		RequestMeta: serialized,
-		Url:         r.Url(),
+		Url:         r.Url().String(),
 		Headers:     r.Headers(),
 		Body:        r.RawBody(),
 	}, nil
 }
-
-// FSReplayStore implements CacheStore with the local filesystem.
-type FSReplayStore struct {
-	dir  string
-	menc MetaEncoder
-}
-
-func NewFSReplayStore(dir string, menc MetaEncoder) FSReplayStore {
-	if menc == nil {
-		panic("a valid implementation of MetaEncoder must be given. use middleware.GobMetaEncoder if basic serialization with encoding/gob is all you need for your use case")
-	}
-	return FSReplayStore{dir: dir, menc: menc}
-}
-
-func (s FSReplayStore) filepath(session, id string) (dir string) {
-	filename := fmt.Sprint(xxh3.Hash([]byte(id)))
-	path := filepath.Join(s.dir, session, filename)
-	return path
-}
-
-func (s FSReplayStore) Get(ctx context.Context, session, id string) *downloader.Response {
-	logger := scavenge.LoggerFromContext(ctx)
-
-	path := s.filepath(session, id)
-	f, err := os.Open(path)
-	if os.IsNotExist(err) {
-		return nil
-	}
-	if err != nil {
-		logger.Warn("fs_cache_store", "open file", "path", path, "err", err)
-		return nil
-	}
-	defer f.Close()
-
-	decoder := gob.NewDecoder(f)
-	rr := rawResponse{}
-	err = decoder.Decode(&rr)
-	if err != nil {
-		logger.Warn("fs_cache_store", "decode response", "path", path, "err", err)
-		return nil
-	}
-
-	res, err := rr.Response(s.menc)
-	if err != nil {
-		logger.Warn("fs_cache_store", "decode response", "path", path, "err", err)
-		return nil
-	}
-	return res
-}
-
-func (s FSReplayStore) Has(ctx context.Context, session, id string) bool {
-	logger := scavenge.LoggerFromContext(ctx)
-	path := s.filepath(session, id)
-	_, err := os.Stat(path)
-	if os.IsNotExist(err) {
-		return false
-	}
-	if err != nil {
-		logger.Warn("fs_cache_store", "stat file", "path", path, "err", err)
-		return false
-	}
-	return true
-}
-
-func (s FSReplayStore) Set(ctx context.Context, session, id string, res *downloader.Response) {
-	logger := scavenge.LoggerFromContext(ctx)
-
-	dir := filepath.Join(s.dir, session)
-	err := os.MkdirAll(dir, 0777)
-	if err != nil {
-		logger.Warn("fs_cache_store", "make session dir", "dir", dir, "err", err)
-		return
-	}
-
-	path := s.filepath(session, id)
-	f, err := os.Create(path)
-	if err != nil {
-		logger.Warn("fs_cache_store", "open file for writing", "path", path, "err", err)
-		return
-	}
-	defer f.Close()
-
-	rawres, err := newRawResponse(res, s.menc)
-	if err != nil {
-		logger.Warn("fs_cache_store", "encode response", "path", path, "err", err)
-		return
-	}
-
-	encoder := gob.NewEncoder(f)
-	err = encoder.Encode(rawres)
-	if err != nil {
-		logger.Warn("fs_cache_store", "encode response", "path", path, "err", err)
-	}
-}
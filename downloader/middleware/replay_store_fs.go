@@ -0,0 +1,496 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/LQR471814/scavenge"
+	"github.com/LQR471814/scavenge/downloader"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/zeebo/xxh3"
+)
+
+// ReplayCompression is the compression used for stored responses.
+type ReplayCompression byte
+
+const (
+	ReplayCompressionNone ReplayCompression = 0
+	ReplayCompressionGzip ReplayCompression = 1
+	ReplayCompressionZstd ReplayCompression = 2
+)
+
+func (c ReplayCompression) String() string {
+	switch c {
+	case ReplayCompressionNone:
+		return "none"
+	case ReplayCompressionGzip:
+		return "gzip"
+	case ReplayCompressionZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(c))
+}
+
+func (c ReplayCompression) writer(w io.Writer) (io.WriteCloser, error) {
+	switch c {
+	case ReplayCompressionNone:
+		return nopWriteCloser{w}, nil
+	case ReplayCompressionGzip:
+		return gzip.NewWriter(w), nil
+	case ReplayCompressionZstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unknown compression %v", c)
+}
+
+func (c ReplayCompression) reader(r io.Reader) (io.ReadCloser, error) {
+	switch c {
+	case ReplayCompressionNone:
+		return io.NopCloser(r), nil
+	case ReplayCompressionGzip:
+		return gzip.NewReader(r)
+	case ReplayCompressionZstd:
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unknown compression %v", c)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// The FSReplayStore file format (version 1) is:
+//
+//	magic "SCVR" | version (1 byte) | compression (1 byte) | header length (uint32, little endian) |
+//	gob encoded fsReplayHeader | compressed gob encoded rawResponse
+//
+// Files without the magic are from before the format was versioned (version 0) and contain only a
+// gob encoded legacyRawResponse.
+var fsReplayMagic = []byte("SCVR")
+
+const fsReplayVersion = 1
+
+// fsReplayHeader is stored uncompressed before the response so that it can be read without
+// reading the whole response.
+type fsReplayHeader struct {
+	Key    string
+	Stored time.Time
+}
+
+// legacyRequest is downloader.Request as it was when version 0 files were written, it is a copy so
+// that changes to downloader.Request do not break reading them.
+type legacyRequest struct {
+	Method         string
+	Url            *url.URL
+	Headers        http.Header
+	Body           []byte
+	DirectBody     io.Reader
+	DirectResponse bool
+}
+
+// legacyRawResponse is the format of version 0 files, which encoded downloader.Request directly
+// and did not store the key nor the time the response was stored.
+type legacyRawResponse struct {
+	Status      int
+	Request     legacyRequest
+	RequestMeta [][]byte
+	Url         *url.URL
+	Headers     http.Header
+	Body        []byte
+}
+
+func (r legacyRawResponse) upgrade() rawResponse {
+	reqUrl := ""
+	if r.Request.Url != nil {
+		reqUrl = r.Request.Url.String()
+	}
+	resUrl := ""
+	if r.Url != nil {
+		resUrl = r.Url.String()
+	}
+	return rawResponse{
+		Status: r.Status,
+		Request: rawRequest{
+			Method:  r.Request.Method,
+			Url:     reqUrl,
+			Headers: r.Request.Headers,
+			Body:    r.Request.Body,
+		},
+		RequestMeta: r.RequestMeta,
+		Url:         resUrl,
+		Headers:     r.Headers,
+		Body:        r.Body,
+	}
+}
+
+// fsReplayFile describes the format a file was stored with.
+type fsReplayFile struct {
+	version     int
+	compression ReplayCompression
+	header      fsReplayHeader
+}
+
+type fsReplayOption = func(s *FSReplayStore)
+
+// WithFSReplayCompression sets the compression used for newly stored responses, responses stored
+// with a different compression can still be read.
+func WithFSReplayCompression(compression ReplayCompression) fsReplayOption {
+	return func(s *FSReplayStore) {
+		s.compression = compression
+	}
+}
+
+// FSReplayStore implements CacheStore with the local filesystem.
+//
+// Each response is stored in its own versioned file, files are written to a temporary file
+// first and then renamed so that a crash cannot leave a partially written response behind.
+type FSReplayStore struct {
+	dir         string
+	menc        MetaEncoder
+	compression ReplayCompression
+}
+
+func NewFSReplayStore(dir string, menc MetaEncoder, options ...fsReplayOption) FSReplayStore {
+	if menc == nil {
+		panic("a valid implementation of MetaEncoder must be given. use middleware.GobMetaEncoder if basic serialization with encoding/gob is all you need for your use case")
+	}
+	s := FSReplayStore{dir: dir, menc: menc}
+	for _, o := range options {
+		o(&s)
+	}
+	return s
+}
+
+func (s FSReplayStore) filepath(session, id string) (dir string) {
+	filename := fmt.Sprint(xxh3.Hash([]byte(id)))
+	path := filepath.Join(s.dir, session, filename)
+	return path
+}
+
+// readFSReplayFile reads the file at the given path, if headerOnly is true and the file is not
+// a legacy file, the response is not read.
+func readFSReplayFile(path string, headerOnly bool) (fsReplayFile, rawResponse, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return fsReplayFile{}, rawResponse{}, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	prefix, err := r.Peek(len(fsReplayMagic) + 2)
+	if err != nil || !bytes.Equal(prefix[:len(fsReplayMagic)], fsReplayMagic) {
+		legacy := legacyRawResponse{}
+		err = gob.NewDecoder(r).Decode(&legacy)
+		if err != nil {
+			return fsReplayFile{}, rawResponse{}, fmt.Errorf("decode legacy response: %w", err)
+		}
+		return fsReplayFile{version: 0}, legacy.upgrade(), nil
+	}
+
+	info := fsReplayFile{
+		version:     int(prefix[len(fsReplayMagic)]),
+		compression: ReplayCompression(prefix[len(fsReplayMagic)+1]),
+	}
+	if info.version > fsReplayVersion {
+		return fsReplayFile{}, rawResponse{}, fmt.Errorf("unsupported version %d", info.version)
+	}
+	_, err = r.Discard(len(prefix))
+	if err != nil {
+		return fsReplayFile{}, rawResponse{}, err
+	}
+
+	var headerLen uint32
+	err = binary.Read(r, binary.LittleEndian, &headerLen)
+	if err != nil {
+		return fsReplayFile{}, rawResponse{}, fmt.Errorf("read header length: %w", err)
+	}
+	header := make([]byte, headerLen)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return fsReplayFile{}, rawResponse{}, fmt.Errorf("read header: %w", err)
+	}
+	err = gob.NewDecoder(bytes.NewReader(header)).Decode(&info.header)
+	if err != nil {
+		return fsReplayFile{}, rawResponse{}, fmt.Errorf("decode header: %w", err)
+	}
+	if headerOnly {
+		return info, rawResponse{}, nil
+	}
+
+	zr, err := info.compression.reader(r)
+	if err != nil {
+		return fsReplayFile{}, rawResponse{}, fmt.Errorf("decompress response: %w", err)
+	}
+	defer zr.Close()
+	rr := rawResponse{}
+	err = gob.NewDecoder(zr).Decode(&rr)
+	if err != nil {
+		return fsReplayFile{}, rawResponse{}, fmt.Errorf("decode response: %w", err)
+	}
+	return info, rr, nil
+}
+
+// writeFSReplayFile atomically writes the response to the given path in the current version.
+func writeFSReplayFile(path string, rr rawResponse, compression ReplayCompression) error {
+	var header bytes.Buffer
+	err := gob.NewEncoder(&header).Encode(fsReplayHeader{Key: rr.Key, Stored: rr.Stored})
+	if err != nil {
+		return fmt.Errorf("encode header: %w", err)
+	}
+
+	// temporary files start with "." so they are not mistaken for stored responses
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	err = func() error {
+		w := bufio.NewWriter(f)
+		_, err := w.Write(fsReplayMagic)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write([]byte{fsReplayVersion, byte(compression)})
+		if err != nil {
+			return err
+		}
+		err = binary.Write(w, binary.LittleEndian, uint32(header.Len()))
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(header.Bytes())
+		if err != nil {
+			return err
+		}
+
+		zw, err := compression.writer(w)
+		if err != nil {
+			return err
+		}
+		err = gob.NewEncoder(zw).Encode(rr)
+		if err != nil {
+			return fmt.Errorf("encode response: %w", err)
+		}
+		err = zw.Close()
+		if err != nil {
+			return err
+		}
+		err = w.Flush()
+		if err != nil {
+			return err
+		}
+		return f.Sync()
+	}()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (s FSReplayStore) Get(ctx context.Context, session, id string) *downloader.Response {
+	logger := scavenge.LoggerFromContext(ctx)
+
+	path := s.filepath(session, id)
+	_, rr, err := readFSReplayFile(path, false)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		logger.Warn("fs_cache_store", "read file", "path", path, "err", err)
+		return nil
+	}
+
+	res, err := rr.Response(s.menc)
+	if err != nil {
+		logger.Warn("fs_cache_store", "decode response", "path", path, "err", err)
+		return nil
+	}
+	return res
+}
+
+func (s FSReplayStore) Has(ctx context.Context, session, id string) bool {
+	logger := scavenge.LoggerFromContext(ctx)
+	path := s.filepath(session, id)
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false
+	}
+	if err != nil {
+		logger.Warn("fs_cache_store", "stat file", "path", path, "err", err)
+		return false
+	}
+	return true
+}
+
+func (s FSReplayStore) Set(ctx context.Context, session, id string, res *downloader.Response) {
+	logger := scavenge.LoggerFromContext(ctx)
+
+	dir := filepath.Join(s.dir, session)
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		logger.Warn("fs_cache_store", "make session dir", "dir", dir, "err", err)
+		return
+	}
+
+	path := s.filepath(session, id)
+	rawres, err := newRawResponse(id, res, s.menc)
+	if err != nil {
+		logger.Warn("fs_cache_store", "encode response", "path", path, "err", err)
+		return
+	}
+	err = writeFSReplayFile(path, rawres, s.compression)
+	if err != nil {
+		logger.Warn("fs_cache_store", "write file", "path", path, "err", err)
+	}
+}
+
+// Stat reads the header of the stored response to find the time it was stored (which is kept
+// when the response is migrated), the modification time of the file is used for responses stored
+// without it.
+func (s FSReplayStore) Stat(ctx context.Context, session, id string) (ReplayEntry, bool) {
+	logger := scavenge.LoggerFromContext(ctx)
+	path := s.filepath(session, id)
+	info, _, err := readFSReplayFile(path, true)
+	if os.IsNotExist(err) {
+		return ReplayEntry{}, false
+	}
+	if err != nil {
+		logger.Warn("fs_cache_store", "read file", "path", path, "err", err)
+		return ReplayEntry{}, false
+	}
+	stored := info.header.Stored
+	if stored.IsZero() {
+		fileInfo, err := os.Stat(path)
+		if err != nil {
+			logger.Warn("fs_cache_store", "stat file", "path", path, "err", err)
+			return ReplayEntry{}, false
+		}
+		stored = fileInfo.ModTime()
+	}
+	return ReplayEntry{Key: id, Stored: stored}, true
+}
+
+func (s FSReplayStore) Delete(ctx context.Context, session, id string) {
+	logger := scavenge.LoggerFromContext(ctx)
+	path := s.filepath(session, id)
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		logger.Warn("fs_cache_store", "remove file", "path", path, "err", err)
+	}
+}
+
+// sessionFiles returns the paths of all the stored responses in a session.
+func (s FSReplayStore) sessionFiles(session string) ([]string, error) {
+	dir := filepath.Join(s.dir, session)
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("list session dir: %w", err)
+	}
+	var paths []string
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		paths = append(paths, filepath.Join(dir, file.Name()))
+	}
+	return paths, nil
+}
+
+// List reads the header of every stored response in the session to find its key, responses
+// stored before keys were stored with them cannot be listed and are skipped.
+func (s FSReplayStore) List(ctx context.Context, session string) ([]ReplayEntry, error) {
+	logger := scavenge.LoggerFromContext(ctx)
+
+	paths, err := s.sessionFiles(session)
+	if err != nil {
+		return nil, err
+	}
+	var entries []ReplayEntry
+	for _, path := range paths {
+		info, _, err := readFSReplayFile(path, true)
+		if err != nil {
+			logger.Warn("fs_cache_store", "read file", "path", path, "err", err)
+			continue
+		}
+		if info.header.Key == "" {
+			logger.Debug("fs_cache_store", "skipping response without key", "path", path)
+			continue
+		}
+		entries = append(entries, ReplayEntry{Key: info.header.Key, Stored: info.header.Stored})
+	}
+	return entries, nil
+}
+
+// Migrate rewrites all the responses in the session that are stored in an older version of the
+// format or with a different compression than the store's, it returns the amount of responses
+// that were rewritten.
+func (s FSReplayStore) Migrate(ctx context.Context, session string) (int, error) {
+	logger := scavenge.LoggerFromContext(ctx)
+
+	paths, err := s.sessionFiles(session)
+	if err != nil {
+		return 0, err
+	}
+	migrated := 0
+	for _, path := range paths {
+		info, _, err := readFSReplayFile(path, true)
+		if err != nil {
+			logger.Warn("fs_cache_store", "read file", "path", path, "err", err)
+			continue
+		}
+		if info.version == fsReplayVersion && info.compression == s.compression {
+			continue
+		}
+		_, rr, err := readFSReplayFile(path, false)
+		if err != nil {
+			logger.Warn("fs_cache_store", "read file", "path", path, "err", err)
+			continue
+		}
+		// responses stored without the time they were stored keep the age given by the
+		// modification time of their file
+		if rr.Stored.IsZero() {
+			fileInfo, err := os.Stat(path)
+			if err != nil {
+				logger.Warn("fs_cache_store", "stat file", "path", path, "err", err)
+				continue
+			}
+			rr.Stored = fileInfo.ModTime()
+		}
+		err = writeFSReplayFile(path, rr, s.compression)
+		if err != nil {
+			return migrated, fmt.Errorf("migrate '%s': %w", path, err)
+		}
+		migrated++
+	}
+	return migrated, nil
+}
@@ -0,0 +1,159 @@
+package middleware
+
+import (
+	"encoding/gob"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/LQR471814/scavenge/downloader"
+)
+
+func TestFSReplayStoreCompressions(t *testing.T) {
+	ctx, _ := testContext()
+	menc := NewGobMetaEncoder(testStoredMeta{})
+	dir := t.TempDir()
+
+	for _, compression := range []ReplayCompression{ReplayCompressionNone, ReplayCompressionGzip, ReplayCompressionZstd} {
+		t.Run(compression.String(), func(t *testing.T) {
+			store := NewFSReplayStore(dir, menc, WithFSReplayCompression(compression))
+			store.Set(ctx, compression.String(), "key", testStoredResponse())
+			checkStoredResponse(t, store.Get(ctx, compression.String(), "key"))
+
+			// responses can be read regardless of the compression of the store
+			other := NewFSReplayStore(dir, menc, WithFSReplayCompression(ReplayCompressionGzip))
+			checkStoredResponse(t, other.Get(ctx, compression.String(), "key"))
+		})
+	}
+}
+
+// baselineRequest and baselineRawResponse are the types version 0 files were written with.
+type baselineRequest struct {
+	Method         string
+	Url            *url.URL
+	Headers        http.Header
+	Body           []byte
+	DirectBody     io.Reader
+	DirectResponse bool
+}
+
+type baselineRawResponse struct {
+	Status      int
+	Request     baselineRequest
+	RequestMeta [][]byte
+	Url         *url.URL
+	Headers     http.Header
+	Body        []byte
+}
+
+// writeLegacyFSReplayFile writes a response in the version 0 format, with the given modification
+// time.
+func writeLegacyFSReplayFile(t *testing.T, store FSReplayStore, session, id string, modified time.Time) {
+	t.Helper()
+	path := store.filepath(session, id)
+	err := os.MkdirAll(filepath.Dir(path), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := store.menc.Marshal(testStoredMeta{Page: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = gob.NewEncoder(f).Encode(baselineRawResponse{
+		Status: 200,
+		Request: baselineRequest{
+			Method:  http.MethodGet,
+			Url:     downloader.MustParseUrl("https://example.com/page?q=1"),
+			Headers: http.Header{"Accept": {"text/html"}},
+		},
+		RequestMeta: [][]byte{meta},
+		Url:         downloader.MustParseUrl("https://example.com/final"),
+		Headers:     http.Header{"Content-Type": {"text/html"}},
+		Body:        []byte("body"),
+	})
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(path, modified, modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFSReplayStoreMigrate(t *testing.T) {
+	ctx, _ := testContext()
+	store := NewFSReplayStore(t.TempDir(), NewGobMetaEncoder(testStoredMeta{}), WithFSReplayCompression(ReplayCompressionZstd))
+	modified := time.Now().Add(-48 * time.Hour).Round(0)
+	writeLegacyFSReplayFile(t, store, "s", "legacy", modified)
+	store.Set(ctx, "s", "current", testStoredResponse())
+
+	checkStoredResponse(t, store.Get(ctx, "s", "legacy"))
+	entry, ok := store.Stat(ctx, "s", "legacy")
+	if !ok || !entry.Stored.Equal(modified) {
+		t.Fatalf("expected the modification time of the legacy response, got %v", entry.Stored)
+	}
+
+	migrated, err := store.Migrate(ctx, "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != 1 {
+		t.Fatalf("expected only the legacy response to be migrated, got %d", migrated)
+	}
+	info, _, err := readFSReplayFile(store.filepath("s", "legacy"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.version != fsReplayVersion || info.compression != ReplayCompressionZstd {
+		t.Fatalf("expected the current format, got version %d with %v", info.version, info.compression)
+	}
+	checkStoredResponse(t, store.Get(ctx, "s", "legacy"))
+
+	// migrating a response does not reset its age
+	entry, ok = store.Stat(ctx, "s", "legacy")
+	if !ok || !entry.Stored.Equal(modified) {
+		t.Fatalf("expected the modified time to be kept after migrating, got %v", entry.Stored)
+	}
+	entries, err := store.List(ctx, "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// version 0 files did not store the key of the response, so it cannot be listed
+	if len(entries) != 1 || entries[0].Key != "current" {
+		t.Fatalf("expected only the response with a key to be listed, got %v", entries)
+	}
+
+	migrated, err = store.Migrate(ctx, "s")
+	if err != nil || migrated != 0 {
+		t.Fatalf("expected nothing to be migrated again, got %d %v", migrated, err)
+	}
+}
+
+func TestFSReplayStoreIgnoresTemporaryFiles(t *testing.T) {
+	ctx, _ := testContext()
+	store := NewFSReplayStore(t.TempDir(), NewGobMetaEncoder(testStoredMeta{}))
+	store.Set(ctx, "s", "key", testStoredResponse())
+
+	tmp := filepath.Join(filepath.Dir(store.filepath("s", "key")), ".123.tmp-456")
+	err := os.WriteFile(tmp, []byte("partial"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := store.List(ctx, "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Key != "key" {
+		t.Fatalf("expected only the stored response to be listed, got %v", entries)
+	}
+}
@@ -0,0 +1,558 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/LQR471814/scavenge"
+	"github.com/LQR471814/scavenge/downloader"
+)
+
+// replayLogMagic identifies a LogReplayStore file and the version of its format.
+var replayLogMagic = []byte("SCVLOG01")
+
+const (
+	replayLogSet    byte = 1
+	replayLogDelete byte = 2
+
+	// crc32 (4) + kind (1) + stored (8) + session len (4) + id len (4) + value len (4)
+	replayLogHeaderSize = 25
+)
+
+// replayLogRecord is a single record in the log, value is a gzip compressed gob encoded
+// rawResponse for set records and empty for delete records.
+type replayLogRecord struct {
+	kind    byte
+	stored  time.Time
+	session string
+	id      string
+	value   []byte
+}
+
+func (r replayLogRecord) size() int64 {
+	return int64(replayLogHeaderSize + len(r.session) + len(r.id) + len(r.value))
+}
+
+func (r replayLogRecord) encode() []byte {
+	buff := make([]byte, r.size())
+	buff[4] = r.kind
+	binary.LittleEndian.PutUint64(buff[5:], uint64(r.stored.UnixNano()))
+	binary.LittleEndian.PutUint32(buff[13:], uint32(len(r.session)))
+	binary.LittleEndian.PutUint32(buff[17:], uint32(len(r.id)))
+	binary.LittleEndian.PutUint32(buff[21:], uint32(len(r.value)))
+	n := replayLogHeaderSize
+	n += copy(buff[n:], r.session)
+	n += copy(buff[n:], r.id)
+	copy(buff[n:], r.value)
+	binary.LittleEndian.PutUint32(buff, crc32.ChecksumIEEE(buff[4:]))
+	return buff
+}
+
+var errReplayLogCorrupt = errors.New("corrupt record")
+
+// plausibleReplayLogHeader reports whether the given record header could be valid for a record
+// that has at most remaining bytes left in the file.
+func plausibleReplayLogHeader(header []byte, remaining int64) bool {
+	if header[4] != replayLogSet && header[4] != replayLogDelete {
+		return false
+	}
+	length := int64(replayLogHeaderSize) +
+		int64(binary.LittleEndian.Uint32(header[13:])) +
+		int64(binary.LittleEndian.Uint32(header[17:])) +
+		int64(binary.LittleEndian.Uint32(header[21:]))
+	return length <= remaining
+}
+
+// readReplayLogRecord reads a record with at most remaining bytes left in the file, the lengths
+// in the header are checked before anything is allocated for them.
+func readReplayLogRecord(r io.Reader, remaining int64) (replayLogRecord, error) {
+	header := make([]byte, replayLogHeaderSize)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return replayLogRecord{}, err
+	}
+	if !plausibleReplayLogHeader(header, remaining) {
+		return replayLogRecord{}, errReplayLogCorrupt
+	}
+	sessionLen := binary.LittleEndian.Uint32(header[13:])
+	idLen := binary.LittleEndian.Uint32(header[17:])
+	valueLen := binary.LittleEndian.Uint32(header[21:])
+
+	rest := make([]byte, int(sessionLen)+int(idLen)+int(valueLen))
+	_, err = io.ReadFull(r, rest)
+	if err != nil {
+		return replayLogRecord{}, err
+	}
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(rest)
+	if crc.Sum32() != binary.LittleEndian.Uint32(header) {
+		return replayLogRecord{}, errReplayLogCorrupt
+	}
+
+	return replayLogRecord{
+		kind:    header[4],
+		stored:  time.Unix(0, int64(binary.LittleEndian.Uint64(header[5:]))),
+		session: string(rest[:sessionLen]),
+		id:      string(rest[sessionLen : sessionLen+idLen]),
+		value:   rest[sessionLen+idLen:],
+	}, nil
+}
+
+type replayLogEntry struct {
+	// offset is the offset of the value of the record in the file.
+	offset int64
+	length int
+	stored time.Time
+}
+
+// replayLog is the file of a LogReplayStore.
+type replayLog struct {
+	path  string
+	mu    sync.RWMutex
+	file  *os.File
+	end   int64
+	index map[memoryReplayKey]replayLogEntry
+	// garbage is the amount of bytes used by records that have been overwritten or deleted.
+	garbage int64
+	// corrupt is the amount of bytes of corrupt records that were skipped when loading the log.
+	corrupt int64
+}
+
+// openReplayLog opens the log at the given path, creating it if it does not exist, a truncated
+// or corrupt tail (ex. from a crash in the middle of a write) is discarded and corrupt records
+// in the middle of the file are skipped.
+func openReplayLog(path string) (*replayLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	l := &replayLog{
+		path:  path,
+		file:  f,
+		index: map[memoryReplayKey]replayLogEntry{},
+	}
+	err = l.load()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *replayLog) load() error {
+	info, err := l.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		_, err = l.file.WriteAt(replayLogMagic, 0)
+		if err != nil {
+			return fmt.Errorf("write magic: %w", err)
+		}
+		l.end = int64(len(replayLogMagic))
+		return nil
+	}
+
+	size := info.Size()
+	magic := make([]byte, len(replayLogMagic))
+	_, err = l.file.ReadAt(magic, 0)
+	if err != nil || !bytes.Equal(magic, replayLogMagic) {
+		return fmt.Errorf("'%s' is not a replay log", l.path)
+	}
+
+	offset := int64(len(magic))
+	for offset < size {
+		r := io.NewSectionReader(l.file, offset, size-offset)
+		record, err := readReplayLogRecord(r, size-offset)
+		if err == nil {
+			l.apply(record, offset)
+			offset += record.size()
+			continue
+		}
+
+		next, err := l.resync(offset, size)
+		if err != nil {
+			return fmt.Errorf("resync: %w", err)
+		}
+		if next < 0 {
+			// discard the incomplete record at the end
+			err = l.file.Truncate(offset)
+			if err != nil {
+				return fmt.Errorf("truncate corrupt tail: %w", err)
+			}
+			break
+		}
+		// the corrupt bytes are removed when the log is compacted
+		l.corrupt += next - offset
+		l.garbage += next - offset
+		offset = next
+	}
+	l.end = offset
+	return nil
+}
+
+// resync returns the offset of the first valid record after the corrupt record at the given
+// offset, or -1 if there are no valid records after it.
+func (l *replayLog) resync(offset, size int64) (int64, error) {
+	start := offset + 1
+	r := bufio.NewReader(io.NewSectionReader(l.file, start, size-start))
+	for pos := start; size-pos >= replayLogHeaderSize; pos++ {
+		header, err := r.Peek(replayLogHeaderSize)
+		if err != nil {
+			return 0, err
+		}
+		if plausibleReplayLogHeader(header, size-pos) {
+			_, err = readReplayLogRecord(io.NewSectionReader(l.file, pos, size-pos), size-pos)
+			if err == nil {
+				return pos, nil
+			}
+		}
+		_, err = r.Discard(1)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return -1, nil
+}
+
+// apply updates the index with a record written at the given offset.
+func (l *replayLog) apply(record replayLogRecord, offset int64) {
+	key := memoryReplayKey{session: record.session, id: record.id}
+	old, ok := l.index[key]
+	if ok {
+		l.garbage += int64(replayLogHeaderSize+len(key.session)+len(key.id)) + int64(old.length)
+	}
+
+	switch record.kind {
+	case replayLogSet:
+		l.index[key] = replayLogEntry{
+			offset: offset + record.size() - int64(len(record.value)),
+			length: len(record.value),
+			stored: record.stored,
+		}
+	case replayLogDelete:
+		delete(l.index, key)
+		l.garbage += record.size()
+	}
+}
+
+func (l *replayLog) append(record replayLogRecord) error {
+	encoded := record.encode()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, err := l.file.WriteAt(encoded, l.end)
+	if err != nil {
+		return err
+	}
+	l.apply(record, l.end)
+	l.end += int64(len(encoded))
+	return nil
+}
+
+func (l *replayLog) read(session, id string) ([]byte, replayLogEntry, bool, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	entry, ok := l.index[memoryReplayKey{session: session, id: id}]
+	if !ok {
+		return nil, replayLogEntry{}, false, nil
+	}
+	value := make([]byte, entry.length)
+	_, err := l.file.ReadAt(value, entry.offset)
+	if err != nil {
+		return nil, replayLogEntry{}, false, err
+	}
+	return value, entry, true, nil
+}
+
+// renameFile is os.Rename, it is replaced in tests.
+var renameFile = os.Rename
+
+// compact rewrites the log with only the records that are still live.
+func (l *replayLog) compact() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	keys := make([]memoryReplayKey, 0, len(l.index))
+	for key := range l.index {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(a, b int) bool {
+		return l.index[keys[a]].offset < l.index[keys[b]].offset
+	})
+
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".compact-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	_, err = w.Write(replayLogMagic)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	for _, key := range keys {
+		entry := l.index[key]
+		value := make([]byte, entry.length)
+		_, err = l.file.ReadAt(value, entry.offset)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		_, err = w.Write(replayLogRecord{
+			kind:    replayLogSet,
+			stored:  entry.stored,
+			session: key.session,
+			id:      key.id,
+			value:   value,
+		}.encode())
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	// the compacted file is opened before it replaces the log and the log is only closed once it
+	// has been replaced, so the log is kept as is if anything fails
+	compacted, err := os.OpenFile(tmp.Name(), os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	err = renameFile(tmp.Name(), l.path)
+	if err != nil {
+		compacted.Close()
+		return err
+	}
+	l.file.Close()
+	l.file = compacted
+	l.index = map[memoryReplayKey]replayLogEntry{}
+	l.garbage = 0
+	l.corrupt = 0
+	return l.load()
+}
+
+func (l *replayLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.file.Sync()
+	if err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// CompactReplayLog compacts the LogReplayStore file at the given path.
+//
+// Note: the file must not be in use by a LogReplayStore at the same time.
+func CompactReplayLog(path string) (before, after int64, err error) {
+	l, err := openReplayLog(path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("compact replay log: %w", err)
+	}
+	before = l.end
+	err = l.compact()
+	if err != nil {
+		l.close()
+		return 0, 0, fmt.Errorf("compact replay log: %w", err)
+	}
+	after = l.end
+	err = l.close()
+	if err != nil {
+		return 0, 0, fmt.Errorf("compact replay log: %w", err)
+	}
+	return before, after, nil
+}
+
+// LogReplayStore implements ManagedReplayStore with a single append-only file, responses are
+// compressed with gzip.
+//
+// Overwritten and deleted responses still take up space in the file until it is compacted with
+// Compact or [CompactReplayLog].
+//
+// Corrupt records are skipped when the file is opened (see Corrupt), an incomplete record at the
+// end of the file (ex. from a crash in the middle of a write) is discarded.
+//
+// It is safe to use from multiple download workers, but not from multiple processes.
+type LogReplayStore struct {
+	log  *replayLog
+	menc MetaEncoder
+}
+
+// NewLogReplayStore opens (or creates) the LogReplayStore file at the given path.
+func NewLogReplayStore(path string, menc MetaEncoder) (*LogReplayStore, error) {
+	if menc == nil {
+		panic("a valid implementation of MetaEncoder must be given. use middleware.GobMetaEncoder if basic serialization with encoding/gob is all you need for your use case")
+	}
+	l, err := openReplayLog(path)
+	if err != nil {
+		return nil, fmt.Errorf("open replay log: %w", err)
+	}
+	return &LogReplayStore{log: l, menc: menc}, nil
+}
+
+// Compact rewrites the file without overwritten and deleted responses, all other operations
+// wait for it to finish.
+func (s *LogReplayStore) Compact() error {
+	err := s.log.compact()
+	if err != nil {
+		return fmt.Errorf("compact replay log: %w", err)
+	}
+	return nil
+}
+
+// Garbage returns the amount of bytes that would be freed by compacting the file.
+func (s *LogReplayStore) Garbage() int64 {
+	s.log.mu.RLock()
+	defer s.log.mu.RUnlock()
+	return s.log.garbage
+}
+
+// Corrupt returns the amount of bytes of corrupt records that were skipped when the file was
+// opened, they are removed by compacting the file.
+func (s *LogReplayStore) Corrupt() int64 {
+	s.log.mu.RLock()
+	defer s.log.mu.RUnlock()
+	return s.log.corrupt
+}
+
+// Close flushes and closes the file.
+func (s *LogReplayStore) Close() error {
+	return s.log.close()
+}
+
+func (s *LogReplayStore) Get(ctx context.Context, session, id string) *downloader.Response {
+	logger := scavenge.LoggerFromContext(ctx)
+
+	value, _, ok, err := s.log.read(session, id)
+	if err != nil {
+		logger.Warn("log_replay_store", "read record", "path", s.log.path, "err", err)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(value))
+	if err != nil {
+		logger.Warn("log_replay_store", "decompress response", "path", s.log.path, "err", err)
+		return nil
+	}
+	rr := rawResponse{}
+	err = gob.NewDecoder(zr).Decode(&rr)
+	if err != nil {
+		logger.Warn("log_replay_store", "decode response", "path", s.log.path, "err", err)
+		return nil
+	}
+	res, err := rr.Response(s.menc)
+	if err != nil {
+		logger.Warn("log_replay_store", "decode response", "path", s.log.path, "err", err)
+		return nil
+	}
+	return res
+}
+
+func (s *LogReplayStore) Has(ctx context.Context, session, id string) bool {
+	_, ok := s.Stat(ctx, session, id)
+	return ok
+}
+
+func (s *LogReplayStore) Set(ctx context.Context, session, id string, res *downloader.Response) {
+	logger := scavenge.LoggerFromContext(ctx)
+
+	rawres, err := newRawResponse(id, res, s.menc)
+	if err != nil {
+		logger.Warn("log_replay_store", "encode response", "path", s.log.path, "err", err)
+		return
+	}
+	var buff bytes.Buffer
+	zw := gzip.NewWriter(&buff)
+	err = gob.NewEncoder(zw).Encode(rawres)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		logger.Warn("log_replay_store", "encode response", "path", s.log.path, "err", err)
+		return
+	}
+
+	err = s.log.append(replayLogRecord{
+		kind:    replayLogSet,
+		stored:  rawres.Stored,
+		session: session,
+		id:      id,
+		value:   buff.Bytes(),
+	})
+	if err != nil {
+		logger.Warn("log_replay_store", "append record", "path", s.log.path, "err", err)
+	}
+}
+
+func (s *LogReplayStore) Stat(ctx context.Context, session, id string) (ReplayEntry, bool) {
+	s.log.mu.RLock()
+	defer s.log.mu.RUnlock()
+	entry, ok := s.log.index[memoryReplayKey{session: session, id: id}]
+	if !ok {
+		return ReplayEntry{}, false
+	}
+	return ReplayEntry{Key: id, Stored: entry.stored}, true
+}
+
+func (s *LogReplayStore) Delete(ctx context.Context, session, id string) {
+	if !s.Has(ctx, session, id) {
+		return
+	}
+	err := s.log.append(replayLogRecord{
+		kind:    replayLogDelete,
+		stored:  time.Now(),
+		session: session,
+		id:      id,
+	})
+	if err != nil {
+		scavenge.LoggerFromContext(ctx).Warn("log_replay_store", "append record", "path", s.log.path, "err", err)
+	}
+}
+
+func (s *LogReplayStore) List(ctx context.Context, session string) ([]ReplayEntry, error) {
+	s.log.mu.RLock()
+	defer s.log.mu.RUnlock()
+	var entries []ReplayEntry
+	for key, entry := range s.log.index {
+		if key.session != session {
+			continue
+		}
+		entries = append(entries, ReplayEntry{Key: key.id, Stored: entry.stored})
+	}
+	return entries, nil
+}
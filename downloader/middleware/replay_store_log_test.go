@@ -0,0 +1,175 @@
+package middleware
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestLogStore(t *testing.T, path string) *LogReplayStore {
+	t.Helper()
+	store, err := NewLogReplayStore(path, NewGobMetaEncoder(testStoredMeta{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func appendToFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogReplayStorePersists(t *testing.T) {
+	ctx, _ := testContext()
+	path := filepath.Join(t.TempDir(), "replay.log")
+
+	store := openTestLogStore(t, path)
+	store.Set(ctx, "s", "a", testStoredResponse())
+	store.Set(ctx, "s", "a", testStoredResponse())
+	store.Set(ctx, "s", "b", testStoredResponse())
+	store.Delete(ctx, "s", "b")
+	if store.Garbage() == 0 {
+		t.Fatal("expected overwritten and deleted responses to be garbage")
+	}
+	err := store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := fileSize(t, path)
+	_, after, err := CompactReplayLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after >= before {
+		t.Fatalf("expected compaction to shrink the file, %d -> %d", before, after)
+	}
+
+	store = openTestLogStore(t, path)
+	checkStoredResponse(t, store.Get(ctx, "s", "a"))
+	if store.Has(ctx, "s", "b") || store.Garbage() != 0 {
+		t.Fatal("expected only the live responses to be kept")
+	}
+}
+
+func TestLogReplayStoreTruncatedTail(t *testing.T) {
+	ctx, _ := testContext()
+	path := filepath.Join(t.TempDir(), "replay.log")
+
+	store := openTestLogStore(t, path)
+	store.Set(ctx, "s", "a", testStoredResponse())
+	store.Close()
+	size := fileSize(t, path)
+
+	// an incomplete record, and a header claiming a value far larger than the file
+	record := replayLogRecord{kind: replayLogSet, session: "s", id: "b", value: []byte("value")}.encode()
+	appendToFile(t, path, record[:len(record)-2])
+	store = openTestLogStore(t, path)
+	checkStoredResponse(t, store.Get(ctx, "s", "a"))
+	store.Close()
+	if fileSize(t, path) != size {
+		t.Fatalf("expected the incomplete record to be discarded, size %d -> %d", size, fileSize(t, path))
+	}
+
+	header := make([]byte, replayLogHeaderSize)
+	header[4] = replayLogSet
+	binary.LittleEndian.PutUint32(header[21:], 0xffffffff)
+	appendToFile(t, path, header)
+	store = openTestLogStore(t, path)
+	checkStoredResponse(t, store.Get(ctx, "s", "a"))
+	if store.Corrupt() != 0 {
+		t.Fatal("expected an incomplete tail to not be counted as corrupt")
+	}
+	store.Close()
+	if fileSize(t, path) != size {
+		t.Fatalf("expected the invalid record to be discarded, size %d -> %d", size, fileSize(t, path))
+	}
+}
+
+func TestLogReplayStoreCorruptRecord(t *testing.T) {
+	ctx, _ := testContext()
+	path := filepath.Join(t.TempDir(), "replay.log")
+
+	store := openTestLogStore(t, path)
+	store.Set(ctx, "s", "a", testStoredResponse())
+	store.Set(ctx, "s", "b", testStoredResponse())
+	store.Close()
+
+	// corrupt the value of the first record
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, int64(len(replayLogMagic)+replayLogHeaderSize+10))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store = openTestLogStore(t, path)
+	if store.Has(ctx, "s", "a") {
+		t.Fatal("expected the corrupt record to be skipped")
+	}
+	checkStoredResponse(t, store.Get(ctx, "s", "b"))
+	if store.Corrupt() == 0 {
+		t.Fatal("expected the corrupt record to be reported")
+	}
+
+	err = store.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.Corrupt() != 0 {
+		t.Fatal("expected compaction to remove the corrupt record")
+	}
+	checkStoredResponse(t, store.Get(ctx, "s", "b"))
+}
+
+func TestLogReplayStoreFailedCompaction(t *testing.T) {
+	ctx, _ := testContext()
+	path := filepath.Join(t.TempDir(), "replay.log")
+	store := openTestLogStore(t, path)
+	store.Set(ctx, "s", "a", testStoredResponse())
+	store.Set(ctx, "s", "a", testStoredResponse())
+
+	renameFile = func(oldpath, newpath string) error {
+		return errors.New("rename failed")
+	}
+	defer func() { renameFile = os.Rename }()
+	err := store.Compact()
+	if err == nil {
+		t.Fatal("expected the compaction to fail")
+	}
+
+	// the store keeps using the original file
+	checkStoredResponse(t, store.Get(ctx, "s", "a"))
+	store.Set(ctx, "s", "b", testStoredResponse())
+	err = store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = openTestLogStore(t, path)
+	checkStoredResponse(t, store.Get(ctx, "s", "a"))
+	checkStoredResponse(t, store.Get(ctx, "s", "b"))
+}
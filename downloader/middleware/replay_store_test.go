@@ -0,0 +1,183 @@
+package middleware
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LQR471814/scavenge/downloader"
+)
+
+type testStoredMeta struct {
+	Page int
+}
+
+// testStoredResponse returns a response whose request has both registered and unregistered
+// (ex. internal to middleware) metadata.
+func testStoredResponse() *downloader.Response {
+	req := testGET("https://example.com/page?q=1")
+	req.SetHeader("Accept", "text/html")
+	req.AddMeta(testStoredMeta{Page: 3})
+	req.AddMeta(Session{Name: "unregistered"})
+	req.AddMeta(originalCookieHeader{value: "a=1"})
+	req.AddMeta(downloader.DontFilter{})
+
+	headers := http.Header{}
+	headers.Set("Content-Type", "text/html")
+	return downloader.NewResponse(req, 200, downloader.MustParseUrl("https://example.com/final"), headers, []byte("body"))
+}
+
+// checkStoredResponse checks that a response stored with testStoredResponse was restored.
+func checkStoredResponse(t *testing.T, res *downloader.Response) {
+	t.Helper()
+	if res == nil {
+		t.Fatal("expected a stored response")
+	}
+	if res.Status() != 200 || string(res.RawBody()) != "body" || res.Url().String() != "https://example.com/final" {
+		t.Fatalf("unexpected response: %d %s '%s'", res.Status(), res.Url(), res.RawBody())
+	}
+	if res.Headers().Get("Content-Type") != "text/html" {
+		t.Fatalf("unexpected headers: %v", res.Headers())
+	}
+	req := res.Request()
+	if req.Url.String() != "https://example.com/page?q=1" || req.Headers.Get("Accept") != "text/html" {
+		t.Fatalf("unexpected request: %s %v", req.Url, req.Headers)
+	}
+	meta, ok := downloader.GetRequestMeta[testStoredMeta](req)
+	if !ok || meta.Page != 3 {
+		t.Fatalf("expected the registered meta to be restored, got %v", req.Meta())
+	}
+	if len(req.Meta()) != 1 {
+		t.Fatalf("expected only the registered meta to be stored, got %v", req.Meta())
+	}
+}
+
+func TestGobMetaEncoderRegisteredTypes(t *testing.T) {
+	menc := NewGobMetaEncoder(testStoredMeta{})
+
+	out, err := menc.Marshal(originalCookieHeader{value: "a=1"})
+	if err != nil || len(out) != 0 {
+		t.Fatalf("expected the meta of a middleware to be skipped, got %v %v", out, err)
+	}
+	out, err = menc.Marshal(downloader.DontFilter{})
+	if err != nil || len(out) != 0 {
+		t.Fatalf("expected the meta of the downloader to be skipped, got %v %v", out, err)
+	}
+	_, err = menc.Marshal(struct{ Page int }{Page: 1})
+	if err == nil {
+		t.Fatal("expected an error for meta of an unregistered type")
+	}
+
+	out, err = menc.Marshal(testStoredMeta{Page: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := menc.Unmarshal(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.(testStoredMeta).Page != 1 {
+		t.Fatalf("unexpected decoded meta %v", decoded)
+	}
+}
+
+func TestMemoryReplayStore(t *testing.T) {
+	ctx, _ := testContext()
+	store := NewMemoryReplayStore()
+	res := testResponse(testGET("https://example.com"), 200)
+
+	if store.Has(ctx, "s", "a") || store.Get(ctx, "s", "a") != nil {
+		t.Fatal("expected an empty store")
+	}
+	store.Set(ctx, "s", "a", res)
+	if !store.Has(ctx, "s", "a") || store.Get(ctx, "s", "a") != res {
+		t.Fatal("expected the stored response")
+	}
+	if store.Has(ctx, "other", "a") {
+		t.Fatal("expected sessions to be separate")
+	}
+}
+
+func TestPersistentStoresSkipUnregisteredMeta(t *testing.T) {
+	ctx, _ := testContext()
+	menc := NewGobMetaEncoder(testStoredMeta{})
+
+	logStore, err := NewLogReplayStore(t.TempDir()+"/replay.log", menc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logStore.Close()
+
+	stores := map[string]ReplayStore{
+		"fs":  NewFSReplayStore(t.TempDir(), menc),
+		"log": logStore,
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			store.Set(ctx, "s", "key", testStoredResponse())
+			checkStoredResponse(t, store.Get(ctx, "s", "key"))
+		})
+	}
+}
+
+func TestManagedReplayStores(t *testing.T) {
+	ctx, _ := testContext()
+	menc := NewGobMetaEncoder(testStoredMeta{})
+
+	logStore, err := NewLogReplayStore(t.TempDir()+"/replay.log", menc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logStore.Close()
+
+	stores := map[string]ManagedReplayStore{
+		"memory": NewMemoryReplayStore(),
+		"fs":     NewFSReplayStore(t.TempDir(), menc),
+		"log":    logStore,
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			before := time.Now().Add(-time.Second)
+			store.Set(ctx, "s", "a", testStoredResponse())
+			store.Set(ctx, "s", "b", testStoredResponse())
+			store.Set(ctx, "other", "c", testStoredResponse())
+
+			entry, ok := store.Stat(ctx, "s", "a")
+			if !ok || entry.Key != "a" || entry.Stored.Before(before) || entry.Stored.After(time.Now()) {
+				t.Fatalf("unexpected entry %v %v", entry, ok)
+			}
+			if _, ok := store.Stat(ctx, "s", "missing"); ok {
+				t.Fatal("expected a missing entry to not be found")
+			}
+
+			listed := func() []string {
+				entries, err := store.List(ctx, "s")
+				if err != nil {
+					t.Fatal(err)
+				}
+				var keys []string
+				for _, e := range entries {
+					keys = append(keys, e.Key)
+				}
+				sort.Strings(keys)
+				return keys
+			}
+			if got := strings.Join(listed(), ","); got != "a,b" {
+				t.Fatalf("expected the entries of the session to be listed, got '%s'", got)
+			}
+
+			store.Delete(ctx, "s", "a")
+			if store.Has(ctx, "s", "a") || store.Get(ctx, "s", "a") != nil {
+				t.Fatal("expected the entry to be deleted")
+			}
+			if got := strings.Join(listed(), ","); got != "b" {
+				t.Fatalf("expected the deleted entry to not be listed, got '%s'", got)
+			}
+			if !store.Has(ctx, "other", "c") {
+				t.Fatal("expected the other session to be kept")
+			}
+		})
+	}
+}
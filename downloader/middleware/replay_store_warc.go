@@ -0,0 +1,342 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/LQR471814/scavenge"
+	"github.com/LQR471814/scavenge/downloader"
+)
+
+// warcLocation is the location of a record in a WARC file.
+type warcLocation struct {
+	path       string
+	offset     int64
+	compressed bool
+}
+
+func (l warcLocation) read() (warcRecord, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return warcRecord{}, err
+	}
+	defer f.Close()
+	_, err = f.Seek(l.offset, io.SeekStart)
+	if err != nil {
+		return warcRecord{}, err
+	}
+	if !l.compressed {
+		return readWARCRecord(bufio.NewReader(f))
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return warcRecord{}, err
+	}
+	defer zr.Close()
+	zr.Multistream(false)
+	return readWARCRecord(bufio.NewReader(zr))
+}
+
+// scanWARC calls fn with every record in the WARC file at the given path, the file can either
+// be uncompressed or compressed with a gzip member per record.
+func scanWARC(path string, fn func(loc warcLocation, rec warcRecord) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cr := &countingReader{r: bufio.NewReader(f)}
+	magic, err := cr.r.Peek(2)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	compressed := magic[0] == 0x1f && magic[1] == 0x8b
+
+	if !compressed {
+		for {
+			loc := warcLocation{path: path, offset: cr.n}
+			rec, err := readWARCRecord(cr)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("record at %d: %w", loc.offset, err)
+			}
+			err = fn(loc, rec)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	zr := &gzip.Reader{}
+	for {
+		loc := warcLocation{path: path, offset: cr.n, compressed: true}
+		err := zr.Reset(cr)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("record at %d: %w", loc.offset, err)
+		}
+		zr.Multistream(false)
+		rec, err := readWARCRecord(bufio.NewReader(zr))
+		if err != nil {
+			return fmt.Errorf("record at %d: %w", loc.offset, err)
+		}
+		// read the rest of the gzip member so the next one starts at the current offset
+		_, err = io.Copy(io.Discard, zr)
+		if err != nil {
+			return fmt.Errorf("record at %d: %w", loc.offset, err)
+		}
+		err = fn(loc, rec)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func isWARCHttp(rec warcRecord, msgtype string) bool {
+	contentType := strings.ToLower(strings.ReplaceAll(rec.get("Content-Type"), " ", ""))
+	return strings.HasPrefix(contentType, "application/http") &&
+		(!strings.Contains(contentType, "msgtype=") || strings.Contains(contentType, "msgtype="+msgtype))
+}
+
+func parseWARCRequest(rec warcRecord) (*downloader.Request, error) {
+	target, err := url.Parse(rec.get("WARC-Target-URI"))
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(rec.block)))
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(parsed.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &downloader.Request{
+		Method:  parsed.Method,
+		Url:     target,
+		Headers: parsed.Header,
+		Body:    body,
+	}, nil
+}
+
+func parseWARCResponse(rec warcRecord, req *downloader.Request) (*downloader.Response, error) {
+	parsed, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(rec.block)), nil)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(parsed.Body)
+	if err != nil {
+		return nil, err
+	}
+	// archives written by other tools keep the body as it was sent
+	headers, body, err := downloader.DecodeResponseBody(parsed.Header, body)
+	if err != nil {
+		return nil, err
+	}
+	resUrl := req.Url
+	target, err := url.Parse(rec.get("WARC-Target-URI"))
+	if err == nil && target.Host != "" {
+		resUrl = target
+	}
+	return downloader.NewResponse(req, parsed.StatusCode, resUrl, headers, body), nil
+}
+
+// warcRedirectLocation returns the location a response record redirects to.
+func warcRedirectLocation(rec warcRecord) (*url.URL, bool) {
+	parsed, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(rec.block)), nil)
+	if err != nil {
+		return nil, false
+	}
+	parsed.Body.Close()
+	if parsed.StatusCode < 300 || parsed.StatusCode >= 400 || parsed.StatusCode == http.StatusNotModified {
+		return nil, false
+	}
+	location := parsed.Header.Get("Location")
+	if location == "" {
+		return nil, false
+	}
+	target, err := url.Parse(rec.get("WARC-Target-URI"))
+	if err != nil {
+		return nil, false
+	}
+	next, err := target.Parse(location)
+	if err != nil {
+		return nil, false
+	}
+	return next, true
+}
+
+// maxWARCRedirects is the maximum amount of redirects followed within an archive.
+const maxWARCRedirects = 10
+
+type warcResponseEntry struct {
+	loc     warcLocation
+	request *downloader.Request
+}
+
+// WARCReplayStore is a read-only ReplayStore that serves the responses in existing WARC files
+// (like the ones written by WARCWriter).
+//
+// The files are indexed when the store is created, response records are paired with the request
+// record that is concurrent to them and keyed with the given ReplayHandler. When a response has
+// no request record, a GET request to its target uri is assumed. If multiple responses have the
+// same key, the last one is served. Bodies are decoded with downloader.DecodeResponseBody, so
+// responses from archives written by other tools are served like downloaded ones.
+//
+// Redirects are followed within the archive: when a response redirects to a target uri that has
+// a response in the archive, the request is served that response (with its target uri as the
+// url) like the client would have done.
+//
+// Sessions are ignored, every session sees the same responses. Set does nothing, so the store
+// should be used with ReplayOnly (or ReplayRecordMissing with requests missing from the archive
+// being downloaded every time).
+type WARCReplayStore struct {
+	index map[string]warcResponseEntry
+}
+
+func NewWARCReplayStore(ctx context.Context, handler ReplayHandler, paths ...string) (*WARCReplayStore, error) {
+	type response struct {
+		id           string
+		target       string
+		concurrentTo []string
+		loc          warcLocation
+		redirect     *url.URL
+	}
+	var responses []response
+	requests := map[string]*downloader.Request{}
+	// requestFor maps the id of a response to the id of the request concurrent to it.
+	requestFor := map[string]string{}
+
+	for _, path := range paths {
+		err := scanWARC(path, func(loc warcLocation, rec warcRecord) error {
+			id := rec.get("WARC-Record-ID")
+			switch rec.get("WARC-Type") {
+			case "request":
+				if !isWARCHttp(rec, "request") {
+					return nil
+				}
+				req, err := parseWARCRequest(rec)
+				if err != nil {
+					// records that are not valid http are skipped
+					return nil
+				}
+				requests[id] = req
+				for _, other := range rec.header.Values("WARC-Concurrent-To") {
+					requestFor[other] = id
+				}
+			case "response":
+				if !isWARCHttp(rec, "response") {
+					return nil
+				}
+				redirect, _ := warcRedirectLocation(rec)
+				responses = append(responses, response{
+					id:           id,
+					target:       rec.get("WARC-Target-URI"),
+					concurrentTo: rec.header.Values("WARC-Concurrent-To"),
+					loc:          loc,
+					redirect:     redirect,
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("warc replay store: '%s': %w", path, err)
+		}
+	}
+
+	// byTarget maps a target uri to the last response to it.
+	byTarget := map[string]int{}
+	for i, res := range responses {
+		byTarget[res.target] = i
+	}
+
+	store := &WARCReplayStore{index: map[string]warcResponseEntry{}}
+	for _, res := range responses {
+		req := requests[requestFor[res.id]]
+		for _, id := range res.concurrentTo {
+			if req != nil {
+				break
+			}
+			req = requests[id]
+		}
+		if req == nil {
+			target, err := url.Parse(res.target)
+			if err != nil {
+				continue
+			}
+			req = downloader.GETRequest(target)
+		}
+
+		key, replay := handler(ctx, req, downloader.RequestMetadata{})
+		if !replay {
+			continue
+		}
+		final := res
+		for range maxWARCRedirects {
+			if final.redirect == nil {
+				break
+			}
+			next, ok := byTarget[final.redirect.String()]
+			if !ok || responses[next].id == final.id {
+				break
+			}
+			final = responses[next]
+		}
+		store.index[key] = warcResponseEntry{loc: final.loc, request: req}
+	}
+	return store, nil
+}
+
+// Keys returns the keys of all the responses in the store.
+func (s *WARCReplayStore) Keys() []string {
+	keys := make([]string, 0, len(s.index))
+	for key := range s.index {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *WARCReplayStore) Has(ctx context.Context, session, id string) bool {
+	_, ok := s.index[id]
+	return ok
+}
+
+func (s *WARCReplayStore) Get(ctx context.Context, session, id string) *downloader.Response {
+	logger := scavenge.LoggerFromContext(ctx)
+
+	entry, ok := s.index[id]
+	if !ok {
+		return nil
+	}
+	rec, err := entry.loc.read()
+	if err != nil {
+		logger.Warn("warc_replay_store", "read record", "path", entry.loc.path, "offset", entry.loc.offset, "err", err)
+		return nil
+	}
+	res, err := parseWARCResponse(rec, entry.request)
+	if err != nil {
+		logger.Warn("warc_replay_store", "parse response", "path", entry.loc.path, "offset", entry.loc.offset, "err", err)
+		return nil
+	}
+	return res
+}
+
+func (s *WARCReplayStore) Set(ctx context.Context, session, id string, res *downloader.Response) {}
@@ -0,0 +1,206 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LQR471814/scavenge/downloader"
+)
+
+func TestReplayMaxAge(t *testing.T) {
+	ctx, stats := testContext()
+	store := NewMemoryReplayStore()
+	req := testGET("https://example.com/page")
+	_, err := NewReplay("s", store, ReplayGetRequests).HandleResponse(ctx, testResponse(req, 200), downloader.ResponseMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := NewReplay("s", store, ReplayGetRequests, WithReplayMaxAge(time.Hour)).
+		HandleRequest(ctx, testGET("https://example.com/page"), downloader.RequestMetadata{})
+	if err != nil || res == nil {
+		t.Fatalf("expected a response younger than the max age to be replayed, got %v", err)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	res, err = NewReplay("s", store, ReplayGetRequests, WithReplayMaxAge(time.Millisecond)).
+		HandleRequest(ctx, testGET("https://example.com/page"), downloader.RequestMetadata{})
+	if err != nil || res != nil {
+		t.Fatalf("expected a response older than the max age to be downloaded again, got %v %v", res, err)
+	}
+	if stats.Get("replay", "expired") != 1 {
+		t.Fatalf("expected 1 expired response, got %d", stats.Get("replay", "expired"))
+	}
+
+	res, err = NewReplay("s", store, ReplayGetRequests, WithReplayMaxAge(time.Millisecond), WithReplayMode(ReplayOnly)).
+		HandleRequest(ctx, testGET("https://example.com/page"), downloader.RequestMetadata{})
+	if err != nil || res == nil {
+		t.Fatalf("expected the max age to be ignored in the ReplayOnly mode, got %v", err)
+	}
+}
+
+func TestReplayMaxAgeRequiresManagedStore(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic")
+		}
+	}()
+	NewReplay("s", unmanagedReplayStore{}, ReplayGetRequests, WithReplayMaxAge(time.Hour))
+}
+
+// unmanagedReplayStore is a ReplayStore that is not a ManagedReplayStore.
+type unmanagedReplayStore struct {
+	ReplayStore
+}
+
+// testClient is a Client that responds to every request without making network requests, each
+// response body is the number of requests made so far.
+type testClient struct {
+	requests int
+}
+
+func (c *testClient) Do(ctx context.Context, req *downloader.Request) (*downloader.Response, error) {
+	c.requests++
+	return downloader.NewResponse(req, 200, req.Url, http.Header{}, []byte(fmt.Sprint(c.requests))), nil
+}
+
+func TestReplayModes(t *testing.T) {
+	ctx, _ := testContext()
+	store := NewMemoryReplayStore()
+	client := &testClient{}
+	download := func(mode ReplayMode, req *downloader.Request) (string, error) {
+		t.Helper()
+		dl := downloader.NewDownloader(client, NewReplay("s", store, ReplayGetRequests, WithReplayMode(mode)))
+		res, err := dl.Download(ctx, req, downloader.RequestMetadata{})
+		if err != nil {
+			return "", err
+		}
+		return string(res.RawBody()), nil
+	}
+	expect := func(body string, err error, expected string) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body != expected {
+			t.Fatalf("expected the response '%s', got '%s'", expected, body)
+		}
+	}
+
+	// record missing downloads and stores missing responses and replays stored ones
+	body, err := download(ReplayRecordMissing, testGET("https://example.com/a"))
+	expect(body, err, "1")
+	body, err = download(ReplayRecordMissing, testGET("https://example.com/a"))
+	expect(body, err, "1")
+
+	noCache := testGET("https://example.com/a")
+	noCache.SetMeta(downloader.CacheControl{NoCache: true})
+	body, err = download(ReplayRecordMissing, noCache)
+	expect(body, err, "2")
+
+	noStore := testGET("https://example.com/b")
+	noStore.SetMeta(downloader.CacheControl{NoStore: true})
+	body, err = download(ReplayRecordMissing, noStore)
+	expect(body, err, "3")
+	if store.Has(ctx, "s", "https://example.com/b") {
+		t.Fatal("expected a NoStore response to not be stored")
+	}
+
+	// record always downloads and replaces stored responses
+	body, err = download(ReplayRecord, testGET("https://example.com/a"))
+	expect(body, err, "4")
+	body, err = download(ReplayRecordMissing, testGET("https://example.com/a"))
+	expect(body, err, "4")
+
+	// replay only never downloads
+	replayOnly := NewReplay("s", store, ReplayGetRequests, WithReplayMode(ReplayOnly))
+	dl := downloader.NewDownloader(client, replayOnly)
+	res, err := dl.Download(ctx, testGET("https://example.com/a"), downloader.RequestMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(string(res.RawBody()), nil, "4")
+
+	for _, req := range []*downloader.Request{
+		testGET("https://example.com/missing"),
+		downloader.POSTRequest(downloader.MustParseUrl("https://example.com/a")),
+	} {
+		_, err = dl.Download(ctx, req, downloader.RequestMetadata{})
+		if err == nil || !strings.Contains(err.Error(), "dropped request") {
+			t.Fatalf("expected a request without a stored response to be dropped, got %v", err)
+		}
+	}
+	if client.requests != 4 {
+		t.Fatalf("expected no requests to be made in the ReplayOnly mode, got %d", client.requests-4)
+	}
+	expected := "POST https://example.com/a,https://example.com/missing"
+	if got := strings.Join(replayOnly.Unmatched(), ","); got != expected {
+		t.Fatalf("expected the unmatched requests '%s', got '%s'", expected, got)
+	}
+}
+
+func TestReplayedResponses(t *testing.T) {
+	ctx, stats := testContext()
+	stored := NewMemoryReplayStore()
+	_, err := NewReplay("s", stored, ReplayGetRequests).
+		HandleResponse(ctx, testResponse(testGET("https://example.com/page"), 200), downloader.ResponseMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	warc, err := NewWARCWriter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer warc.Close()
+	har := NewHAR(filepath.Join(dir, "out.har"))
+	harReplayed := NewHAR(filepath.Join(dir, "replayed.har"), WithHARReplayed())
+	outer := NewMemoryReplayStore()
+	client := &testClient{}
+	dl := downloader.NewDownloader(
+		client,
+		warc,
+		har,
+		harReplayed,
+		NewReplay("s", outer, ReplayGetRequests),
+		NewHTTPCache("s", outer, ReplayGetRequests, RFCCachePolicy{}),
+		NewReplay("s", stored, ReplayGetRequests),
+	)
+
+	req := testGET("https://example.com/page")
+	res, err := dl.Download(ctx, req, downloader.RequestMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.requests != 0 {
+		t.Fatal("expected the response to be replayed")
+	}
+	if res.Request() != req {
+		t.Fatal("expected the replayed response to be for the downloaded request")
+	}
+	if stats.Get("warc_writer", "records") != 0 || stats.Get("har", "entries") != 1 {
+		t.Fatal("expected only the archives that opted in to record the replayed response")
+	}
+	if outer.Has(ctx, "s", "https://example.com/page") || stats.Get("http_cache", "stored") != 0 {
+		t.Fatal("expected the replayed response to not be stored again")
+	}
+
+	warcReplayed, err := NewWARCWriter(t.TempDir(), WithWARCReplayed())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer warcReplayed.Close()
+	_, err = warcReplayed.HandleResponse(ctx, res, downloader.ResponseMetadata{Replayed: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Get("warc_writer", "records") != 2 {
+		t.Fatalf("expected the replayed response to be written with WithWARCReplayed, got %d records", stats.Get("warc_writer", "records"))
+	}
+}
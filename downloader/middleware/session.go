@@ -0,0 +1,17 @@
+package middleware
+
+import "github.com/LQR471814/scavenge/downloader"
+
+// Session is request metadata that identifies the session (ex. an account that is logged in) a
+// request belongs to, middleware that keep some identity for requests keep it separately for
+// each session.
+//
+// Requests without a Session belong to the default session (which has an empty name).
+type Session struct {
+	Name string
+}
+
+func requestSession(req *downloader.Request) string {
+	session, _ := downloader.GetRequestMeta[Session](req)
+	return session.Name
+}
@@ -0,0 +1,510 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LQR471814/scavenge"
+	"github.com/LQR471814/scavenge/downloader"
+)
+
+// https://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/
+const warcVersion = "WARC/1.1"
+
+// warcRecord is a single WARC record, header holds the named fields of the record.
+type warcRecord struct {
+	header textproto.MIMEHeader
+	block  []byte
+}
+
+func (r warcRecord) get(field string) string {
+	return r.header.Get(field)
+}
+
+// warcFieldOrder is the order the well-known fields are written in, other fields are written
+// after them in alphabetical order.
+var warcFieldOrder = []string{
+	"WARC-Type",
+	"WARC-Record-ID",
+	"WARC-Date",
+	"WARC-Target-URI",
+	"WARC-Concurrent-To",
+	"WARC-Warcinfo-ID",
+	"WARC-Filename",
+	"WARC-Block-Digest",
+	"WARC-Payload-Digest",
+	"Content-Type",
+	"Content-Length",
+}
+
+func (r warcRecord) encode() []byte {
+	var buff bytes.Buffer
+	buff.WriteString(warcVersion + "\r\n")
+
+	written := map[string]bool{}
+	writeField := func(name string) {
+		key := textproto.CanonicalMIMEHeaderKey(name)
+		if written[key] {
+			return
+		}
+		written[key] = true
+		for _, v := range r.header[key] {
+			buff.WriteString(name + ": " + v + "\r\n")
+		}
+	}
+	for _, name := range warcFieldOrder {
+		writeField(name)
+	}
+	var rest []string
+	for key := range r.header {
+		if !written[key] {
+			rest = append(rest, key)
+		}
+	}
+	sort.Strings(rest)
+	for _, key := range rest {
+		writeField(key)
+	}
+
+	buff.WriteString("\r\n")
+	buff.Write(r.block)
+	buff.WriteString("\r\n\r\n")
+	return buff.Bytes()
+}
+
+// warcReader is what WARC records are read from, it must not read ahead so that the offsets of
+// records can be known.
+type warcReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+func readWARCLine(r io.ByteReader) (string, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		if b == '\n' {
+			return strings.TrimSuffix(string(line), "\r"), nil
+		}
+		line = append(line, b)
+	}
+}
+
+// readWARCRecord reads a single record, it returns io.EOF if there are no more records.
+func readWARCRecord(r warcReader) (warcRecord, error) {
+	version := ""
+	for version == "" {
+		line, err := readWARCLine(r)
+		if err != nil {
+			return warcRecord{}, err
+		}
+		version = strings.TrimSpace(line)
+	}
+	if !strings.HasPrefix(version, "WARC/") {
+		return warcRecord{}, fmt.Errorf("invalid record version line '%s'", version)
+	}
+
+	rec := warcRecord{header: textproto.MIMEHeader{}}
+	for {
+		line, err := readWARCLine(r)
+		if err != nil {
+			return warcRecord{}, fmt.Errorf("read record header: %w", err)
+		}
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return warcRecord{}, fmt.Errorf("invalid record header line '%s'", line)
+		}
+		rec.header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	length, err := strconv.ParseInt(rec.get("Content-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return warcRecord{}, fmt.Errorf("invalid record Content-Length '%s'", rec.get("Content-Length"))
+	}
+	rec.block = make([]byte, length)
+	_, err = io.ReadFull(r, rec.block)
+	if err != nil {
+		return warcRecord{}, fmt.Errorf("read record block: %w", err)
+	}
+
+	// the block is followed by two newlines
+	for range 2 {
+		_, err = readWARCLine(r)
+		if err != nil && err != io.EOF {
+			return warcRecord{}, fmt.Errorf("read record end: %w", err)
+		}
+	}
+	return rec, nil
+}
+
+func warcDigest(data []byte) string {
+	sum := sha1.Sum(data)
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum[:])
+}
+
+func warcRecordId() string {
+	var b [16]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		panic(err)
+	}
+	// uuid version 4
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func warcDate(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// writeHTTPHeaders writes the headers in a stable order followed by the empty line.
+func writeHTTPHeaders(buff *bytes.Buffer, headers http.Header) {
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range headers[k] {
+			buff.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+	buff.WriteString("\r\n")
+}
+
+func encodeHTTPRequest(method string, u *url.URL, headers http.Header, body []byte) []byte {
+	var buff bytes.Buffer
+	buff.WriteString(method + " " + u.RequestURI() + " HTTP/1.1\r\n")
+	buff.WriteString("Host: " + u.Host + "\r\n")
+	headers = headers.Clone()
+	if headers == nil {
+		headers = http.Header{}
+	}
+	headers.Del("Host")
+	if len(body) > 0 {
+		headers.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	writeHTTPHeaders(&buff, headers)
+	buff.Write(body)
+	return buff.Bytes()
+}
+
+// encodeHTTPResponse returns the http response block and the offset of its payload.
+func encodeHTTPResponse(status int, headers http.Header, body []byte) ([]byte, int) {
+	var buff bytes.Buffer
+	buff.WriteString(fmt.Sprintf("HTTP/1.1 %d %s\r\n", status, http.StatusText(status)))
+	headers = headers.Clone()
+	if headers == nil {
+		headers = http.Header{}
+	}
+	// the body is stored as it was read by the client
+	headers.Del("Transfer-Encoding")
+	headers.Set("Content-Length", strconv.Itoa(len(body)))
+	writeHTTPHeaders(&buff, headers)
+	payloadOffset := buff.Len()
+	buff.Write(body)
+	return buff.Bytes(), payloadOffset
+}
+
+// warcExchange is a request and response pair that is written as a request and a response record.
+type warcExchange struct {
+	target        string
+	request       []byte
+	response      []byte
+	payloadOffset int
+}
+
+// warcExchanges returns the exchanges of a response, the redirects followed by the client are
+// written as their own exchanges before the exchange of the final response.
+func warcExchanges(res *downloader.Response) []warcExchange {
+	req := res.Request()
+	method, headers, body := req.Method, req.Headers, req.Body
+
+	var exchanges []warcExchange
+	for _, r := range res.Redirects() {
+		resBlock, payloadOffset := encodeHTTPResponse(r.Status, r.Headers, nil)
+		exchanges = append(exchanges, warcExchange{
+			target:        r.Url.String(),
+			request:       encodeHTTPRequest(method, r.Url, headers, body),
+			response:      resBlock,
+			payloadOffset: payloadOffset,
+		})
+		method, headers, body = followRedirect(r.Status, method, headers, body)
+	}
+
+	resBlock, payloadOffset := encodeHTTPResponse(res.Status(), res.Headers(), res.RawBody())
+	return append(exchanges, warcExchange{
+		target:        res.Url().String(),
+		request:       encodeHTTPRequest(method, res.Url(), headers, body),
+		response:      resBlock,
+		payloadOffset: payloadOffset,
+	})
+}
+
+type warcCfg struct {
+	prefix   string
+	maxSize  int64
+	replayed bool
+}
+
+type warcOption = func(cfg *warcCfg)
+
+// WithWARCPrefix sets the prefix of the names of the WARC files, by default it is "scavenge".
+func WithWARCPrefix(prefix string) warcOption {
+	return func(cfg *warcCfg) {
+		cfg.prefix = prefix
+	}
+}
+
+// WithWARCMaxSize sets the size in bytes after which a new WARC file is started, by default it
+// is 1 GB.
+func WithWARCMaxSize(size int64) warcOption {
+	return func(cfg *warcCfg) {
+		cfg.maxSize = size
+	}
+}
+
+// WithWARCReplayed also writes the responses returned by request middleware (ex. to archive the
+// responses of a ReplayStore), they are written as if they were downloaded again.
+func WithWARCReplayed() warcOption {
+	return func(cfg *warcCfg) {
+		cfg.replayed = true
+	}
+}
+
+// WARCWriter is a middleware that writes every request and response pair to WARC 1.1 files as
+// request and response records.
+//
+//   - The redirects followed by the client are written as their own request and response records
+//     (without the body of the redirect response), the records of the final response target its
+//     final url.
+//   - Every record is compressed as its own gzip member (.warc.gz), so records can be read
+//     individually.
+//   - Each file starts with a warcinfo record, files are rotated once they exceed the max size.
+//   - The body of a response is written as it was read by the client, so its Content-Length
+//     header is set to the length of the body and Transfer-Encoding is removed.
+//
+// Responses with a DirectBody and responses returned by request middleware (ex. replayed
+// responses, unless WithWARCReplayed is given) are not written. Close must be called once
+// scraping is done.
+type WARCWriter struct {
+	dir string
+	cfg warcCfg
+
+	mu        sync.Mutex
+	file      *os.File
+	filename  string
+	warcinfo  string
+	size      int64
+	fileCount int
+}
+
+func NewWARCWriter(dir string, options ...warcOption) (*WARCWriter, error) {
+	cfg := warcCfg{
+		prefix:  "scavenge",
+		maxSize: 1 << 30,
+	}
+	for _, o := range options {
+		o(&cfg)
+	}
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return nil, fmt.Errorf("warc writer: %w", err)
+	}
+	return &WARCWriter{dir: dir, cfg: cfg}, nil
+}
+
+// appendRecord writes the record as a gzip member, it must be called with the lock held.
+func (w *WARCWriter) appendRecord(rec warcRecord) error {
+	var buff bytes.Buffer
+	gz := gzip.NewWriter(&buff)
+	_, err := gz.Write(rec.encode())
+	if err != nil {
+		return err
+	}
+	err = gz.Close()
+	if err != nil {
+		return err
+	}
+	n, err := w.file.Write(buff.Bytes())
+	w.size += int64(n)
+	return err
+}
+
+// rotate closes the current file and starts a new one, it must be called with the lock held.
+func (w *WARCWriter) rotate() error {
+	if w.file != nil {
+		err := w.file.Close()
+		w.file = nil
+		if err != nil {
+			return err
+		}
+	}
+
+	w.fileCount++
+	w.filename = fmt.Sprintf(
+		"%s-%s-%05d.warc.gz",
+		w.cfg.prefix, time.Now().UTC().Format("20060102150405"), w.fileCount,
+	)
+	f, err := os.OpenFile(filepath.Join(w.dir, w.filename), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	w.file = f
+	w.size = 0
+
+	info := []byte(
+		"software: scavenge\r\n" +
+			"format: WARC File Format 1.1\r\n" +
+			"conformsTo: http://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/\r\n",
+	)
+	w.warcinfo = warcRecordId()
+	return w.appendRecord(warcRecord{
+		header: textproto.MIMEHeader{
+			"Warc-Type":      {"warcinfo"},
+			"Warc-Record-Id": {w.warcinfo},
+			"Warc-Date":      {warcDate(time.Now())},
+			"Warc-Filename":  {w.filename},
+			"Content-Type":   {"application/warc-fields"},
+			"Content-Length": {strconv.Itoa(len(info))},
+		},
+		block: info,
+	})
+}
+
+// write writes the records of the response, it returns the amount of records written.
+func (w *WARCWriter) write(res *downloader.Response) (int, error) {
+	now := time.Now()
+	exchanges := warcExchanges(res)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil || w.size >= w.cfg.maxSize {
+		err := w.rotate()
+		if err != nil {
+			return 0, fmt.Errorf("rotate: %w", err)
+		}
+	}
+
+	written := 0
+	for _, e := range exchanges {
+		resId := warcRecordId()
+		err := w.appendRecord(warcRecord{
+			header: textproto.MIMEHeader{
+				"Warc-Type":           {"response"},
+				"Warc-Record-Id":      {resId},
+				"Warc-Date":           {warcDate(now)},
+				"Warc-Target-Uri":     {e.target},
+				"Warc-Warcinfo-Id":    {w.warcinfo},
+				"Warc-Block-Digest":   {warcDigest(e.response)},
+				"Warc-Payload-Digest": {warcDigest(e.response[e.payloadOffset:])},
+				"Content-Type":        {"application/http;msgtype=response"},
+				"Content-Length":      {strconv.Itoa(len(e.response))},
+			},
+			block: e.response,
+		})
+		if err != nil {
+			return written, err
+		}
+		written++
+		err = w.appendRecord(warcRecord{
+			header: textproto.MIMEHeader{
+				"Warc-Type":          {"request"},
+				"Warc-Record-Id":     {warcRecordId()},
+				"Warc-Date":          {warcDate(now)},
+				"Warc-Target-Uri":    {e.target},
+				"Warc-Concurrent-To": {resId},
+				"Warc-Warcinfo-Id":   {w.warcinfo},
+				"Warc-Block-Digest":  {warcDigest(e.request)},
+				"Content-Type":       {"application/http;msgtype=request"},
+				"Content-Length":     {strconv.Itoa(len(e.request))},
+			},
+			block: e.request,
+		})
+		if err != nil {
+			return written, err
+		}
+		written++
+	}
+	return written, nil
+}
+
+func (w *WARCWriter) HandleRequest(ctx context.Context, req *downloader.Request, meta downloader.RequestMetadata) (*downloader.Response, error) {
+	return nil, nil
+}
+
+func (w *WARCWriter) HandleResponse(ctx context.Context, res *downloader.Response, meta downloader.ResponseMetadata) (*downloader.Response, error) {
+	if res.DirectBody() != nil || meta.Replayed && !w.cfg.replayed {
+		return nil, nil
+	}
+	written, err := w.write(res)
+	scavenge.StatsFromContext(ctx).Inc("warc_writer", "records", int64(written))
+	if err != nil {
+		// failing to archive a response should not fail the request
+		scavenge.LoggerFromContext(ctx).Error("warc_writer", "write records", "url", scavenge.ShortUrl(res.Url()), "err", err)
+	}
+	return nil, nil
+}
+
+// Close closes the current WARC file.
+func (w *WARCWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	if err != nil {
+		return fmt.Errorf("warc writer: %w", err)
+	}
+	return nil
+}
+
+// countingReader counts the bytes read from a bufio.Reader.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
@@ -0,0 +1,125 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/LQR471814/scavenge/downloader"
+)
+
+func TestWARCWriterRedirects(t *testing.T) {
+	ctx, stats := testContext()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/start":
+			http.Redirect(w, r, "/final", http.StatusFound)
+		case "/final":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("final"))
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	writer, err := NewWARCWriter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl := downloader.NewDownloader(downloader.NewHttpClient(http.DefaultClient), writer)
+	_, err = dl.Download(ctx, testGET(srv.URL+"/start"), downloader.RequestMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Get("warc_writer", "records") != 4 {
+		t.Fatalf("expected a request and response record per hop, got %d", stats.Get("warc_writer", "records"))
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.warc.gz"))
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("expected a single warc file, got %v %v", paths, err)
+	}
+	targets := map[string]int{}
+	err = scanWARC(paths[0], func(loc warcLocation, rec warcRecord) error {
+		if rec.get("WARC-Type") == "response" {
+			targets[rec.get("WARC-Target-URI")]++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if targets[srv.URL+"/start"] != 1 || targets[srv.URL+"/final"] != 1 {
+		t.Fatalf("expected a response record targeting each hop, got %v", targets)
+	}
+
+	store, err := NewWARCReplayStore(ctx, ReplayGetRequests, paths...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start, _ := ReplayGetRequests(ctx, testGET(srv.URL+"/start"), downloader.RequestMetadata{})
+	res := store.Get(ctx, "", start)
+	if res == nil {
+		t.Fatal("expected the redirected request to be replayed")
+	}
+	if string(res.RawBody()) != "final" || res.Status() != 200 {
+		t.Fatalf("expected the redirect to be followed within the archive, got %d '%s'", res.Status(), res.RawBody())
+	}
+	if res.Url().String() != srv.URL+"/final" || res.Request().Url.String() != srv.URL+"/start" {
+		t.Fatalf("expected the final url of the request, got %s for %s", res.Url(), res.Request().Url)
+	}
+
+	final, _ := ReplayGetRequests(ctx, testGET(srv.URL+"/final"), downloader.RequestMetadata{})
+	res = store.Get(ctx, "", final)
+	if res == nil || string(res.RawBody()) != "final" || res.Url().String() != srv.URL+"/final" {
+		t.Fatal("expected the final hop to be replayed on its own")
+	}
+}
+
+func TestWARCReplayStoreDecodesBodies(t *testing.T) {
+	ctx, _ := testContext()
+	dir := t.TempDir()
+	writer, err := NewWARCWriter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// archives written by other tools keep the encoding of the body
+	var encoded bytes.Buffer
+	gz := gzip.NewWriter(&encoded)
+	gz.Write([]byte("archived"))
+	gz.Close()
+	req := testGET("https://example.com/page")
+	res := downloader.NewResponse(req, 200, req.Url, http.Header{"Content-Encoding": {"gzip"}}, encoded.Bytes())
+	_, err = writer.HandleResponse(ctx, res, downloader.ResponseMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.warc.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewWARCReplayStore(ctx, ReplayGetRequests, paths...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed := store.Get(ctx, "", "https://example.com/page")
+	if replayed == nil {
+		t.Fatal("expected the response to be replayed")
+	}
+	if string(replayed.RawBody()) != "archived" || replayed.Headers().Get("Content-Encoding") != "" {
+		t.Fatalf("expected the body to be decoded, got '%s' %v", replayed.RawBody(), replayed.Headers())
+	}
+}
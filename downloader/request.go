@@ -14,6 +14,10 @@ type Request struct {
 	Headers http.Header
 	Body    []byte
 
+	// Proxy is the url of the proxy the request should be made through, if it is nil the
+	// client's default behavior is used.
+	Proxy *url.URL
+
 	// DirectBody should be used to pipe an [io.Reader] directly into an HTTP request's body,
 	// bypassing all external processing done by middleware or user code.
 	//
@@ -101,6 +105,19 @@ func (r *Request) AddMeta(value any) {
 	r.meta = append(r.meta, value)
 }
 
+// SetMeta replaces the first metadata value with the same type as the given value, if there
+// is no such value, it is added instead.
+func (r *Request) SetMeta(value any) {
+	t := reflect.TypeOf(value)
+	for i, e := range r.meta {
+		if reflect.TypeOf(e) == t {
+			r.meta[i] = value
+			return
+		}
+	}
+	r.meta = append(r.meta, value)
+}
+
 // GetRequestMeta finds the first value with type T according to the same rules as [items.CastItem]
 func GetRequestMeta[T any](r *Request) (T, bool) {
 	var tmp T
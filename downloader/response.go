@@ -3,11 +3,16 @@ package downloader
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"unicode/utf8"
 
 	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
 )
 
 // Response represents a standard HTTP response with some convenience methods.
@@ -19,6 +24,8 @@ type Response struct {
 	body    []byte
 
 	directBody io.Reader
+	timings    *Timings
+	redirects  []Redirect
 }
 
 func NewResponse(request *Request, status int, url *url.URL, headers http.Header, body []byte) *Response {
@@ -66,10 +73,27 @@ func (r *Response) ContentType() string {
 //
 // Middleware should not read from this field, as it is not certain that the reader
 // can be read from more than once.
+//
+// The DirectBody of a response made by HttpClient is an [io.ReadCloser] (ex. a decoded body),
+// it should be closed once it has been read.
 func (r *Response) DirectBody() io.Reader {
 	return r.directBody
 }
 
+// Timings returns the timings of the request made by HttpClient, it is nil for responses that
+// were not made by HttpClient (ex. replayed responses).
+//
+// Note: for responses with a DirectBody, Receive does not include reading the body.
+func (r *Response) Timings() *Timings {
+	return r.timings
+}
+
+// Redirects returns the redirects HttpClient followed before this response in the order they
+// were followed.
+func (r *Response) Redirects() []Redirect {
+	return r.redirects
+}
+
 // RawBody returns the raw body contents.
 func (r *Response) RawBody() []byte {
 	return r.body
@@ -80,7 +104,30 @@ func (r *Response) JsonBody(v any) error {
 	return json.Unmarshal(r.body, v)
 }
 
-// HtmlBody attempts to interpret the body as html and parse it into a [html.Node]
+// utf8Body returns a reader of the body converted to UTF-8.
+func (r *Response) utf8Body() io.Reader {
+	e, name, certain := charset.DetermineEncoding(r.body, r.ContentType())
+	// DetermineEncoding only looks at the start of the body to guess
+	if !certain && name == "windows-1252" && utf8.Valid(r.body) {
+		return bytes.NewReader(r.body)
+	}
+	// the BOM is not part of the text
+	return transform.NewReader(bytes.NewReader(r.body), unicode.BOMOverride(e.NewDecoder()))
+}
+
+// Text returns the body converted to UTF-8, the charset is detected from the BOM, the
+// `content-type` header and the <meta charset> of html bodies (in that order), otherwise it is
+// UTF-8 if the body is valid UTF-8 and windows-1252 if it is not.
+func (r *Response) Text() (string, error) {
+	text, err := io.ReadAll(r.utf8Body())
+	if err != nil {
+		return "", fmt.Errorf("charset: %w", err)
+	}
+	return string(text), nil
+}
+
+// HtmlBody attempts to interpret the body as html and parse it into a [html.Node], the body is
+// converted to UTF-8 like Text does.
 func (r *Response) HtmlBody() (*html.Node, error) {
-	return html.Parse(bytes.NewBuffer(r.body))
+	return html.Parse(r.utf8Body())
 }
@@ -0,0 +1,190 @@
+package downloader
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timings are the phases of the last round trip made for a response, phases that did not happen
+// (ex. dns and connecting when a connection was reused) are zero.
+type Timings struct {
+	// Start is when the client started getting a connection.
+	Start time.Time
+	// Blocked is the time spent waiting for a connection, excluding dns, connecting and tls.
+	Blocked time.Duration
+	DNS     time.Duration
+	Connect time.Duration
+	TLS     time.Duration
+	// Send is the time spent writing the request.
+	Send time.Duration
+	// Wait is the time between the request being written and the first byte of the response.
+	Wait time.Duration
+	// Receive is the time spent reading the response.
+	Receive time.Duration
+}
+
+// Redirect is a redirect response that was followed by the client.
+type Redirect struct {
+	Method  string
+	Url     *url.URL
+	Status  int
+	Headers http.Header
+}
+
+// phases are the times the phases of a round trip happened at.
+type phases struct {
+	getConn      time.Time
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	gotConn      time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+}
+
+// tracer collects Timings and Redirects for a single request.
+type tracer struct {
+	mu sync.Mutex
+	phases
+	redirects []Redirect
+	cookies   RedirectCookies
+}
+
+func (t *tracer) set(field *time.Time) {
+	t.mu.Lock()
+	*field = time.Now()
+	t.mu.Unlock()
+}
+
+// setOnce only sets the first time of a phase, as with multiple dial attempts the first start
+// and the last end are what matter.
+func (t *tracer) setOnce(field *time.Time) {
+	t.mu.Lock()
+	if field.IsZero() {
+		*field = time.Now()
+	}
+	t.mu.Unlock()
+}
+
+func (t *tracer) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GetConn: func(string) {
+			t.mu.Lock()
+			// a new round trip (ex. after a redirect) starts over
+			t.phases = phases{getConn: time.Now()}
+			t.mu.Unlock()
+		},
+		DNSStart:             func(httptrace.DNSStartInfo) { t.setOnce(&t.dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { t.set(&t.dnsDone) },
+		ConnectStart:         func(string, string) { t.setOnce(&t.connectStart) },
+		ConnectDone:          func(string, string, error) { t.set(&t.connectDone) },
+		TLSHandshakeStart:    func() { t.setOnce(&t.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { t.set(&t.tlsDone) },
+		GotConn:              func(httptrace.GotConnInfo) { t.set(&t.gotConn) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { t.set(&t.wroteRequest) },
+		GotFirstResponseByte: func() { t.set(&t.firstByte) },
+	}
+}
+
+func since(start, end time.Time) time.Duration {
+	if start.IsZero() || end.IsZero() || end.Before(start) {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+// timings returns the timings of the last round trip given the time the response finished
+// being read.
+func (t *tracer) timings(end time.Time) *Timings {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.getConn.IsZero() {
+		return nil
+	}
+	timings := &Timings{
+		Start:   t.getConn,
+		DNS:     since(t.dnsStart, t.dnsDone),
+		Connect: since(t.connectStart, t.connectDone),
+		TLS:     since(t.tlsStart, t.tlsDone),
+		Send:    since(t.gotConn, t.wroteRequest),
+		Wait:    since(t.wroteRequest, t.firstByte),
+		Receive: since(t.firstByte, end),
+	}
+	timings.Blocked = max(since(t.getConn, t.gotConn)-timings.DNS-timings.Connect-timings.TLS, 0)
+	return timings
+}
+
+type tracerCtxKeyType int
+
+var tracerCtxKey tracerCtxKeyType
+
+// traceRedirects wraps the CheckRedirect of the given client to record the redirects followed
+// for requests with a tracer.
+func traceRedirects(client *http.Client) {
+	check := client.CheckRedirect
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		var err error
+		if check != nil {
+			err = check(req, via)
+		} else if len(via) >= 10 {
+			// the default policy of http.Client
+			err = errors.New("stopped after 10 redirects")
+		}
+		if err != nil {
+			return err
+		}
+
+		t, ok := req.Context().Value(tracerCtxKey).(*tracer)
+		if ok && req.Response != nil {
+			prev := req.Response.Request
+			t.mu.Lock()
+			t.redirects = append(t.redirects, Redirect{
+				Method:  prev.Method,
+				Url:     prev.URL,
+				Status:  req.Response.StatusCode,
+				Headers: req.Response.Header,
+			})
+			t.mu.Unlock()
+		}
+		if ok && t.cookies.Jar != nil {
+			if req.Response != nil {
+				t.cookies.Jar.SetCookies(req.Response.Request.URL, req.Response.Cookies())
+			}
+			setRedirectCookies(req, t.cookies)
+		}
+		return nil
+	}
+}
+
+// setRedirectCookies sets the Cookie header of a redirected request from the RedirectCookies of
+// the original request.
+func setRedirectCookies(req *http.Request, cookies RedirectCookies) {
+	var pairs []string
+	// the client removes the Cookie header when redirecting to another domain
+	if cookies.Header != "" && req.Header.Get("Cookie") != "" {
+		pairs = append(pairs, cookies.Header)
+	}
+	for _, cookie := range cookies.Jar.Cookies(req.URL) {
+		pairs = append(pairs, cookie.String())
+	}
+	if len(pairs) == 0 {
+		req.Header.Del("Cookie")
+		return
+	}
+	req.Header.Set("Cookie", strings.Join(pairs, "; "))
+}
+
+func withTracer(ctx context.Context, t *tracer) context.Context {
+	ctx = context.WithValue(ctx, tracerCtxKey, t)
+	return httptrace.WithClientTrace(ctx, t.clientTrace())
+}
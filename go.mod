@@ -6,15 +6,17 @@ require (
 	github.com/JohannesKaufmann/html-to-markdown/v2 v2.3.0
 	github.com/PuerkitoBio/goquery v1.10.2
 	github.com/PuerkitoBio/purell v1.2.1
+	github.com/andybalholm/brotli v1.2.6
+	github.com/andybalholm/cascadia v1.3.3
 	github.com/gobwas/glob v0.2.3
+	github.com/klauspost/compress v1.18.0
 	github.com/lmittmann/tint v1.0.7
 	github.com/zeebo/xxh3 v1.0.2
 	golang.org/x/net v0.37.0
+	golang.org/x/text v0.23.0
 )
 
 require (
 	github.com/JohannesKaufmann/dom v0.2.0 // indirect
-	github.com/andybalholm/cascadia v1.3.3 // indirect
 	github.com/klauspost/cpuid/v2 v2.0.9 // indirect
-	golang.org/x/text v0.23.0 // indirect
 )
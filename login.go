@@ -0,0 +1,153 @@
+package scavenge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/LQR471814/scavenge/downloader"
+)
+
+// LoginStep returns the next request of a login sequence given the response to the request of
+// the previous step (nil for the first step).
+//
+// A step can return a nil request to end the sequence early, or an error to fail the login
+// (ex. when the previous response indicates that the credentials were wrong), a login failed by
+// a step is not retried.
+type LoginStep = func(prev *downloader.Response) (*downloader.Request, error)
+
+// LoginSpider is a Spider that needs to log in before crawling.
+//
+// The login sequence is run before the starting requests are queued, whenever a response
+// indicates the session has expired, the crawl is paused, the login sequence is run again and
+// the request is replayed.
+//
+// Note: login requests go through the downloader like any other request, so middleware like
+// middleware.Cookies will keep the session.
+type LoginSpider interface {
+	Spider
+	LoginSequence() []LoginStep
+	// SessionExpired reports whether the given response indicates that the session has expired.
+	SessionExpired(res *downloader.Response) bool
+}
+
+// loginState gates downloads on the login session, downloads hold a read lock while logging in
+// holds the write lock, so that logging in waits for in-flight downloads and pauses new ones.
+type loginState struct {
+	spider LoginSpider
+	mu     sync.RWMutex
+	// gen is incremented every time the login sequence succeeds.
+	gen uint64
+}
+
+// enter must be called before downloading, it returns the current login generation.
+func (l *loginState) enter() uint64 {
+	l.mu.RLock()
+	return l.gen
+}
+
+// exit must be called after downloading.
+func (l *loginState) exit() {
+	l.mu.RUnlock()
+}
+
+// loginRejected is the error of a login sequence failed by one of its steps.
+type loginRejected struct {
+	err error
+}
+
+func (e loginRejected) Error() string {
+	return e.err.Error()
+}
+
+func (e loginRejected) Unwrap() error {
+	return e.err
+}
+
+func (s *Scavenger) runLoginSequence(ctx context.Context, spider LoginSpider) error {
+	var prev *downloader.Response
+	for i, step := range spider.LoginSequence() {
+		req, err := step(prev)
+		if err != nil {
+			return loginRejected{err: fmt.Errorf("login step %d: %w", i, err)}
+		}
+		if req == nil {
+			return nil
+		}
+		// logging in again repeats the same requests
+		req.SetMeta(downloader.DontFilter{})
+		s.log.Info("login", "download", "step", i, "url", ShortUrl(req.Url))
+		prev, err = s.downloadLoginStep(ctx, req)
+		if err != nil {
+			return fmt.Errorf("login step %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// maxLoginReissues is the maximum amount of times a login step is reissued by middleware.
+const maxLoginReissues = 10
+
+// downloadLoginStep downloads the request of a login step, following the requests reissued by
+// middleware.
+func (s *Scavenger) downloadLoginStep(ctx context.Context, req *downloader.Request) (*downloader.Response, error) {
+	for reissues := 0; ; reissues++ {
+		res, err := s.dl.Download(ctx, req, downloader.RequestMetadata{})
+		var reissue downloader.ReissueError
+		if !errors.As(err, &reissue) {
+			return res, err
+		}
+		if reissues >= maxLoginReissues {
+			return nil, fmt.Errorf("reissued more than %d times: %w", maxLoginReissues, err)
+		}
+		req = reissue.Request
+		req.SetMeta(downloader.DontFilter{})
+	}
+}
+
+// login runs the login sequence until it succeeds, it is failed by a LoginStep, it has been
+// attempted the configured amount of times or the context is canceled.
+//
+// It must be called with the write lock held (or before any downloads have started).
+func (s *Scavenger) login(ctx context.Context) error {
+	for attempt := 0; ; attempt++ {
+		err := s.runLoginSequence(ctx, s.loginState.spider)
+		if err == nil {
+			s.loginState.gen++
+			s.stats.Inc("scavenger", "logins", 1)
+			s.log.Info("login", "logged in", "attempt", attempt)
+			return nil
+		}
+		s.log.Error("login", "login failed", "attempt", attempt, "err", err)
+		s.stats.Inc("scavenger", "logins_failed", 1)
+
+		var rejected loginRejected
+		if errors.As(err, &rejected) {
+			return fmt.Errorf("login: %w", err)
+		}
+		if attempt+1 >= s.cfg.loginAttempts {
+			return fmt.Errorf("login: failed after %d attempts: %w", attempt+1, err)
+		}
+
+		timer := time.NewTimer(s.retryDelay(attempt + 1))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// relogin runs the login sequence again if no one else has since the given generation.
+func (s *Scavenger) relogin(ctx context.Context, gen uint64) error {
+	s.loginState.mu.Lock()
+	defer s.loginState.mu.Unlock()
+	if s.loginState.gen != gen {
+		return nil
+	}
+	s.log.Warn("login", "session expired, logging in again")
+	return s.login(ctx)
+}
@@ -0,0 +1,238 @@
+package scavenge_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/LQR471814/scavenge"
+	"github.com/LQR471814/scavenge/downloader"
+	"github.com/LQR471814/scavenge/downloader/middleware"
+	"github.com/LQR471814/scavenge/items"
+)
+
+// testLoginServer issues a new session cookie for each POST /login, the other pages respond
+// with 401 unless the request has the latest session, expireOnce makes the session expire at
+// the first request to that path.
+type testLoginServer struct {
+	url        string
+	sessions   atomic.Int64
+	expireOnce string
+	expired    atomic.Bool
+}
+
+func newTestLoginServer(t *testing.T, expireOnce string) *testLoginServer {
+	s := &testLoginServer{expireOnce: expireOnce}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			n := s.sessions.Add(1)
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: fmt.Sprint(n), Path: "/"})
+			return
+		}
+		if r.URL.Path == s.expireOnce && s.expired.CompareAndSwap(false, true) {
+			s.sessions.Add(1)
+		}
+		cookie, err := r.Cookie("session")
+		if err != nil || cookie.Value != fmt.Sprint(s.sessions.Load()) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	t.Cleanup(srv.Close)
+	s.url = srv.URL
+	return s
+}
+
+type testLoginSpider struct {
+	baseUrl string
+	steps   []scavenge.LoginStep
+
+	mu      sync.Mutex
+	visited []string
+}
+
+func (s *testLoginSpider) StartingRequests() []*downloader.Request {
+	return []*downloader.Request{downloader.GETRequest(downloader.MustParseUrl(s.baseUrl + "/a"))}
+}
+
+func (s *testLoginSpider) HandleResponse(nav scavenge.Navigator, res *downloader.Response) error {
+	s.mu.Lock()
+	s.visited = append(s.visited, string(res.RawBody()))
+	s.mu.Unlock()
+	if res.Url().Path == "/a" {
+		nav.Request(downloader.GETRequest(downloader.MustParseUrl(s.baseUrl + "/b")))
+	}
+	return nil
+}
+
+func (s *testLoginSpider) LoginSequence() []scavenge.LoginStep {
+	return s.steps
+}
+
+func (s *testLoginSpider) SessionExpired(res *downloader.Response) bool {
+	return res.Status() == http.StatusUnauthorized
+}
+
+func loginStep(rawUrl string) scavenge.LoginStep {
+	return func(prev *downloader.Response) (*downloader.Request, error) {
+		return downloader.POSTRequest(downloader.MustParseUrl(rawUrl)), nil
+	}
+}
+
+func testDownloader() downloader.Downloader {
+	return downloader.NewDownloader(
+		downloader.NewHttpClient(http.DefaultClient),
+		middleware.NewDedupe(),
+		middleware.NewCookies(),
+	)
+}
+
+func testLogger() scavenge.Logger {
+	return scavenge.NewSlogLogger(slog.New(slog.NewTextHandler(io.Discard, nil)), false)
+}
+
+func TestLoginBeforeCrawling(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	server := newTestLoginServer(t, "/b")
+	spider := &testLoginSpider{
+		baseUrl: server.url,
+		steps:   []scavenge.LoginStep{loginStep(server.url + "/login")},
+	}
+
+	stats := scavenge.NewMemoryStats()
+	s := scavenge.NewScavenger(
+		testDownloader(),
+		items.NewProcessor(),
+		testLogger(),
+		scavenge.WithStats(stats),
+		scavenge.WithParallelDownloads(2),
+		scavenge.WithParallelItems(1),
+		scavenge.WithRetryDelayBounds(time.Millisecond, time.Millisecond),
+	)
+	s.Run(ctx, spider)
+
+	// the session expiring at /b causes a second login, after which /b is downloaded again
+	// without being dropped as a duplicate
+	if got := strings.Join(spider.visited, ","); got != "/a,/b" {
+		t.Fatalf("expected /a and /b to be visited, got '%s'", got)
+	}
+	if stats.Get("scavenger", "logins") != 2 {
+		t.Fatalf("expected 2 logins, got %d", stats.Get("scavenger", "logins"))
+	}
+}
+
+func TestLoginRejectedByStep(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	server := newTestLoginServer(t, "")
+	spider := &testLoginSpider{
+		baseUrl: server.url,
+		steps: []scavenge.LoginStep{
+			loginStep(server.url + "/login"),
+			func(prev *downloader.Response) (*downloader.Request, error) {
+				return nil, fmt.Errorf("wrong credentials")
+			},
+		},
+	}
+
+	stats := scavenge.NewMemoryStats()
+	s := scavenge.NewScavenger(
+		testDownloader(),
+		items.NewProcessor(),
+		testLogger(),
+		scavenge.WithStats(stats),
+		scavenge.WithParallelDownloads(2),
+		scavenge.WithParallelItems(1),
+		scavenge.WithRetryDelayBounds(time.Millisecond, time.Millisecond),
+	)
+	s.Run(ctx, spider)
+
+	if stats.Get("scavenger", "logins_failed") != 1 {
+		t.Fatalf("expected a login failed by a step to not be retried, got %d failures", stats.Get("scavenger", "logins_failed"))
+	}
+	if len(spider.visited) != 0 {
+		t.Fatalf("expected nothing to be crawled without logging in, got %v", spider.visited)
+	}
+}
+
+func TestLoginAttempts(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	server := newTestLoginServer(t, "")
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	spider := &testLoginSpider{
+		baseUrl: server.url,
+		steps:   []scavenge.LoginStep{loginStep(closed.URL + "/login")},
+	}
+
+	stats := scavenge.NewMemoryStats()
+	s := scavenge.NewScavenger(
+		testDownloader(),
+		items.NewProcessor(),
+		testLogger(),
+		scavenge.WithStats(stats),
+		scavenge.WithParallelDownloads(2),
+		scavenge.WithParallelItems(1),
+		scavenge.WithRetryDelayBounds(time.Millisecond, time.Millisecond),
+		scavenge.WithLoginAttempts(3),
+	)
+	s.Run(ctx, spider)
+
+	if stats.Get("scavenger", "logins_failed") != 3 {
+		t.Fatalf("expected 3 login attempts, got %d", stats.Get("scavenger", "logins_failed"))
+	}
+	if ctx.Err() != nil {
+		t.Fatal("expected Run to give up on logging in")
+	}
+}
+
+func TestReloginFailure(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	server := newTestLoginServer(t, "/b")
+	logins := 0
+	spider := &testLoginSpider{
+		baseUrl: server.url,
+		steps: []scavenge.LoginStep{func(prev *downloader.Response) (*downloader.Request, error) {
+			logins++
+			if logins > 1 {
+				return nil, fmt.Errorf("account locked")
+			}
+			return downloader.POSTRequest(downloader.MustParseUrl(server.url + "/login")), nil
+		}},
+	}
+
+	var failed []error
+	stats := scavenge.NewMemoryStats()
+	s := scavenge.NewScavenger(
+		testDownloader(),
+		items.NewProcessor(),
+		testLogger(),
+		scavenge.WithStats(stats),
+		scavenge.WithParallelDownloads(2),
+		scavenge.WithParallelItems(1),
+		scavenge.WithRetryDelayBounds(time.Millisecond, time.Millisecond),
+		scavenge.WithOnRequestFail(func(req *downloader.Request, err error) {
+			failed = append(failed, err)
+		}),
+	)
+	s.Run(ctx, spider)
+
+	if len(failed) != 1 || !strings.Contains(failed[0].Error(), "account locked") {
+		t.Fatalf("expected the relogin error to be reported for the request, got %v", failed)
+	}
+	if got := strings.Join(spider.visited, ","); got != "/a" {
+		t.Fatalf("expected only /a to be visited, got '%s'", got)
+	}
+}
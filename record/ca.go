@@ -0,0 +1,158 @@
+package record
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// GenerateCA creates a self-signed certificate authority that can be used to intercept HTTPS
+// traffic, it returns the certificate and private key PEM encoded.
+//
+// The certificate must be trusted by the browser that is recorded.
+func GenerateCA() (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate ca: %w", err)
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate ca: %w", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "scavenge record CA", Organization: []string{"scavenge"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate ca: %w", err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate ca: %w", err)
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+	return certPEM, keyPEM, nil
+}
+
+// LoadCA loads a certificate authority from PEM encoded certificate and key files.
+func LoadCA(certFile, keyFile string) (tls.Certificate, error) {
+	ca, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("load ca: %w", err)
+	}
+	return ca, nil
+}
+
+// LoadOrGenerateCA loads the certificate authority from the given files, generating and writing
+// a new one to them if they do not exist.
+func LoadOrGenerateCA(certFile, keyFile string) (tls.Certificate, error) {
+	_, err := os.Stat(certFile)
+	if os.IsNotExist(err) {
+		certPEM, keyPEM, err := GenerateCA()
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		err = os.WriteFile(keyFile, keyPEM, 0600)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("write ca key: %w", err)
+		}
+		err = os.WriteFile(certFile, certPEM, 0644)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("write ca cert: %w", err)
+		}
+	}
+	return LoadCA(certFile, keyFile)
+}
+
+// certs issues leaf certificates for the hosts intercepted by a Proxy.
+type certs struct {
+	ca    *x509.Certificate
+	caKey any
+	key   *ecdsa.PrivateKey
+
+	mu    sync.Mutex
+	cache map[string]*tls.Certificate
+}
+
+func newCerts(ca tls.Certificate) (*certs, error) {
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse ca: %w", err)
+	}
+	// a single key is shared by all leaf certificates, generating one per host is slow
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &certs{
+		ca:    caCert,
+		caKey: ca.PrivateKey,
+		key:   key,
+		cache: map[string]*tls.Certificate{},
+	}, nil
+}
+
+func (c *certs) get(host string) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cert, ok := c.cache[host]
+	if ok {
+		return cert, nil
+	}
+
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	ip := net.ParseIP(host)
+	if ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	if template.NotAfter.After(c.ca.NotAfter) {
+		template.NotAfter = c.ca.NotAfter
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, c.ca, &c.key.PublicKey, c.caKey)
+	if err != nil {
+		return nil, fmt.Errorf("issue certificate for '%s': %w", host, err)
+	}
+	cert = &tls.Certificate{
+		Certificate: [][]byte{der, c.ca.Raw},
+		PrivateKey:  c.key,
+	}
+	c.cache[host] = cert
+	return cert, nil
+}
@@ -0,0 +1,373 @@
+// Package record implements a forward proxy that records the traffic of a manual browsing
+// session into a middleware.ReplayStore, so that a spider can be developed offline against the
+// responses the browser saw.
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/LQR471814/scavenge"
+	"github.com/LQR471814/scavenge/downloader"
+	"github.com/LQR471814/scavenge/downloader/middleware"
+)
+
+// hopHeaders are the headers that only apply to a single connection and must not be forwarded.
+//
+// https://www.rfc-editor.org/rfc/rfc9110#section-7.6.1
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopHeaders(headers http.Header) http.Header {
+	headers = headers.Clone()
+	if headers == nil {
+		return http.Header{}
+	}
+	for _, v := range headers.Values("Connection") {
+		headers.Del(v)
+	}
+	for _, h := range hopHeaders {
+		headers.Del(h)
+	}
+	return headers
+}
+
+type proxyCfg struct {
+	ca     *tls.Certificate
+	client downloader.Client
+	logger scavenge.Logger
+	stats  scavenge.Stats
+}
+
+type proxyOption = func(cfg *proxyCfg)
+
+// WithCA makes the proxy intercept HTTPS traffic by issuing certificates signed by the given
+// certificate authority, without it HTTPS traffic is tunneled without being recorded.
+func WithCA(ca tls.Certificate) proxyOption {
+	return func(cfg *proxyCfg) {
+		cfg.ca = &ca
+	}
+}
+
+// WithClient sets the client requests are forwarded with, it must not follow redirects, by
+// default it is a downloader.HttpClient.
+func WithClient(client downloader.Client) proxyOption {
+	return func(cfg *proxyCfg) {
+		cfg.client = client
+	}
+}
+
+// WithLogger sets the logger of the proxy, by default it logs to slog.Default.
+func WithLogger(logger scavenge.Logger) proxyOption {
+	return func(cfg *proxyCfg) {
+		cfg.logger = logger
+	}
+}
+
+// WithStats sets the stats the proxy reports to, by default they are kept in a
+// scavenge.MemoryStats.
+func WithStats(stats scavenge.Stats) proxyOption {
+	return func(cfg *proxyCfg) {
+		cfg.stats = stats
+	}
+}
+
+// Proxy is an HTTP forward proxy that stores every response that passes through it in a
+// ReplayStore, keyed with the same ReplayHandler a middleware.Replay would use.
+//
+// Requests are forwarded without the Accept-Encoding of the browser so that the client picks the
+// encodings (and decodes the responses), responses are stored decoded like the ones downloaded by
+// a spider.
+type Proxy struct {
+	sessionId string
+	store     middleware.ReplayStore
+	handler   middleware.ReplayHandler
+	cfg       proxyCfg
+	certs     *certs
+}
+
+func NewProxy(sessionId string, store middleware.ReplayStore, handler middleware.ReplayHandler, options ...proxyOption) (*Proxy, error) {
+	cfg := proxyCfg{}
+	for _, o := range options {
+		o(&cfg)
+	}
+	if cfg.client == nil {
+		cfg.client = downloader.NewHttpClient(&http.Client{
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		})
+	}
+	if cfg.logger == nil {
+		cfg.logger = scavenge.NewSlogLogger(slog.Default(), false)
+	}
+	if cfg.stats == nil {
+		cfg.stats = scavenge.NewMemoryStats()
+	}
+
+	p := &Proxy{
+		sessionId: sessionId,
+		store:     store,
+		handler:   handler,
+		cfg:       cfg,
+	}
+	if cfg.ca != nil {
+		c, err := newCerts(*cfg.ca)
+		if err != nil {
+			return nil, fmt.Errorf("record: %w", err)
+		}
+		p.certs = c
+	}
+	return p, nil
+}
+
+func (p *Proxy) context(ctx context.Context) context.Context {
+	ctx = scavenge.ContextWithLogger(ctx, p.cfg.logger)
+	return scavenge.ContextWithStats(ctx, p.cfg.stats)
+}
+
+// forward makes the given request upstream and records its response.
+func (p *Proxy) forward(ctx context.Context, r *http.Request) (*downloader.Response, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read request body: %w", err)
+	}
+	headers := removeHopHeaders(r.Header)
+	headers.Del("Accept-Encoding")
+	// the browser revalidating a page it has cached would get a 304 without a body, which would
+	// replace the recorded page, so the full response is always requested
+	headers.Del("If-None-Match")
+	headers.Del("If-Modified-Since")
+
+	url := *r.URL
+	req := &downloader.Request{
+		Method:  r.Method,
+		Url:     &url,
+		Headers: headers,
+		Body:    body,
+	}
+	res, err := p.cfg.client.Do(ctx, req)
+	if err != nil {
+		p.cfg.stats.Inc("record", "failed", 1)
+		return nil, err
+	}
+
+	key, record := p.handler(ctx, req, downloader.RequestMetadata{})
+	if record {
+		p.store.Set(ctx, p.sessionId, key, res)
+		p.cfg.stats.Inc("record", "recorded", 1)
+		p.cfg.logger.Info("record", "recorded", "status", res.Status(), "key", key)
+	} else {
+		p.cfg.stats.Inc("record", "skipped", 1)
+		p.cfg.logger.Debug("record", "not recorded", "method", r.Method, "url", scavenge.ShortUrl(&url))
+	}
+	return res, nil
+}
+
+// responseHeaders returns the headers sent back to the browser.
+func responseHeaders(res *downloader.Response) http.Header {
+	headers := removeHopHeaders(res.Headers())
+	headers.Set("Content-Length", strconv.Itoa(len(res.RawBody())))
+	return headers
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := p.context(r.Context())
+
+	if r.Method == http.MethodConnect {
+		if p.certs == nil {
+			p.tunnel(w, r)
+			return
+		}
+		p.intercept(ctx, w, r)
+		return
+	}
+
+	if !r.URL.IsAbs() {
+		http.Error(w, "scavenge record is a forward proxy, requests must have an absolute url", http.StatusBadRequest)
+		return
+	}
+	res, err := p.forward(ctx, r)
+	if err != nil {
+		p.cfg.logger.Warn("record", "forward request", "url", scavenge.ShortUrl(r.URL), "err", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	for k, v := range responseHeaders(res) {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(res.Status())
+	_, err = w.Write(res.RawBody())
+	if err != nil {
+		p.cfg.logger.Debug("record", "write response", "url", scavenge.ShortUrl(r.URL), "err", err)
+	}
+}
+
+// hijack takes over the connection of a CONNECT request after telling the client it was
+// established.
+func hijack(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection cannot be hijacked")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = rw.WriteString("HTTP/1.1 200 Connection Established\r\n\r\n")
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, rw, nil
+}
+
+// tunnel passes the connection through to the host without recording anything.
+func (p *Proxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	upstream, err := net.DialTimeout("tcp", r.Host, 30*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	conn, rw, err := hijack(w)
+	if err != nil {
+		upstream.Close()
+		p.cfg.logger.Warn("record", "hijack connection", "host", r.Host, "err", err)
+		return
+	}
+	p.cfg.logger.Debug("record", "tunneling", "host", r.Host)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, rw.Reader)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+	conn.Close()
+	upstream.Close()
+}
+
+// intercept terminates TLS with a certificate issued for the host and records the requests
+// made through the connection.
+func (p *Proxy) intercept(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	conn, rw, err := hijack(w)
+	if err != nil {
+		p.cfg.logger.Warn("record", "hijack connection", "host", r.Host, "err", err)
+		return
+	}
+	defer conn.Close()
+
+	tlsConn := tls.Server(&bufferedConn{Conn: conn, r: rw.Reader}, &tls.Config{
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = host
+			}
+			return p.certs.get(name)
+		},
+	})
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		p.cfg.logger.Warn("record", "tls handshake", "host", r.Host, "err", err)
+		return
+	}
+
+	br := bufio.NewReader(tlsConn)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if err != io.EOF {
+				p.cfg.logger.Debug("record", "read request", "host", r.Host, "err", err)
+			}
+			return
+		}
+		req.URL.Scheme = "https"
+		req.URL.Host = req.Host
+		if req.URL.Host == "" {
+			req.URL.Host = r.Host
+		}
+
+		res, err := p.forward(ctx, req.WithContext(ctx))
+		out := &http.Response{
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Request:    req,
+		}
+		if err != nil {
+			p.cfg.logger.Warn("record", "forward request", "url", scavenge.ShortUrl(req.URL), "err", err)
+			msg := []byte(err.Error())
+			out.StatusCode = http.StatusBadGateway
+			out.Header = http.Header{"Content-Type": {"text/plain; charset=utf-8"}}
+			out.Body = io.NopCloser(bytes.NewReader(msg))
+			out.ContentLength = int64(len(msg))
+		} else {
+			out.StatusCode = res.Status()
+			out.Header = responseHeaders(res)
+			out.Body = io.NopCloser(bytes.NewReader(res.RawBody()))
+			out.ContentLength = int64(len(res.RawBody()))
+		}
+		err = out.Write(tlsConn)
+		if err != nil || req.Close {
+			return
+		}
+	}
+}
+
+// bufferedConn reads through the buffer of a hijacked connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// ListenAndServe runs the proxy on the given address until the context is canceled.
+func (p *Proxy) ListenAndServe(ctx context.Context, addr string) error {
+	server := &http.Server{Addr: addr, Handler: p}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		return fmt.Errorf("record: %w", err)
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+		return nil
+	}
+}
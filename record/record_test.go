@@ -0,0 +1,208 @@
+package record
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/LQR471814/scavenge"
+	"github.com/LQR471814/scavenge/downloader"
+	"github.com/LQR471814/scavenge/downloader/middleware"
+)
+
+func testUpstream(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/page":
+		if r.Header.Get("Proxy-Connection") != "" {
+			http.Error(w, "hop header forwarded", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("page"))
+	case "/cached":
+		w.Header().Set("Etag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("cached page"))
+	case "/redirect":
+		http.Redirect(w, r, "/page", http.StatusFound)
+	case "/submit":
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}
+}
+
+// testBrowser returns a client that makes its requests through the proxy.
+func testBrowser(t *testing.T, proxy *Proxy, roots *x509.CertPool) *http.Client {
+	t.Helper()
+	srv := httptest.NewServer(proxy)
+	t.Cleanup(srv.Close)
+	proxyUrl, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyUrl),
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func get(t *testing.T, client *http.Client, rawUrl string) (int, string) {
+	t.Helper()
+	res, err := client.Get(rawUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, string(body)
+}
+
+func replayKey(rawUrl string) string {
+	key, _ := middleware.ReplayGetRequests(context.Background(), downloader.GETRequest(downloader.MustParseUrl(rawUrl)), downloader.RequestMetadata{})
+	return key
+}
+
+func TestProxyRecords(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(testUpstream))
+	defer upstream.Close()
+
+	ctx := context.Background()
+	store := middleware.NewMemoryReplayStore()
+	stats := scavenge.NewMemoryStats()
+	proxy, err := NewProxy("s", store, middleware.ReplayGetRequests, WithStats(stats))
+	if err != nil {
+		t.Fatal(err)
+	}
+	browser := testBrowser(t, proxy, nil)
+
+	status, body := get(t, browser, upstream.URL+"/page")
+	if status != 200 || body != "page" {
+		t.Fatalf("expected the upstream response, got %d '%s'", status, body)
+	}
+	res := store.Get(ctx, "s", replayKey(upstream.URL+"/page"))
+	if res == nil || string(res.RawBody()) != "page" {
+		t.Fatal("expected the response to be recorded")
+	}
+
+	// redirects are passed to the browser instead of being followed by the proxy
+	status, _ = get(t, browser, upstream.URL+"/redirect")
+	if status != http.StatusFound {
+		t.Fatalf("expected the redirect to be passed through, got %d", status)
+	}
+	res = store.Get(ctx, "s", replayKey(upstream.URL+"/redirect"))
+	if res == nil || res.Status() != http.StatusFound {
+		t.Fatal("expected the redirect to be recorded")
+	}
+
+	post, err := browser.Post(upstream.URL+"/submit", "text/plain", strings.NewReader("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoed, _ := io.ReadAll(post.Body)
+	post.Body.Close()
+	if string(echoed) != "data" {
+		t.Fatalf("expected the request body to be forwarded, got '%s'", echoed)
+	}
+	if stats.Get("record", "recorded") != 2 || stats.Get("record", "skipped") != 1 {
+		t.Fatalf(
+			"expected 2 recorded and 1 skipped, got %d and %d",
+			stats.Get("record", "recorded"), stats.Get("record", "skipped"),
+		)
+	}
+}
+
+func TestProxyRevalidation(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(testUpstream))
+	defer upstream.Close()
+
+	ctx := context.Background()
+	store := middleware.NewMemoryReplayStore()
+	proxy, err := NewProxy("s", store, middleware.ReplayGetRequests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	browser := testBrowser(t, proxy, nil)
+
+	status, _ := get(t, browser, upstream.URL+"/cached")
+	if status != 200 {
+		t.Fatalf("expected the page, got %d", status)
+	}
+
+	// the browser revalidates the page it has cached
+	req, err := http.NewRequest(http.MethodGet, upstream.URL+"/cached", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("If-None-Match", `"v1"`)
+	res, err := browser.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	recorded := store.Get(ctx, "s", replayKey(upstream.URL+"/cached"))
+	if recorded == nil || recorded.Status() != 200 || string(recorded.RawBody()) != "cached page" {
+		t.Fatal("expected the recorded page to not be replaced by a revalidation")
+	}
+}
+
+func TestProxyInterceptsHTTPS(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(testUpstream))
+	defer upstream.Close()
+
+	certPEM, keyPEM, err := GenerateCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+
+	store := middleware.NewMemoryReplayStore()
+	proxy, err := NewProxy(
+		"s", store, middleware.ReplayGetRequests,
+		WithCA(ca),
+		// the upstream client must trust the certificate of the test server
+		WithClient(downloader.NewHttpClient(&http.Client{
+			Transport: upstream.Client().Transport,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	browser := testBrowser(t, proxy, roots)
+
+	for range 2 {
+		status, body := get(t, browser, upstream.URL+"/page")
+		if status != 200 || body != "page" {
+			t.Fatalf("expected the upstream response, got %d '%s'", status, body)
+		}
+	}
+	res := store.Get(context.Background(), "s", replayKey(upstream.URL+"/page"))
+	if res == nil || string(res.RawBody()) != "page" {
+		t.Fatal("expected the intercepted response to be recorded")
+	}
+}
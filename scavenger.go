@@ -2,6 +2,7 @@ package scavenge
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math"
 	"math/rand/v2"
@@ -32,6 +33,10 @@ type reqJob struct {
 	Referer *url.URL
 	// attempt is unexported, since all requests should reset their timers after resuming.
 	attempt int
+	// relogged is true if the request has already been replayed after its session expired.
+	relogged bool
+	// reissues is the amount of times middleware reissued the request of the job.
+	reissues int
 }
 
 type itemJob struct {
@@ -44,6 +49,7 @@ type itemJob struct {
 type Scavenger struct {
 	cfg   config
 	log   Logger
+	stats Stats
 	dl    downloader.Downloader
 	iproc items.Processor
 
@@ -51,6 +57,7 @@ type Scavenger struct {
 	itemjobs    chan itemJob
 	wg          sync.WaitGroup
 	quitWorkers atomic.Uint64
+	loginState  *loginState
 }
 
 type config struct {
@@ -61,6 +68,8 @@ type config struct {
 	reqFailHandler    func(req *downloader.Request, err error)
 	spiderFailHandler func(res *downloader.Response, err error)
 	iprocFailHandler  func(i items.Item, err error)
+	stats             Stats
+	loginAttempts     int
 }
 
 type option func(cfg *config)
@@ -120,6 +129,26 @@ func WithOnItemProcessorFail(callback func(i items.Item, err error)) option {
 	}
 }
 
+// WithStats sets the Stats the scavenger and its middleware report statistics to.
+//
+// By default, a [MemoryStats] is used.
+func WithStats(stats Stats) option {
+	return func(cfg *config) {
+		cfg.stats = stats
+	}
+}
+
+// WithLoginAttempts sets the amount of times the login sequence of a LoginSpider is run before
+// giving up on logging in, by default it is 5.
+func WithLoginAttempts(attempts int) option {
+	return func(cfg *config) {
+		if attempts < 1 {
+			panic(fmt.Errorf("login attempts '%d' must be at least 1", attempts))
+		}
+		cfg.loginAttempts = attempts
+	}
+}
+
 func NewScavenger(
 	dl downloader.Downloader,
 	iproc items.Processor,
@@ -132,18 +161,28 @@ func NewScavenger(
 		parallelItems:     runtime.NumCPU() - defaultParDowns,
 		minRetryDelay:     time.Second,
 		maxRetryDelay:     time.Hour,
+		loginAttempts:     5,
 	}
 	for _, opt := range options {
 		opt(&cfg)
 	}
+	if cfg.stats == nil {
+		cfg.stats = NewMemoryStats()
+	}
 	return &Scavenger{
 		cfg:   cfg,
 		iproc: iproc,
 		log:   logger,
+		stats: cfg.stats,
 		dl:    dl,
 	}
 }
 
+// Stats returns the Stats the scavenger reports to.
+func (s *Scavenger) Stats() Stats {
+	return s.stats
+}
+
 func (s *Scavenger) handleRequest(
 	ctx context.Context,
 	spider Spider,
@@ -158,12 +197,25 @@ func (s *Scavenger) handleRequest(
 		"attempt", job.attempt,
 	)
 
+	var loginGen uint64
+	if s.loginState != nil {
+		loginGen = s.loginState.enter()
+	}
 	res, err := s.dl.Download(ctx, job.Req, downloader.RequestMetadata{
 		AttemptNo: job.attempt,
 		Referer:   job.Referer,
 	})
+	if s.loginState != nil {
+		s.loginState.exit()
+	}
 	if err != nil {
+		var reissue downloader.ReissueError
+		if errors.As(err, &reissue) {
+			s.reissueReqJob(ctx, job, reissue.Request)
+			return
+		}
 		if strings.Contains(err.Error(), "dropped request:") {
+			s.stats.Inc("scavenger", "requests_dropped", 1)
 			s.log.Info(
 				"scavenger", "dropped request",
 				"url", ShortUrl(job.Req.Url),
@@ -181,12 +233,19 @@ func (s *Scavenger) handleRequest(
 			"attempt", job.attempt,
 			"err", err,
 		)
+		s.stats.Inc("scavenger", "requests_failed", 1)
 		if s.cfg.reqFailHandler != nil {
 			s.cfg.reqFailHandler(job.Req, err)
 		}
 		s.retryReqJob(ctx, job)
 		return
 	}
+	s.stats.Inc("scavenger", "responses", 1)
+
+	if s.loginState != nil && s.loginState.spider.SessionExpired(res) {
+		s.handleSessionExpired(ctx, job, loginGen)
+		return
+	}
 
 	err = spider.HandleResponse(Navigator{
 		context:    ctx,
@@ -209,6 +268,99 @@ func (s *Scavenger) handleRequest(
 	}
 }
 
+// maxRequestReissues is the maximum amount of times the request of a job is reissued by
+// middleware before it fails.
+const maxRequestReissues = 10
+
+// reissueReqJob queues the request returned by a middleware in place of the request of the job,
+// each reissue counts as another attempt (so a reissued request is not deduplicated) and the same
+// request reissued waits for the retry delay.
+func (s *Scavenger) reissueReqJob(ctx context.Context, job reqJob, req *downloader.Request) {
+	if job.reissues >= maxRequestReissues {
+		err := fmt.Errorf("reissued more than %d times", maxRequestReissues)
+		s.log.Error(
+			"scavenger", "request download failed",
+			"url", ShortUrl(job.Req.Url),
+			"referer", ShortUrl(job.Referer),
+			"attempt", job.attempt,
+			"err", err,
+		)
+		s.stats.Inc("scavenger", "requests_failed", 1)
+		if s.cfg.reqFailHandler != nil {
+			s.cfg.reqFailHandler(job.Req, err)
+		}
+		return
+	}
+
+	s.stats.Inc("scavenger", "requests_reissued", 1)
+	s.log.Info(
+		"scavenger", "reissued request",
+		"url", ShortUrl(job.Req.Url),
+		"reissued_url", ShortUrl(req.Url),
+		"attempt", job.attempt,
+	)
+
+	job.reissues++
+	if req == job.Req {
+		s.retryReqJob(ctx, job)
+		return
+	}
+	job.Req = req
+	job.attempt++
+	s.wg.Add(1)
+	go func() {
+		defer s.recoverAndCancelJob()
+		s.reqjobs <- job
+	}()
+}
+
+func (s *Scavenger) handleSessionExpired(ctx context.Context, job reqJob, loginGen uint64) {
+	if job.relogged {
+		err := fmt.Errorf("session expired after logging in again")
+		s.log.Error(
+			"scavenger", "request download failed",
+			"url", ShortUrl(job.Req.Url),
+			"referer", ShortUrl(job.Referer),
+			"attempt", job.attempt,
+			"err", err,
+		)
+		s.stats.Inc("scavenger", "requests_failed", 1)
+		if s.cfg.reqFailHandler != nil {
+			s.cfg.reqFailHandler(job.Req, err)
+		}
+		job.relogged = false
+		s.retryReqJob(ctx, job)
+		return
+	}
+
+	err := s.relogin(ctx, loginGen)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		s.log.Error(
+			"scavenger", "request download failed",
+			"url", ShortUrl(job.Req.Url),
+			"referer", ShortUrl(job.Referer),
+			"attempt", job.attempt,
+			"err", err,
+		)
+		s.stats.Inc("scavenger", "requests_failed", 1)
+		if s.cfg.reqFailHandler != nil {
+			s.cfg.reqFailHandler(job.Req, err)
+		}
+		return
+	}
+	// the replayed request counts as another attempt so that it is not filtered as a duplicate
+	job.attempt++
+	job.relogged = true
+	s.wg.Add(1)
+	go func() {
+		defer s.recoverAndCancelJob()
+		s.reqjobs <- job
+	}()
+}
+
 func (s *Scavenger) handleItem(ctx context.Context, job itemJob) {
 	defer s.wg.Done()
 
@@ -371,10 +523,22 @@ func (s *Scavenger) Run(ctx context.Context, spider Spider) {
 
 	ctx = setScavengerCtx(ctx, s)
 	ctx = setLogCtx(ctx, s.log)
+	ctx = setStatsCtx(ctx, s.stats)
 
 	s.itemjobs = make(chan itemJob)
 	s.reqjobs = make(chan reqJob)
 	s.wg = sync.WaitGroup{}
+	s.loginState = nil
+
+	loginSpider, ok := spider.(LoginSpider)
+	if ok {
+		s.loginState = &loginState{spider: loginSpider}
+		err := s.login(ctx)
+		if err != nil {
+			s.log.Error("scavenger", "could not log in", "err", err)
+			return
+		}
+	}
 
 	for range s.cfg.parallelDownloads {
 		go s.reqWorker(ctx, spider)
@@ -0,0 +1,169 @@
+package scavenge_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/LQR471814/scavenge"
+	"github.com/LQR471814/scavenge/downloader"
+	"github.com/LQR471814/scavenge/downloader/middleware"
+	"github.com/LQR471814/scavenge/items"
+)
+
+// reissueMiddleware reissues responses with a 503 status and the responses to /old as a request
+// to /new.
+type reissueMiddleware struct{}
+
+func (reissueMiddleware) HandleRequest(ctx context.Context, req *downloader.Request, meta downloader.RequestMetadata) (*downloader.Response, error) {
+	return nil, nil
+}
+
+func (reissueMiddleware) HandleResponse(ctx context.Context, res *downloader.Response, meta downloader.ResponseMetadata) (*downloader.Response, error) {
+	if res.Status() == http.StatusServiceUnavailable {
+		return nil, downloader.ReissueRequest(res.Request())
+	}
+	if res.Url().Path == "/old" {
+		moved := *res.Url()
+		moved.Path = "/new"
+		return nil, downloader.ReissueRequest(downloader.GETRequest(&moved))
+	}
+	return nil, nil
+}
+
+type testReissueSpider struct {
+	baseUrl string
+
+	mu      sync.Mutex
+	visited []string
+}
+
+func (s *testReissueSpider) StartingRequests() []*downloader.Request {
+	return []*downloader.Request{
+		downloader.GETRequest(downloader.MustParseUrl(s.baseUrl + "/flaky")),
+		downloader.GETRequest(downloader.MustParseUrl(s.baseUrl + "/old")),
+	}
+}
+
+func (s *testReissueSpider) HandleResponse(nav scavenge.Navigator, res *downloader.Response) error {
+	s.mu.Lock()
+	s.visited = append(s.visited, res.Url().Path)
+	s.mu.Unlock()
+	return nil
+}
+
+func TestReissuedRequests(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var flaky atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/flaky" && flaky.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	stats := scavenge.NewMemoryStats()
+	s := scavenge.NewScavenger(
+		downloader.NewDownloader(
+			downloader.NewHttpClient(http.DefaultClient),
+			middleware.NewDedupe(),
+			reissueMiddleware{},
+		),
+		items.NewProcessor(),
+		testLogger(),
+		scavenge.WithStats(stats),
+		scavenge.WithParallelDownloads(2),
+		scavenge.WithParallelItems(1),
+		scavenge.WithRetryDelayBounds(time.Millisecond, time.Millisecond),
+	)
+	spider := &testReissueSpider{baseUrl: srv.URL}
+	s.Run(ctx, spider)
+
+	// the same request reissued is another attempt, so it is not dropped as a duplicate
+	slices.Sort(spider.visited)
+	if !slices.Equal(spider.visited, []string{"/flaky", "/new"}) {
+		t.Fatalf("expected the reissued requests to be downloaded in place of the others, got %v", spider.visited)
+	}
+	if stats.Get("scavenger", "requests_reissued") != 2 {
+		t.Fatalf("expected 2 reissued requests, got %d", stats.Get("scavenger", "requests_reissued"))
+	}
+	if flaky.Load() != 2 {
+		t.Fatalf("expected /flaky to be downloaded twice, got %d", flaky.Load())
+	}
+}
+
+// endlessReissueMiddleware always reissues responses, /same as the same request and /new as a new
+// request.
+type endlessReissueMiddleware struct{}
+
+func (endlessReissueMiddleware) HandleRequest(ctx context.Context, req *downloader.Request, meta downloader.RequestMetadata) (*downloader.Response, error) {
+	return nil, nil
+}
+
+func (endlessReissueMiddleware) HandleResponse(ctx context.Context, res *downloader.Response, meta downloader.ResponseMetadata) (*downloader.Response, error) {
+	if res.Url().Path == "/same" {
+		return nil, downloader.ReissueRequest(res.Request())
+	}
+	return nil, downloader.ReissueRequest(downloader.GETRequest(res.Url()))
+}
+
+type testEndlessReissueSpider struct {
+	baseUrl string
+}
+
+func (s testEndlessReissueSpider) StartingRequests() []*downloader.Request {
+	return []*downloader.Request{
+		downloader.GETRequest(downloader.MustParseUrl(s.baseUrl + "/same")),
+		downloader.GETRequest(downloader.MustParseUrl(s.baseUrl + "/new")),
+	}
+}
+
+func (s testEndlessReissueSpider) HandleResponse(nav scavenge.Navigator, res *downloader.Response) error {
+	return nil
+}
+
+func TestEndlessReissuedRequests(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var downloads atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads.Add(1)
+	}))
+	defer srv.Close()
+
+	stats := scavenge.NewMemoryStats()
+	s := scavenge.NewScavenger(
+		downloader.NewDownloader(
+			downloader.NewHttpClient(http.DefaultClient),
+			middleware.NewDedupe(),
+			endlessReissueMiddleware{},
+		),
+		items.NewProcessor(),
+		testLogger(),
+		scavenge.WithStats(stats),
+		scavenge.WithParallelDownloads(2),
+		scavenge.WithParallelItems(1),
+		scavenge.WithRetryDelayBounds(time.Millisecond, time.Millisecond),
+	)
+	s.Run(ctx, testEndlessReissueSpider{baseUrl: srv.URL})
+	if ctx.Err() != nil {
+		t.Fatal("expected the requests to stop being reissued")
+	}
+
+	// each request is downloaded once and then once for each reissue
+	if downloads.Load() != 2*11 {
+		t.Fatalf("expected 22 downloads, got %d", downloads.Load())
+	}
+	if stats.Get("scavenger", "requests_reissued") != 20 || stats.Get("scavenger", "requests_failed") != 2 {
+		t.Fatalf(
+			"expected 20 reissued and 2 failed requests, got %d and %d",
+			stats.Get("scavenger", "requests_reissued"), stats.Get("scavenger", "requests_failed"),
+		)
+	}
+}
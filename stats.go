@@ -0,0 +1,47 @@
+package scavenge
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// MemoryStats implements Stats with in-memory counters.
+type MemoryStats struct {
+	counters sync.Map
+}
+
+// NewMemoryStats creates a new MemoryStats.
+func NewMemoryStats() *MemoryStats {
+	return &MemoryStats{
+		counters: sync.Map{},
+	}
+}
+
+func (s *MemoryStats) Inc(component, name string, delta int64) {
+	id := fmt.Sprintf("%s::%s", component, name)
+	v, ok := s.counters.Load(id)
+	if !ok {
+		v, _ = s.counters.LoadOrStore(id, &atomic.Int64{})
+	}
+	v.(*atomic.Int64).Add(delta)
+}
+
+// Get returns the current value of the counter with the given name.
+func (s *MemoryStats) Get(component, name string) int64 {
+	v, ok := s.counters.Load(fmt.Sprintf("%s::%s", component, name))
+	if !ok {
+		return 0
+	}
+	return v.(*atomic.Int64).Load()
+}
+
+// Snapshot returns a copy of all the counters, keyed by "component::name".
+func (s *MemoryStats) Snapshot() map[string]int64 {
+	out := map[string]int64{}
+	s.counters.Range(func(key, value any) bool {
+		out[key.(string)] = value.(*atomic.Int64).Load()
+		return true
+	})
+	return out
+}
@@ -21,6 +21,14 @@ type Perf interface {
 	Elapsed(component, operation string, milliseconds uint64)
 }
 
+// Stats is an interface containing statistic reporters.
+//
+// Note: Stats should be safe to be called concurrently.
+type Stats interface {
+	// Inc increments the counter with the given name by delta.
+	Inc(component, name string, delta int64)
+}
+
 type logCtxKeyType int
 
 var logCtxKey logCtxKeyType
@@ -29,6 +37,12 @@ func setLogCtx(ctx context.Context, log Logger) context.Context {
 	return context.WithValue(ctx, logCtxKey, log)
 }
 
+// ContextWithLogger returns a context carrying the given Logger, this is only needed when using
+// components (like middleware) outside of a Scavenger.
+func ContextWithLogger(ctx context.Context, log Logger) context.Context {
+	return setLogCtx(ctx, log)
+}
+
 // LoggerFromContext retrieves a Logger from the given context,
 // it will panic if the Logger is not there.
 func LoggerFromContext(ctx context.Context) Logger {
@@ -36,6 +50,27 @@ func LoggerFromContext(ctx context.Context) Logger {
 	return value
 }
 
+type statsCtxKeyType int
+
+var statsCtxKey statsCtxKeyType
+
+func setStatsCtx(ctx context.Context, stats Stats) context.Context {
+	return context.WithValue(ctx, statsCtxKey, stats)
+}
+
+// ContextWithStats returns a context carrying the given Stats, this is only needed when using
+// components (like middleware) outside of a Scavenger.
+func ContextWithStats(ctx context.Context, stats Stats) context.Context {
+	return setStatsCtx(ctx, stats)
+}
+
+// StatsFromContext retrieves Stats from the given context,
+// it will panic if Stats is not there.
+func StatsFromContext(ctx context.Context) Stats {
+	value := ctx.Value(statsCtxKey).(Stats)
+	return value
+}
+
 // ShortUrl formats a url.URL without its schema for use in logging and errors.
 func ShortUrl(u *url.URL) string {
 	if u == nil {